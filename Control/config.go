@@ -3,11 +3,18 @@ package Control
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 
 	"process_data/config"
+	"process_data/lib/graphite"
 	"process_data/lib/logging"
+	"process_data/lib/prometheus"
+	ltime "process_data/lib/time"
 )
 
 type Config struct {
@@ -17,7 +24,13 @@ type Config struct {
 	config.KafkaConsumerConfig `toml:"kafka_consumer" json:"kafka_consumer"`
 	WorkerConfig               `toml:"worker" json:"worker"`
 	config.RedisCluster        `toml:"redis_cluster" json:"redis_cluster"`
-
+	DeadLetter                 DeadLetterConfig          `toml:"dead_letter" json:"dead_letter"`
+	Filter                     FilterConfig              `toml:"filter" json:"filter"`
+	Expr                       ExprConfig                `toml:"expr" json:"expr"`
+	FreqLog                    logging.FreqLogPoolConfig `toml:"freq_log" json:"freq_log"`
+	Graphite                   graphite.Config           `toml:"graphite" json:"graphite"`
+	Prometheus                 prometheus.Config         `toml:"prometheus" json:"prometheus"`
+	ShutdownTimeout            ltime.Duration            `toml:"shutdown_timeout" json:"shutdown_timeout"` // 退出时等待处理完缓冲消息的最长时间
 }
 
 func NewConfig(fname string) (*Config, error) {
@@ -33,6 +46,10 @@ func NewConfig(fname string) (*Config, error) {
 }
 
 func (c *Config) Validate() error {
+	sc, err := GetScene(c.Scene)
+	if err != nil {
+		return err
+	}
 	if err := c.LogConfig.Validate(); err != nil {
 		return err
 	}
@@ -45,6 +62,37 @@ func (c *Config) Validate() error {
 	if err := c.RedisCluster.Validate(); err != nil {
 		return err
 	}
+	if err := c.DeadLetter.Validate(); err != nil {
+		return err
+	}
+	if err := c.Filter.Validate(); err != nil {
+		return err
+	}
+	if err := c.Expr.Validate(); err != nil {
+		return err
+	}
+	if err := c.Expr.CheckFields(sc.ExprFields); err != nil {
+		return err
+	}
+	if err := c.FreqLog.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateFreqLogScan(); err != nil {
+		return err
+	}
+	// 未配置graphite.address时不启用
+	if len(c.Graphite.Address) == 0 {
+		c.Graphite.Disable = true
+	}
+	if err := c.Graphite.Validate(); err != nil {
+		return err
+	}
+	if err := c.Prometheus.Validate(); err != nil {
+		return err
+	}
+	if c.ShutdownTimeout.Duration == 0 {
+		c.ShutdownTimeout.Duration = 30 * time.Second
+	}
 
 	return nil
 }
@@ -58,3 +106,21 @@ func (c *Config) String() string {
 
 	return string(b)
 }
+
+// validateFreqLogScan 封存与删除目录时，log_file_path必须是专用的目录，不能是默认的/tmp/
+func (c *Config) validateFreqLogScan() error {
+	if !c.FreqLog.ScanEnabled() {
+		return nil
+	}
+	root := filepath.Clean(c.WorkerConfig.LogFilePath)
+	if root == "/" || root == "/tmp" || root == filepath.Clean(os.TempDir()) {
+		return fmt.Errorf("freq_log.seal_delay and retention_days require a dedicated worker.log_file_path, not %q", c.WorkerConfig.LogFilePath)
+	}
+	if !strings.HasSuffix(c.WorkerConfig.LogFilePath, "/") {
+		return fmt.Errorf("worker.log_file_path %q must end with \"/\"", c.WorkerConfig.LogFilePath)
+	}
+	if c.WorkerConfig.LogDirPattern() == nil {
+		return fmt.Errorf("freq_log.seal_delay and retention_days require worker.path_template with a directory, got %q", c.WorkerConfig.PathTemplate)
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package Control
 
+import "process_data/lib/prometheus"
+
 const (
 	FRQ_MSG_QPS              = "msg.qps"
 	FRQ_MSG_INVALID          = "msg.invalid"
@@ -7,8 +9,56 @@ const (
         FRQ_MSG_SUCC             = "msg.succ"
 	FRQ_MSG_RDS_SUCCESS      = "msg.process_data.set_ok"
 	FRQ_MSG_RDS_FAIL         = "msg.process_data.set_fail"
+	FRQ_MSG_RDS_RETRY        = "msg.process_data.set_retry" // 未配置死信时写入失败后重试的次数
 	FRQ_MSG_WRFILE_SUCCESS   = "msg.file.wrt_ok"
 	FRQ_MSG_WRFILE_FAIL      = "msg.file.wrt_fail"
 	FRQ_MSG_WRFILE_DIR__FAIL = "msg.file.wrt_dir_fail"
+	FRQ_MSG_FLUSH_FAIL       = "msg.file.flush_fail" // 缓冲写入文件失败的次数
 	FRQ_INPUT_CHAN_NODE_NAME = "inchan" // input chan
+	FRQ_MSG_DEAD_LETTER      = "msg.dead_letter.ok"
+	FRQ_MSG_DEAD_LETTER_FAIL = "msg.dead_letter.fail"
+	FRQ_RELOAD_SUCCESS       = "reload.succ"
+	FRQ_RELOAD_FAIL          = "reload.fail"
+	FRQ_MSG_FILTER           = "msg.filter" // 按规则名统计被过滤的消息 msg.filter.<rule>
+	FRQ_WORKER_NODE_NAME     = "worker"     // 按worker统计处理的消息 worker.<id>.qps
 )
+
+// 耗时指标，由graphite.Timing记录，输出 .p50 .p90 .p99 .max .count
+const (
+	FRQ_TIME_QUEUE       = "time.queue"       // 消费者收到消息到worker开始处理
+	FRQ_TIME_REDIS       = "time.redis"       // 单条写入redis
+	FRQ_TIME_REDIS_BATCH = "time.redis_batch" // 一次批量写入redis
+	FRQ_TIME_FILE_WRITE  = "time.file_write"  // 写FreqLog文件
+)
+
+// promRules graphite指标名到Prometheus指标名和标签的转换，scene标签由[prometheus.labels]添加
+var promRules = []prometheus.Rule{
+	{Pattern: FRQ_MSG_QPS, Name: "messages_received_total"},
+	{Pattern: FRQ_MSG_SUCC, Name: "messages_total", Labels: prometheus.Labels{"result": "succ"}},
+	{Pattern: FRQ_MSG_INVALID, Name: "messages_total", Labels: prometheus.Labels{"result": "invalid"}},
+	{Pattern: FRQ_MSG_IGNORE, Name: "messages_total", Labels: prometheus.Labels{"result": "ignore"}},
+	{Pattern: FRQ_MSG_FILTER + ".{rule}", Name: "messages_filtered_total"},
+	{Pattern: FRQ_MSG_RDS_SUCCESS, Name: "redis_writes_total", Labels: prometheus.Labels{"result": "ok"}},
+	{Pattern: FRQ_MSG_RDS_FAIL, Name: "redis_writes_total", Labels: prometheus.Labels{"result": "fail"}},
+	{Pattern: FRQ_MSG_RDS_RETRY, Name: "redis_write_retries_total"},
+	{Pattern: FRQ_MSG_WRFILE_SUCCESS, Name: "freq_log_writes_total", Labels: prometheus.Labels{"result": "ok"}},
+	{Pattern: FRQ_MSG_WRFILE_FAIL, Name: "freq_log_writes_total", Labels: prometheus.Labels{"result": "fail"}},
+	{Pattern: FRQ_MSG_WRFILE_DIR__FAIL, Name: "freq_log_writes_total", Labels: prometheus.Labels{"result": "dir_fail"}},
+	{Pattern: FRQ_MSG_FLUSH_FAIL, Name: "freq_log_flush_failures_total"},
+	{Pattern: FRQ_MSG_DEAD_LETTER, Name: "dead_letters_total", Labels: prometheus.Labels{"result": "ok"}},
+	{Pattern: FRQ_MSG_DEAD_LETTER_FAIL, Name: "dead_letters_total", Labels: prometheus.Labels{"result": "fail"}},
+	{Pattern: FRQ_RELOAD_SUCCESS, Name: "reloads_total", Labels: prometheus.Labels{"result": "succ"}},
+	{Pattern: FRQ_RELOAD_FAIL, Name: "reloads_total", Labels: prometheus.Labels{"result": "fail"}},
+	{Pattern: FRQ_WORKER_NODE_NAME + ".{worker}.qps", Name: "worker_messages_total"},
+	{Pattern: "{topic}.consume.qps", Name: "kafka_consumed_total"},
+	{Pattern: "{topic}.consume.error", Name: "kafka_consume_errors_total"},
+	{Pattern: "{topic}.consume.pause", Name: "kafka_consume_pauses_total"},
+	{Pattern: "{topic}.consume.unacked_age", Name: "kafka_oldest_unacked_age_seconds"},
+	{Pattern: "{topic}.produce.qps", Name: "kafka_produced_total"},
+	{Pattern: "{topic}.produce.error", Name: "kafka_produce_errors_total"},
+	{Pattern: "{topic}.produce.spill", Name: "kafka_produce_spilled_total"},
+	{Pattern: FRQ_TIME_QUEUE, Name: "queue_delay_seconds"},
+	{Pattern: FRQ_TIME_REDIS, Name: "redis_write_duration_seconds", Labels: prometheus.Labels{"mode": "single"}},
+	{Pattern: FRQ_TIME_REDIS_BATCH, Name: "redis_write_duration_seconds", Labels: prometheus.Labels{"mode": "batch"}},
+	{Pattern: FRQ_TIME_FILE_WRITE, Name: "freq_log_write_duration_seconds"},
+}
@@ -5,11 +5,14 @@ import (
 	"os"
 	"os/signal"
 	"process_data/config"
-	"process_data/Control/process_data"
+	"process_data/lib/graphite"
 	"process_data/lib/kafka"
 	"process_data/lib/logging"
+	"process_data/lib/prometheus"
+	"reflect"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type FreqControl struct {
@@ -22,6 +25,11 @@ type FreqControl struct {
 	workers              []*Worker
 	consumeMsgCh         config.KafkaConsumerMsgCh
 	rediswr              RedisStorager
+	deadLetter           DeadLetterSink
+	decoders             *TopicDecoders
+	freqLogs             *logging.FreqLogPool
+	graphite             *graphite.Graphite
+	prometheus           *prometheus.Exporter // 为nil时未启用
 }
 
 func New(fname string) *FreqControl {
@@ -44,6 +52,16 @@ func (frq *FreqControl) loadServerConfig() error {
 		return err
 	}
 	frq.Logger = logging.NewLoggerWithConfig(&frq.cfg.LogConfig)
+	SetFilter(&frq.cfg.Filter)
+	SetExpr(&frq.cfg.Expr)
+	sc, err := GetScene(frq.Scene)
+	if err != nil {
+		return err
+	}
+	if frq.decoders, err = NewTopicDecoders(sc, &frq.cfg.KafkaConsumerConfig); err != nil {
+		frq.Logger.Errorf("load configuration failed: %s", err)
+		return err
+	}
 	frq.consumeMsgCh = make(config.KafkaConsumerMsgCh, frq.cfg.KafkaConsumerConfig.ChannelBufferSize)
 
 	return nil
@@ -96,6 +114,15 @@ func (frq *FreqControl) Server(isTest bool) error {
 
 func (frq *FreqControl) init() error {
 	frq.Logger.Info("Init ...")
+	if err := frq.initPrometheus(); err != nil {
+		return err
+	}
+	frq.initGraphite()
+	if err := frq.initDeadLetter(); err != nil {
+		return err
+	}
+	frq.freqLogs = logging.NewFreqLogPool(frq.cfg.WorkerConfig.LogFilePath, frq.cfg.WorkerConfig.LogDirPattern(), &frq.cfg.FreqLog)
+	frq.freqLogs.SetErrorHandler(frq.freqLogError)
 	if err := frq.initWorker(); err != nil {
 		return err
 	}
@@ -106,6 +133,47 @@ func (frq *FreqControl) init() error {
 	return nil
 }
 
+// freqLogError FreqLog缓冲写入文件失败，这些消息不会被确认，重启后重新消费
+func (frq *FreqControl) freqLogError(path string, err error, unacked int) {
+	graphite.Add(FRQ_MSG_FLUSH_FAIL, 1)
+	frq.Logger.Errorf("flush freq log %s failed, %d messages not acknowledged: %s", path, unacked, err)
+}
+
+// initGraphite 启动定期刷新指标，并监控consumeMsgCh的长度和容量
+func (frq *FreqControl) initGraphite() {
+	frq.graphite = graphite.NewWithConfig(&frq.cfg.Graphite, frq.Logger)
+	go frq.graphite.Start()
+	graphite.MonitorChan(FRQ_INPUT_CHAN_NODE_NAME, frq.consumeMsgCh)
+	if frq.cfg.Graphite.Disable {
+		frq.Logger.Info("graphite disabled")
+	} else {
+		frq.Logger.Infof("graphite started, flush %s to %s every %s", frq.cfg.Graphite.Format, frq.cfg.Graphite.Address, frq.cfg.Graphite.FlushInterval.Duration)
+	}
+}
+
+// initPrometheus 在prometheus.listen上输出/metrics，与graphite同时接收指标
+// 需在initGraphite之前注册，以便接收MonitorChan
+func (frq *FreqControl) initPrometheus() error {
+	cfg := frq.cfg.Prometheus
+	if len(cfg.Listen) == 0 {
+		return nil
+	}
+	labels := map[string]string{"scene": frq.Scene}
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	cfg.Labels = labels
+	exporter := prometheus.New(&cfg, promRules, frq.Logger)
+	if err := exporter.Start(); err != nil {
+		frq.Logger.Errorf("prometheus listen %s failed: %s", cfg.Listen, err)
+		return err
+	}
+	graphite.AddBackend(exporter)
+	frq.prometheus = exporter
+	frq.Logger.Infof("prometheus started, http://%s%s", cfg.Listen, cfg.Path)
+	return nil
+}
+
 func (frq *FreqControl) initKafkaConsumerManager() error {
 
 	kcm, err := kafka.NewKafkaConsumerManager(&frq.cfg.KafkaConsumerConfig,
@@ -120,40 +188,60 @@ func (frq *FreqControl) initKafkaConsumerManager() error {
 	return nil
 }
 
-func (frq *FreqControl) initWorker() error {
-
-	var err1 error
-	var rdsStorager RedisStorager            //add counterStorager for mainfeed
+func (frq *FreqControl) initDeadLetter() error {
+	sink, err := NewDeadLetterSink(&frq.cfg.DeadLetter, frq.Logger)
+	if err != nil {
+		frq.Logger.Errorf("init dead letter(%s) failed: %s", frq.cfg.DeadLetter.Type, err)
+		return err
+	}
+	frq.deadLetter = sink
+	return nil
+}
 
-	switch frq.Scene {
+// newWorker 以当前配置创建第i个worker
+func (frq *FreqControl) newWorker(i int) (*Worker, error) {
+	worker, err := NewWorker(
+		frq.Scene,
+		i,
+		frq.cfg,
+		frq.Logger,
+		frq.rediswr,
+		frq.consumeMsgCh)
+	if err != nil {
+		return nil, err
+	}
+	worker.WorkerCnf = frq.cfg.WorkerConfig
+	worker.deadLetter = frq.deadLetter
+	if frq.decoders != nil {
+		worker.decoders = frq.decoders
+	}
+	worker.freqLogs = frq.freqLogs
+	return worker, nil
+}
 
+func (frq *FreqControl) initWorker() error {
 
-	case "process_data":
-		rdsStorager, err1 = process_data.NewRedisStorager(frq.Logger, &frq.cfg.RedisCluster)
+	sc, err := GetScene(frq.Scene)
+	if err != nil {
+		frq.Logger.Errorf("initWorker fail: %s", err)
+		return err
 	}
-	if err1 != nil {
-		frq.Logger.Infof("NEW %s RedisStorager faild:%s", frq.Scene, err1)
-		return err1
+	rdsStorager, err := sc.NewStorager(frq.Logger, &frq.cfg.RedisCluster)
+	if err != nil {
+		frq.Logger.Infof("NEW %s RedisStorager faild:%s", frq.Scene, err)
+		return err
 	}
 
-
 	frq.Logger.Infof("%s Control Redis Storager started", frq.Scene)
 	frq.rediswr = rdsStorager
 
 	frq.workers = make([]*Worker, frq.cfg.WorkerConfig.Routines)
 	for i := 0; i < frq.cfg.WorkerConfig.Routines; i++ {
-		worker, err := NewWorker(
-			frq.Scene,
-			i,
-			frq.cfg,
-			frq.Logger,
-			frq.rediswr,
-			frq.consumeMsgCh)
+		worker, err := frq.newWorker(i)
 		if err != nil {
 			frq.Logger.Errorf("initWorker fail: %s", err)
 			return err
 		}
-		worker.WorkerCnf = frq.cfg.WorkerConfig
 		frq.workers[i] = worker
 	}
 	frq.Logger.Info("init worker success")
@@ -177,41 +265,130 @@ func (frq *FreqControl) start() error {
 //简单使用就是在创建一个任务的时候wg.Add(1), 任务完成的时候使用wg.Done()来将任务减一。使用wg.Wait()来阻塞等待所有任务完成。
 //再强制杀死进程时，触发该信号，等所有任务完成后结束
 func (frq *FreqControl) startWorker() error {
-	for i := 0; i < frq.cfg.WorkerConfig.Routines; i++ {
-		worker := frq.workers[i]
+	for _, worker := range frq.workers {
 		frq.wg.Add(1)
 		go worker.Start(&frq.wg)
 	}
 	return nil
 }
 
+// stop 按顺序停止：停止拉取 -> worker处理完consumeMsgCh中缓冲的消息 -> 提交offset -> 关闭redis和死信
+// 超过shutdown_timeout仍未完成时停止worker并放弃剩余消息，已确认的offset仍提交，未确认的消息重启后重新消费
 func (frq *FreqControl) stop() error { //stop consumer first then worker
 	frq.Logger.Info("Stoping...")
-	if err := frq.kafkaConsumerManager.Stop(); err != nil {
+	timeout := frq.cfg.ShutdownTimeout.Duration
+
+	cancel := make(chan struct{})
+	drained := make(chan error, 1)
+	go func() {
+		drained <- frq.drain(cancel)
+	}()
+	var err error
+	select {
+	case err = <-drained:
+	case <-time.After(timeout):
+		frq.Logger.Errorf("shutdown timeout(%s), abandoned %d buffered messages, %d unacknowledged messages",
+			timeout, len(frq.consumeMsgCh), frq.kafkaConsumerManager.Pending())
+		close(cancel)
+		err = <-drained
+		if err == nil {
+			err = fmt.Errorf("shutdown timeout(%s)", timeout)
+		}
+	}
+
+	if cerr := frq.closeAll(); err == nil {
+		err = cerr
+	}
+	if err != nil {
 		return err
 	}
+	frq.Logger.Info("all Stoped")
+	return nil
+}
 
+// drain 停止拉取消息，等待worker处理完缓冲的消息后提交offset
+// cancel关闭时不再等待缓冲的消息，通知worker处理完当前消息后退出，只提交已确认的offset
+func (frq *FreqControl) drain(cancel <-chan struct{}) error {
+	if err := frq.kafkaConsumerManager.StopFetch(); err != nil {
+		return err
+	}
+
+	// consumeMsgCh已关闭，worker处理完缓冲的消息后自行退出
+	frq.Logger.Infof("Waiting, %d buffered messages", len(frq.consumeMsgCh))
+	done := make(chan struct{})
+	go func() {
+		frq.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-cancel:
+		frq.Logger.Info("drain canceled, stop workers")
+	}
+	// 通知仍在重试redis的worker退出
 	if err := frq.stopWorker(); err != nil {
 		return err
 	}
-	frq.Logger.Info("Waiting")
-	frq.wg.Wait()
+	<-done
 
+	// 写入FreqLog文件后消息才被确认，提交offset前写入缓冲
+	if err := frq.freqLogs.Flush(); err != nil {
+		frq.Logger.Errorf("freq log files flush failed: %s", err)
+	}
+	if err := frq.kafkaConsumerManager.Close(); err != nil {
+		return err
+	}
+	frq.Logger.Info("kafka offsets committed")
+	return nil
+}
+
+// closeAll 关闭FreqLog文件、redis、死信与指标，出错时继续关闭其余的，返回第一个错误
+func (frq *FreqControl) closeAll() error {
+	var closeErr error
+	if err := frq.freqLogs.Close(); err != nil {
+		frq.Logger.Errorf("freq log files close failed: %s", err)
+		closeErr = err
+	} else {
+		frq.Logger.Info("freq log files flushed and closed!")
+	}
 
 	if err := frq.rediswr.CloseRedis(); err != nil {
 		frq.Logger.Infof("redis storager.Close() failed: %s", err)
-		return err
+		if closeErr == nil {
+			closeErr = err
+		}
+	} else {
+		frq.Logger.Info("redis storager closed!")
 	}
-	frq.Logger.Info("redis storager closed!")
 
-	frq.Logger.Info("all Stoped")
-	return nil
+	if frq.deadLetter != nil {
+		if err := frq.deadLetter.Close(); err != nil {
+			frq.Logger.Infof("dead letter.Close() failed: %s", err)
+			if closeErr == nil {
+				closeErr = err
+			}
+		} else {
+			frq.Logger.Info("dead letter closed!")
+		}
+	}
+
+	if frq.graphite != nil {
+		frq.graphite.Stop()
+		frq.Logger.Info("graphite stoped!")
+	}
+	if frq.prometheus != nil {
+		graphite.RemoveBackend(frq.prometheus)
+		if err := frq.prometheus.Stop(); err != nil {
+			frq.Logger.Infof("prometheus.Stop() failed: %s", err)
+		}
+		frq.Logger.Info("prometheus stoped!")
+	}
+	return closeErr
 }
 
 func (frq *FreqControl) stopWorker() error {
 	frq.Logger.Info("stop woker")
-	for i := 0; i < frq.cfg.WorkerConfig.Routines; i++ {
-		worker := frq.workers[i]
+	for i, worker := range frq.workers {
 		worker.Stop()
 		frq.Logger.Infof("stop woker:%d", i)
 	}
@@ -219,7 +396,122 @@ func (frq *FreqControl) stopWorker() error {
 	return nil
 }
 
+// resizeWorker 将worker数量调整为n, 多出的worker处理完当前消息后退出
+func (frq *FreqControl) resizeWorker(n int) error {
+	cur := len(frq.workers)
+	for i := cur; i < n; i++ {
+		worker, err := frq.newWorker(i)
+		if err != nil {
+			frq.Logger.Errorf("resizeWorker fail: %s", err)
+			return err
+		}
+		frq.workers = append(frq.workers, worker)
+		frq.wg.Add(1)
+		go worker.Start(&frq.wg)
+	}
+	for i := n; i < cur; i++ {
+		frq.workers[i].Stop()
+	}
+	if n < cur {
+		frq.workers = frq.workers[:n]
+	}
+	if n != cur {
+		frq.Logger.Infof("worker routines: %d -> %d", cur, n)
+	}
+	return nil
+}
+
+// reload 重新加载配置文件，新配置不合法时保留旧配置
+// 热加载生效：日志级别与日志文件、worker.routines、redis连接池大小与ttl、filter、expr，其余配置需重启生效
 func (frq *FreqControl) reload() error {
-	frq.Logger.Info("Do nothing")
+	frq.Logger.Infof("reload configuration %s", frq.cfgFname)
+	cfg, err := NewConfig(frq.cfgFname)
+	if err != nil {
+		graphite.Add(FRQ_RELOAD_FAIL, 1)
+		frq.Logger.Errorf("reload configuration failed, keep the old one: %s", err)
+		return err
+	}
+	old := frq.cfg
+	frq.warnRestartRequired(old, cfg)
+
+	// 不支持热加载的配置保持不变
+	cfg.Scene = old.Scene
+	cfg.KafkaConsumerConfig = old.KafkaConsumerConfig
+	cfg.DeadLetter = old.DeadLetter
+	cfg.FreqLog = old.FreqLog
+	cfg.Graphite = old.Graphite
+	cfg.Prometheus = old.Prometheus
+	routines := cfg.WorkerConfig.Routines
+	cfg.WorkerConfig = old.WorkerConfig
+	cfg.WorkerConfig.Routines = routines
+	rediscfg := old.RedisCluster
+	rediscfg.MaxIdle = cfg.RedisCluster.MaxIdle
+	rediscfg.MaxActive = cfg.RedisCluster.MaxActive
+	rediscfg.TTL = cfg.RedisCluster.TTL
+	cfg.RedisCluster = rediscfg
+
+	// 先检查所有会被拒绝的配置，失败时不修改任何正在使用的配置
+	if err := logging.CheckReloadLoggerConfig(&old.LogConfig, &cfg.LogConfig); err != nil {
+		graphite.Add(FRQ_RELOAD_FAIL, 1)
+		frq.Logger.Errorf("reload logging failed, keep the old configuration: %s", err)
+		return err
+	}
+	if rr, ok := frq.rediswr.(RedisReloader); ok {
+		if err := rr.ReloadRedis(&cfg.RedisCluster); err != nil {
+			graphite.Add(FRQ_RELOAD_FAIL, 1)
+			frq.Logger.Errorf("reload redis failed, keep the old configuration: %s", err)
+			return err
+		}
+	}
+	// 检查通过后日志配置总会生效，出错时为关闭旧日志文件失败
+	if err := logging.ReloadLoggerWithConfig(frq.Logger, &old.LogConfig, &cfg.LogConfig); err != nil {
+		frq.Logger.Errorf("reload logging: %s", err)
+	}
+	frq.cfg = cfg
+	SetFilter(&cfg.Filter)
+	SetExpr(&cfg.Expr)
+	if err := frq.resizeWorker(cfg.WorkerConfig.Routines); err != nil {
+		graphite.Add(FRQ_RELOAD_FAIL, 1)
+		return err
+	}
+
+	graphite.Add(FRQ_RELOAD_SUCCESS, 1)
+	frq.Logger.Infof("reload configuration success")
 	return nil
 }
+
+// warnRestartRequired 记录需要重启才能生效的配置变化
+func (frq *FreqControl) warnRestartRequired(old *Config, cfg *Config) {
+	if old.Scene != cfg.Scene {
+		frq.Logger.Warnf("reload: scene changed (%s -> %s), restart required", old.Scene, cfg.Scene)
+	}
+	if !reflect.DeepEqual(old.KafkaConsumerConfig, cfg.KafkaConsumerConfig) {
+		frq.Logger.Warn("reload: kafka_consumer changed, restart required")
+	}
+	if !reflect.DeepEqual(old.DeadLetter, cfg.DeadLetter) {
+		frq.Logger.Warn("reload: dead_letter changed, restart required")
+	}
+	if old.FreqLog != cfg.FreqLog {
+		frq.Logger.Warn("reload: freq_log changed, restart required")
+	}
+	if !reflect.DeepEqual(old.Graphite, cfg.Graphite) {
+		frq.Logger.Warn("reload: graphite changed, restart required")
+	}
+	if !reflect.DeepEqual(old.Prometheus, cfg.Prometheus) {
+		frq.Logger.Warn("reload: prometheus changed, restart required")
+	}
+	ow, nw := old.WorkerConfig, cfg.WorkerConfig
+	ow.Routines, ow.location, nw.location = nw.Routines, nil, nil
+	if ow != nw {
+		frq.Logger.Warn("reload: worker changed (except routines), restart required")
+	}
+	if !reflect.DeepEqual(old.RedisCluster.Servers, cfg.RedisCluster.Servers) ||
+		old.RedisCluster.Hasher != cfg.RedisCluster.Hasher ||
+		old.RedisCluster.Mode != cfg.RedisCluster.Mode ||
+		old.RedisCluster.Database != cfg.RedisCluster.Database {
+		frq.Logger.Warn("reload: redis_cluster nodes changed, restart required")
+	}
+	if old.RedisCluster.Transmit != cfg.RedisCluster.Transmit {
+		frq.Logger.Warn("reload: redis_cluster.transmit changed, restart required")
+	}
+}
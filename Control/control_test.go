@@ -0,0 +1,42 @@
+package Control
+
+import (
+	"testing"
+	"time"
+
+	"process_data/config"
+	"process_data/lib/logging"
+)
+
+func TestResizeWorker(t *testing.T) {
+	frq := &FreqControl{
+		Scene:        "process_data",
+		cfg:          &Config{WorkerConfig: WorkerConfig{Routines: 1}},
+		Logger:       logging.DefaultLogger(),
+		consumeMsgCh: make(config.KafkaConsumerMsgCh, 1),
+	}
+	if err := frq.resizeWorker(4); err != nil {
+		t.Fatal(err)
+	}
+	if len(frq.workers) != 4 {
+		t.Fatalf("workers %d except 4", len(frq.workers))
+	}
+	if err := frq.resizeWorker(1); err != nil {
+		t.Fatal(err)
+	}
+	if len(frq.workers) != 1 {
+		t.Fatalf("workers %d except 1", len(frq.workers))
+	}
+
+	close(frq.consumeMsgCh)
+	done := make(chan struct{})
+	go func() {
+		frq.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("workers did not exit")
+	}
+}
@@ -0,0 +1,238 @@
+package Control
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"process_data/config"
+	"process_data/lib/kafka"
+	"process_data/lib/logging"
+)
+
+// DeadLetterConfig 处理失败消息的去向，Type为空时不启用
+//	* file  写入本地滚动文件，每行一个DeadLetter的JSON
+//	* kafka 写入kafka topic(Topics[0])，消息key为源topic
+type DeadLetterConfig struct {
+	Type  string                      `toml:"type" json:"type"`
+	File  *logging.LogFile            `toml:"file" json:"file"`
+	Kafka *config.KafkaProducerConfig `toml:"kafka" json:"kafka"`
+}
+
+func (c *DeadLetterConfig) Validate() error {
+	switch c.Type {
+	case "":
+		return nil
+	case "file":
+		if c.File == nil {
+			return fmt.Errorf("dead_letter.file is invalid")
+		}
+		return c.File.Validate()
+	case "kafka":
+		if c.Kafka == nil {
+			return fmt.Errorf("dead_letter.kafka is invalid")
+		}
+		return c.Kafka.Validate()
+	}
+	return fmt.Errorf("dead_letter.type %q is invalid, must be file or kafka", c.Type)
+}
+
+// DeadLetter 一条处理失败的消息
+type DeadLetter struct {
+	Payload   []byte    `json:"payload"`
+	Reason    string    `json:"reason"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func NewDeadLetter(msg *config.KafkaConsumerMsg, reason error) *DeadLetter {
+	return &DeadLetter{
+		Payload:   msg.Value,
+		Reason:    reason.Error(),
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: time.Now(),
+	}
+}
+
+// DeadLetterSink 死信的写入端，需goroutine-safe
+type DeadLetterSink interface {
+	Write(*DeadLetter) error
+	Close() error
+}
+
+// NewDeadLetterSink 按配置创建死信写入端，未启用时返回nil
+func NewDeadLetterSink(cfg *DeadLetterConfig, lg logging.Logger) (DeadLetterSink, error) {
+	switch cfg.Type {
+	case "file":
+		if err := cfg.File.Open(); err != nil {
+			return nil, err
+		}
+		return &fileDeadLetterSink{file: cfg.File}, nil
+	case "kafka":
+		sink, err := newKafkaDeadLetterSink(cfg.Kafka, lg)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
+	return nil, nil
+}
+
+type fileDeadLetterSink struct {
+	file *logging.LogFile
+}
+
+func (s *fileDeadLetterSink) Write(dl *DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+func (s *fileDeadLetterSink) Close() error {
+	return s.file.Close()
+}
+
+// kafkaDeadLetterSink 写入KafkaProducerManager，发送失败的死信由其写入local_file
+// Write等待kafka确认或写入local_file后返回，local_file中的死信可以用replay-dlq重放
+type kafkaDeadLetterSink struct {
+	ch  config.KafkaProducerMsgCh
+	kpm *kafka.KafkaProducerManager
+}
+
+func newKafkaDeadLetterSink(cfg *config.KafkaProducerConfig, lg logging.Logger) (*kafkaDeadLetterSink, error) {
+	ch := make(config.KafkaProducerMsgCh, cfg.ChannelBufferSize)
+	kpm, err := kafka.NewKafkaProducerManager(cfg, lg, ch)
+	if err != nil {
+		return nil, err
+	}
+	if err := kpm.Init(); err != nil {
+		return nil, err
+	}
+	if err := kpm.Start(); err != nil {
+		return nil, err
+	}
+	return &kafkaDeadLetterSink{ch: ch, kpm: kpm}, nil
+}
+
+func (s *kafkaDeadLetterSink) Write(dl *DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	s.ch <- &config.KafkaProducerMsg{Key: []byte(dl.Topic), Value: b, Result: result}
+	return <-result
+}
+
+func (s *kafkaDeadLetterSink) Close() error {
+	return s.kpm.Stop()
+}
+
+// ReplayDeadLetter 将死信文件中的消息重新走一遍场景的处理流程
+// 重放时不再写入死信，仍失败的消息输出到日志，被过滤或忽略的消息视为已处理
+// .gz文件为file.compress压缩后的死信文件；fname为"-"时从标准输入读取
+// kafka死信：local_file中的死信可直接重放；topic中每条消息为一行死信，可导出后重放，如
+//
+//	kafka-console-consumer.sh --bootstrap-server <broker> --topic <dlq> --from-beginning | process_data Control replay-dlq --config=<x.toml> --file=-
+func (frq *FreqControl) ReplayDeadLetter(fname string) error {
+	if err := frq.loadServerConfig(); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if fname != "-" {
+		f, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if strings.HasSuffix(fname, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	sc, err := GetScene(frq.Scene)
+	if err != nil {
+		return err
+	}
+	rdsStorager, err := sc.NewStorager(frq.Logger, &frq.cfg.RedisCluster)
+	if err != nil {
+		return err
+	}
+	frq.rediswr = rdsStorager
+	defer frq.rediswr.CloseRedis()
+	// 封存由运行中的服务负责，重放只写入文件
+	frq.freqLogs = logging.NewFreqLogPool("", nil, &frq.cfg.FreqLog)
+	defer frq.freqLogs.Close()
+
+	worker, err := frq.newWorker(0)
+	if err != nil {
+		return err
+	}
+	worker.deadLetter = nil
+	worker.noRetry = true
+	worker.batcher = nil // 逐条写入，以便统计失败数
+
+	total, filtered, failed, err := replayDeadLetters(worker, r)
+	if err != nil {
+		return err
+	}
+	frq.Logger.Infof("replay %s: %d records, %d filtered, %d failed", fname, total, filtered, failed)
+	if failed > 0 {
+		return fmt.Errorf("replay %s: %d of %d records failed", fname, failed, total)
+	}
+	return nil
+}
+
+// replayDeadLetters 逐行重放死信，filtered为被过滤的消息数
+func replayDeadLetters(w *Worker, r io.Reader) (total, filtered, failed int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		total++
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			failed++
+			w.Logger.Errorf("replay line %d: %s", total, err)
+			continue
+		}
+		msg := &config.KafkaConsumerMsg{
+			Value:     dl.Payload,
+			Topic:     dl.Topic,
+			Partition: dl.Partition,
+			Offset:    dl.Offset,
+		}
+		err := w.process(msg)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrorFiltered):
+			filtered++
+		default:
+			failed++
+			w.Logger.Errorf("replay %s/%d/%d failed: %s", dl.Topic, dl.Partition, dl.Offset, err)
+		}
+	}
+	return total, filtered, failed, scanner.Err()
+}
@@ -0,0 +1,130 @@
+package Control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"process_data/config"
+	"process_data/lib/logging"
+)
+
+func TestFileDeadLetterSink(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "process_data_dlq_test")
+	defer os.RemoveAll(dir)
+
+	cfg := &DeadLetterConfig{
+		Type: "file",
+		File: &logging.LogFile{FileName: "dlq.log", LogPath: dir},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewDeadLetterSink(cfg, logging.DefaultLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &config.KafkaConsumerMsg{Value: []byte(`{"uid":"1"`), Topic: "t1", Partition: 2, Offset: 3}
+	if err := sink.Write(NewDeadLetter(msg, errors.New("unexpected end of JSON input"))); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "dlq-*.log"))
+	if len(files) != 1 {
+		t.Fatalf("dead letter files %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Fatal("dead letter file is empty")
+	}
+	var dl DeadLetter
+	if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+		t.Fatal(err)
+	}
+	if string(dl.Payload) != string(msg.Value) || dl.Topic != "t1" || dl.Partition != 2 || dl.Offset != 3 {
+		t.Errorf("dead letter %+v", dl)
+	}
+}
+
+func TestDeadLetterConfigValidate(t *testing.T) {
+	for _, cfg := range []DeadLetterConfig{{Type: "file"}, {Type: "kafka"}, {Type: "mysql"}} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", cfg)
+		}
+	}
+}
+
+// failSink 写入死信总是失败
+type failSink struct{}
+
+func (failSink) Write(*DeadLetter) error { return errors.New("dead letter down") }
+func (failSink) Close() error            { return nil }
+
+// 非法消息在未启用死信或写入死信成功时确认，写入死信失败时不确认
+func TestInvalidMessageAck(t *testing.T) {
+	w, err := NewWorker("freq", 0, &Config{}, logging.DefaultLogger(), &batchStorager{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WorkerCnf = WorkerConfig{LogFileNum: 64}
+	for _, tc := range []struct {
+		sink  DeadLetterSink
+		acked bool
+	}{
+		{nil, true},
+		{failSink{}, false},
+	} {
+		w.deadLetter = tc.sink
+		acked := false
+		msg := &config.KafkaConsumerMsg{Value: []byte("ad_1|pos"), AckFunc: func() { acked = true }}
+		if err := w.process(msg); err == nil {
+			t.Fatal("message should be invalid")
+		}
+		if acked != tc.acked {
+			t.Errorf("sink %T: acked %v, except %v", tc.sink, acked, tc.acked)
+		}
+	}
+}
+
+// 重放时被过滤的消息视为已处理，非法的行与消息计入失败
+func TestReplayDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWorker("freq", 0, &Config{}, logging.DefaultLogger(), &batchStorager{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WorkerCnf = WorkerConfig{LogFileNum: 64, LogFilePath: dir + "/"}
+	expr := &ExprConfig{Filter: `uid != "2780123002"`}
+	if err := expr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	SetExpr(expr)
+	defer SetExpr(&ExprConfig{})
+
+	var buf bytes.Buffer
+	for _, payload := range []string{"ad_1|pos|33|CMCC|2780123001|iphone|", "ad_2|pos|33|CMCC|2780123002|iphone|", "ad_3|pos"} {
+		b, _ := json.Marshal(&DeadLetter{Payload: []byte(payload), Topic: "t1"})
+		buf.Write(append(b, '\n'))
+	}
+	buf.WriteString("not json\n")
+	total, filtered, failed, err := replayDeadLetters(w, &buf)
+	if err != nil || total != 4 || filtered != 1 || failed != 2 {
+		t.Errorf("total %d, filtered %d, failed %d, err %v", total, filtered, failed, err)
+	}
+}
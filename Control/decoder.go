@@ -0,0 +1,59 @@
+package Control
+
+import (
+	"fmt"
+
+	"process_data/config"
+	"process_data/lib/codec"
+)
+
+// TopicDecoders 按topic选择解码器，未配置的topic使用kafka_consumer.decoder
+type TopicDecoders struct {
+	def    codec.Decoder
+	topics map[string]codec.Decoder
+}
+
+// NewTopicDecoders 创建场景的解码器，cfg为nil时所有topic使用场景的默认解码器
+func NewTopicDecoders(sc *Scene, cfg *config.KafkaConsumerConfig) (*TopicDecoders, error) {
+	d := &TopicDecoders{topics: map[string]codec.Decoder{}}
+	var dc *codec.Config
+	if cfg != nil {
+		dc = &cfg.Decoder
+	}
+	def, err := newSceneDecoder(sc, dc)
+	if err != nil {
+		return nil, fmt.Errorf("kafka.decoder: %s", err)
+	}
+	d.def = def
+	if cfg == nil {
+		return d, nil
+	}
+	for topic, c := range cfg.TopicDecoders {
+		td, err := newSceneDecoder(sc, c)
+		if err != nil {
+			return nil, fmt.Errorf("kafka.topic_decoder.%s: %s", topic, err)
+		}
+		d.topics[topic] = td
+	}
+	return d, nil
+}
+
+// newSceneDecoder type为空时使用场景的默认解码器
+func newSceneDecoder(sc *Scene, c *codec.Config) (codec.Decoder, error) {
+	if c == nil || len(c.Type) == 0 {
+		c = &sc.Codec
+	}
+	if len(c.Type) == 0 {
+		return codec.JSONDecoder{}, nil
+	}
+	cc := *c
+	return codec.New(&cc)
+}
+
+// Decode 用topic对应的解码器解码消息
+func (d *TopicDecoders) Decode(topic string, msg []byte) (codec.Record, error) {
+	if td, ok := d.topics[topic]; ok {
+		return td.Decode(msg)
+	}
+	return d.def.Decode(msg)
+}
@@ -0,0 +1,167 @@
+package Control
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"process_data/Control/process_data"
+	"process_data/lib/codec"
+	"process_data/lib/expr"
+)
+
+// ExprConfig [expr] 表达式过滤与redis value的字段映射，在[filter]之后、写入redis之前执行
+// 表达式语法见lib/expr，字段取自场景解析后的记录(process_data为ResultST的json名)，
+// 场景未提供时取自解码后的消息，支持热加载
+type ExprConfig struct {
+	Filter string            `toml:"filter" json:"filter"` // 结果为false时过滤，计入 msg.filter.expr
+	Value  map[string]string `toml:"value" json:"value"`   // redis value的JSON字段名 = 表达式，为空时不映射
+
+	filter *expr.Program
+	value  []exprField
+}
+
+type exprField struct {
+	name    string
+	program *expr.Program
+}
+
+// ExprRule 表达式过滤在指标与FilterError中使用的规则名
+const ExprRule = "expr"
+
+func (c *ExprConfig) Validate() error {
+	c.filter = nil
+	if len(c.Filter) > 0 {
+		p, err := expr.Compile(c.Filter)
+		if err != nil {
+			return fmt.Errorf("expr.filter: %s", err)
+		}
+		c.filter = p
+	}
+	c.value = nil
+	names := []string{}
+	for name := range c.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, err := expr.Compile(c.Value[name])
+		if err != nil {
+			return fmt.Errorf("expr.value.%s: %s", name, err)
+		}
+		c.value = append(c.value, exprField{name: name, program: p})
+	}
+	return nil
+}
+
+// CheckFields 检查表达式引用的字段都在fields中，fields为空时不检查
+func (c *ExprConfig) CheckFields(fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f] = true
+	}
+	check := func(key string, p *expr.Program) error {
+		for _, f := range p.Fields() {
+			if !known[f] {
+				return fmt.Errorf("%s: unknown field %q, available: %s", key, f, strings.Join(fields, ","))
+			}
+		}
+		return nil
+	}
+	if c.filter != nil {
+		if err := check("expr.filter", c.filter); err != nil {
+			return err
+		}
+	}
+	for _, f := range c.value {
+		if err := check("expr.value."+f.name, f.program); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExprRecord 提供表达式字段的Record
+type ExprRecord interface {
+	ExprEnv() expr.Env
+}
+
+// exprRecord value经过字段映射的Record
+type exprRecord struct {
+	Record
+	value string
+}
+
+func (r *exprRecord) GetRedisValue() (string, error) {
+	return r.value, nil
+}
+
+// exprTransmitRecord 映射后的value作为转发集合的成员
+type exprTransmitRecord struct {
+	exprRecord
+	tr TransmitRecord
+}
+
+func (r *exprTransmitRecord) GetTransmit() (string, *process_data.Transmit) {
+	srcMid, t := r.tr.GetTransmit()
+	t.Member = r.value
+	return srcMid, t
+}
+
+// Apply 执行表达式过滤与字段映射，过滤时返回*FilterError
+func (c *ExprConfig) Apply(rec Record, data codec.Record) (Record, error) {
+	if c == nil || (c.filter == nil && len(c.value) == 0) {
+		return rec, nil
+	}
+	var env expr.Env = data
+	if er, ok := rec.(ExprRecord); ok {
+		env = er.ExprEnv()
+	}
+	if c.filter != nil {
+		ok, err := c.filter.EvalBool(env)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &FilterError{Rule: ExprRule}
+		}
+	}
+	if len(c.value) == 0 {
+		return rec, nil
+	}
+	m := make(map[string]interface{}, len(c.value))
+	for _, f := range c.value {
+		v, err := f.program.Eval(env)
+		if err != nil {
+			return nil, err
+		}
+		m[f.name] = v
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	er := exprRecord{Record: rec, value: string(b)}
+	if tr, ok := rec.(TransmitRecord); ok {
+		return &exprTransmitRecord{exprRecord: er, tr: tr}, nil
+	}
+	return &er, nil
+}
+
+// msgExpr 当前生效的表达式，热加载时整体替换
+var msgExpr atomic.Value
+
+// SetExpr 替换当前生效的表达式
+func SetExpr(c *ExprConfig) {
+	msgExpr.Store(c)
+}
+
+func currentExpr() *ExprConfig {
+	c, _ := msgExpr.Load().(*ExprConfig)
+	return c
+}
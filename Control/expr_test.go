@@ -0,0 +1,209 @@
+package Control
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alicebob/miniredis"
+
+	"process_data/Control/process_data"
+	"process_data/config"
+	"process_data/lib/codec"
+	"process_data/lib/logging"
+	ltime "process_data/lib/time"
+)
+
+func TestExprApply(t *testing.T) {
+	var cfg struct {
+		Expr ExprConfig `toml:"expr"`
+	}
+	data := `
+[expr]
+filter = 'event == 2 && follow > 500 && !(state in [12..15])'
+[expr.value]
+uid = 'uid'
+src = 'src_uid + ":" + src_mid'
+`
+	if _, err := toml.Decode(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Expr.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := GetScene("process_data")
+	parse := func(msg string) (Record, error) {
+		data, err := codec.JSONDecoder{}.Decode([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := s.Parser(data, &WorkerConfig{LogFilePath: "/tmp/", LogFileNum: 64})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg.Expr.Apply(rec, data)
+	}
+
+	_, err := parse(`{"uid":"1","mid":"2","follow":200,"src_uid":"3","src_mid":"4","state":1,"event":2}`)
+	var fe *FilterError
+	if !errors.Is(err, ErrorFiltered) || !errors.As(err, &fe) || fe.Rule != ExprRule {
+		t.Fatalf("follow 200: %v, except rule %s", err, ExprRule)
+	}
+	if _, err := parse(`{"uid":"1","mid":"2","follow":800,"src_uid":"3","src_mid":"4","state":12,"event":2}`); !errors.Is(err, ErrorFiltered) {
+		t.Fatalf("state 12: %v, except filtered", err)
+	}
+
+	rec, err := parse(`{"uid":"1","mid":"2","follow":800,"src_uid":"3","src_mid":"4","state":1,"event":2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"src":"3:4","uid":"1"}`
+	if v, _ := rec.GetRedisValue(); v != want {
+		t.Errorf("value %s, except %s", v, want)
+	}
+	tr, ok := rec.(TransmitRecord)
+	if !ok {
+		t.Fatal("remapped record should keep TransmitRecord")
+	}
+	if srcMid, tm := tr.GetTransmit(); srcMid != "4" || tm.Member != want || tm.FollowerCount != 800 {
+		t.Errorf("transmit %s %+v", srcMid, tm)
+	}
+}
+
+// rawRecord 未提供ExprEnv的场景
+type rawRecord struct{}
+
+func (rawRecord) Ignore() bool                    { return false }
+func (rawRecord) GetRedisKey() string             { return "k" }
+func (rawRecord) GetRedisValue() (string, error)  { return "v", nil }
+func (rawRecord) GetLogFile() (path, name string) { return "", "" }
+
+// 未提供ExprEnv的场景取自解码后的消息
+func TestExprRecord(t *testing.T) {
+	c := &ExprConfig{Filter: `user.level >= 3`}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rec := rawRecord{}
+	if _, err := c.Apply(rec, codec.Record{"user": map[string]interface{}{"level": int64(3)}}); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Apply(rec, codec.Record{"user": map[string]interface{}{"level": int64(1)}}); !errors.Is(err, ErrorFiltered) {
+		t.Errorf("%v, except filtered", err)
+	}
+}
+
+func TestExprConfigError(t *testing.T) {
+	cases := []struct {
+		cfg ExprConfig
+		msg string
+	}{
+		{ExprConfig{Filter: `event == `}, "expr.filter: "},
+		{ExprConfig{Filter: `event == 2 &&`}, "col 14"},
+		{ExprConfig{Value: map[string]string{"src": `src_uid +`}}, "expr.value.src: "},
+		{ExprConfig{Value: map[string]string{"n": `nope(uid)`}}, "unknown function nope"},
+	}
+	for _, c := range cases {
+		err := c.cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%+v: %v, except %s", c.cfg, err, c.msg)
+		}
+	}
+}
+
+// process_data场景只能引用ResultST的字段
+func TestExprCheckFields(t *testing.T) {
+	s, _ := GetScene("process_data")
+	cases := []struct {
+		cfg ExprConfig
+		msg string
+	}{
+		{ExprConfig{Filter: `event == 2 && follow > 500`}, ""},
+		{ExprConfig{Filter: `evnet == 2`}, `expr.filter: unknown field "evnet"`},
+		{ExprConfig{Filter: `user.level >= 3`}, `unknown field "user.level"`},
+		{ExprConfig{Value: map[string]string{"src": `src_uid + ":" + content`}}, `expr.value.src: unknown field "content"`},
+	}
+	for _, c := range cases {
+		if err := c.cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		err := c.cfg.CheckFields(s.ExprFields)
+		if len(c.msg) == 0 {
+			if err != nil {
+				t.Errorf("%+v: %v", c.cfg, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%+v: %v, except %s", c.cfg, err, c.msg)
+		}
+	}
+	// 未声明字段的场景不检查
+	c := &ExprConfig{Filter: `user.level >= 3`}
+	c.Validate()
+	if err := c.CheckFields(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// 映射后的value写入转发集合，TopTransmits仍能读出
+func TestExprTransmit(t *testing.T) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	rcfg := &config.RedisCluster{
+		Name:   "expr_test",
+		Hasher: "FNV32",
+		Nodes:  []config.RedisNode{{Address: srv.Addr()}},
+		TTL:    ltime.Duration{Duration: time.Hour},
+	}
+	if err := rcfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	vrs, err := process_data.NewRedisStorager(logging.DefaultLogger(), rcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vrs.CloseRedis()
+
+	s, _ := GetScene("process_data")
+	add := func(c *ExprConfig, msg string) {
+		data, err := codec.JSONDecoder{}.Decode([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := s.Parser(data, &WorkerConfig{LogFilePath: "/tmp/", LogFileNum: 64})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec, err = c.Apply(rec, data); err != nil {
+			t.Fatal(err)
+		}
+		srcMid, tm := rec.(TransmitRecord).GetTransmit()
+		if err := vrs.AddTransmit(srcMid, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mapped := &ExprConfig{Value: map[string]string{"uid": `uid`}}
+	if err := mapped.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	add(mapped, `{"uid":"1","mid":"2","follow":800,"src_uid":"3","src_mid":"4","state":1,"event":2}`)
+	add(&ExprConfig{}, `{"uid":"5","mid":"6","follow":200,"src_uid":"3","src_mid":"4","state":1,"event":2}`)
+
+	top, err := vrs.TopTransmits("4", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 {
+		t.Fatalf("TopTransmits = %+v", top)
+	}
+	if top[0].Member != `{"uid":"1"}` || top[0].Uid != "" || top[0].FollowerCount != 800 {
+		t.Errorf("mapped transmit %+v", top[0])
+	}
+	if top[1].Uid != "5" || top[1].Mid != "6" || top[1].FollowerCount != 200 {
+		t.Errorf("transmit %+v", top[1])
+	}
+}
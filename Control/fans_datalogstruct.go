@@ -3,16 +3,19 @@ package Control
 
 import (
 	"errors"
-	"strconv"
-	"time"
     "encoding/json"
 	//"github.com/json-iterator/go"
-	"process_data/lib/wredis"
+	"process_data/Control/process_data"
+	"process_data/lib/codec"
+	"process_data/lib/expr"
 )
 //var rjson jsoniter.API = jsoniter.ConfigCompatibleWithStandardLibrary
 //var rjson = jsoniter.ConfigCompatibleWithStandardLibrary
 //水电费
 
+// ErrorFiltered 消息合法但被过滤规则拒绝，不视为处理失败，见FilterError
+var ErrorFiltered = errors.New("filtered")
+
 type ResultST struct {
 	Uid     string `json:"uid"`
 	Mid     string  `json:"mid"`
@@ -24,55 +27,111 @@ type ResultST struct {
 	Event     int  `json:"event"`
 }
 
+// ResultSTFields 表达式中可用的ResultST字段，与Get一致
+var ResultSTFields = []string{"uid", "mid", "follow", "src_uid", "src_mid", "state", "event"}
+
+// Get 表达式中按json名取ResultST的字段
+func (rs *ResultST) Get(name string) (interface{}, bool) {
+	switch name {
+	case "uid":
+		return rs.Uid, true
+	case "mid":
+		return rs.Mid, true
+	case "follow":
+		return rs.Follow, true
+	case "src_uid":
+		return rs.Src_Uid, true
+	case "src_mid":
+		return rs.Src_Mid, true
+	case "state":
+		return rs.State, true
+	case "event":
+		return rs.Event, true
+	}
+	return nil, false
+}
+
+// NewResultST 从解码后的消息中取ResultST的字段，数字字段可以是数字字符串
+func NewResultST(data codec.Record) (*ResultST, error) {
+	var rs ResultST
+	strs := []struct {
+		name string
+		v    *string
+	}{{"uid", &rs.Uid}, {"mid", &rs.Mid}, {"src_uid", &rs.Src_Uid}, {"src_mid", &rs.Src_Mid}}
+	for _, f := range strs {
+		s, err := data.String(f.name)
+		if err != nil {
+			return nil, err
+		}
+		*f.v = s
+	}
+	ints := []struct {
+		name string
+		v    *int
+	}{{"follow", &rs.Follow}, {"state", &rs.State}, {"event", &rs.Event}}
+	for _, f := range ints {
+		n, err := data.Int(f.name)
+		if err != nil {
+			return nil, err
+		}
+		*f.v = int(n)
+	}
+	return &rs, nil
+}
+
 type process_dataLogStruct struct {
     SrcMid             string
 	TransmitUid        string
 	TransmitMid        string
 	TransmitFollowerCount int 
+	Timestamp   int64
 	LogFilePath string
 	LogFileName string
+	result      *ResultST
 }
 
 
 
+// Newprocess_dataFreqLogger 解析JSON格式的消息
 func Newprocess_dataFreqLogger(
 	msg []byte,
 	logpath string,
 	lognumber int,
 ) (*process_dataLogStruct, error) {
+	data, err := codec.JSONDecoder{}.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return newProcessDataLogStruct(data, &WorkerConfig{LogFilePath: logpath, LogFileNum: lognumber})
+}
+
+func newProcessDataLogStruct(data codec.Record, cfg *WorkerConfig) (*process_dataLogStruct, error) {
 
-	var resSt ResultST
-	if err := json.Unmarshal(msg, &resSt); err != nil {
+	rs, err := NewResultST(data)
+	if err != nil {
 
 		 return nil,err
 	}
+	resSt := *rs
 	//resSt := &ResultST{}
 	//if err := rjson.Unmarshal(msg, resSt); err != nil {
 
 	//	return nil,err 
 	//}
-	if resSt.Event !=2 {
-		return nil, errors.New("Event is valid")
-	}
-    st:=resSt.State
-	if  (st>=25 && st<= 34) || (st>=5 && st<= 11) || st==16 || st==17 || st==20 || st==36 || st==41 || st==42 || st==3   {
-		return nil, errors.New("State is valid")
-	}
-    Follow:=resSt.Follow
-	if Follow <=150 {
-		return nil, errors.New("Follow is below 100")
+	if err := currentFilter().Check(&resSt); err != nil {
+		return nil, err
 	}
 
 	if len(resSt.Uid) <=0 {
-		return nil, errors.New("uid is valid")
+		return nil, errors.New("uid is empty")
 	}
 
 	if len(resSt.Mid) <=0 {
-		return nil, errors.New("Mid is valid")
+		return nil, errors.New("mid is empty")
 	}
 
 	if len(resSt.Src_Uid) <=0 || len(resSt.Src_Mid) <=0 {
-		return nil, errors.New("Src_Uid is valid or Src_Mid is valid")
+		return nil, errors.New("src_uid or src_mid is empty")
 	}
 
 
@@ -83,15 +142,20 @@ func Newprocess_dataFreqLogger(
 
 
 
-	fileDateDir := time.Now().Format("2006-01-02/15/")
-	bucket := wredis.FNV32aHash(mid) % uint64(lognumber)
+	eventTime, err := cfg.EventTime(data)
+	if err != nil {
+		return nil, err
+	}
+	logPath, logName := cfg.LogFile(eventTime, mid)
 	loggerStruct := process_dataLogStruct{
         SrcMid:        srcmid,
 		TransmitUid:   uid,
 		TransmitMid:   mid,
 		TransmitFollowerCount:   follow_num,
-		LogFilePath: logpath + fileDateDir,
-		LogFileName: strconv.FormatUint(bucket, 10) + "_pvlog.txt",
+		Timestamp:     eventTime.Unix(),
+		result:        &resSt,
+		LogFilePath: logPath,
+		LogFileName: logName,
 	}
 	return &loggerStruct, nil
 }
@@ -104,9 +168,39 @@ func (l *process_dataLogStruct) Ignore() bool {
 
 
 
+// GetLogFile FreqLog文件的目录和文件名
+func (l *process_dataLogStruct) GetLogFile() (string, string) {
+	return l.LogFilePath, l.LogFileName
+}
+
+// ExprEnv 表达式字段为解码后的ResultST
+func (l *process_dataLogStruct) ExprEnv() expr.Env {
+	return l.result
+}
+
+// GetTransmit 写入源mid转发集合的转发
+func (l *process_dataLogStruct) GetTransmit() (string, *process_data.Transmit) {
+	return l.SrcMid, &process_data.Transmit{
+		Uid:           l.TransmitUid,
+		Mid:           l.TransmitMid,
+		FollowerCount: l.TransmitFollowerCount,
+		Timestamp:     l.Timestamp,
+	}
+}
+
+// GetRedisValue 转发集合的成员
+func (l *process_dataLogStruct) GetRedisValue() (string, error) {
+	_, t := l.GetTransmit()
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func (l *process_dataLogStruct) GetRedisKey() string {
 	if len(l.SrcMid) > 0 {
-		return l.SrcMid + "_transmit_new"
+		return process_data.TransmitKey(l.SrcMid)
 	}
 	return ""
 
@@ -0,0 +1,194 @@
+package Control
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// FilterConfig [filter] process_data场景的过滤规则
+// 规则按顺序检查，第一条不满足的规则拒绝消息，拒绝数按规则名计入 msg.filter.<name>
+// 未配置规则时使用DefaultFilterRules，disable为true时不过滤
+type FilterConfig struct {
+	Disable bool          `toml:"disable" json:"disable"`
+	Rules   []*FilterRule `toml:"rule" json:"rule"`
+}
+
+// FilterRule 一条规则，字段值需同时满足配置的所有条件
+type FilterRule struct {
+	Name        string    `toml:"name" json:"name"`
+	Field       string    `toml:"field" json:"field"`                 // 消息中的字段，见ResultST的json名
+	In          []int64   `toml:"in" json:"in"`                       // 值在集合中
+	NotIn       []int64   `toml:"not_in" json:"not_in"`               // 值不在集合中
+	InRanges    [][]int64 `toml:"in_ranges" json:"in_ranges"`         // 值在某个闭区间[min, max]中
+	NotInRanges [][]int64 `toml:"not_in_ranges" json:"not_in_ranges"` // 值不在任何闭区间中
+	Gt          *int64    `toml:"gt" json:"gt"`
+	Gte         *int64    `toml:"gte" json:"gte"`
+	Lt          *int64    `toml:"lt" json:"lt"`
+	Lte         *int64    `toml:"lte" json:"lte"`
+}
+
+// DefaultFilterRules 未配置[filter]时的规则，与原先写死的判断一致
+func DefaultFilterRules() []*FilterRule {
+	follow := int64(150)
+	return []*FilterRule{
+		{Name: "event", Field: "event", In: []int64{2}},
+		{
+			Name:        "state_blacklist",
+			Field:       "state",
+			NotIn:       []int64{3, 16, 17, 20, 36, 41, 42},
+			NotInRanges: [][]int64{{5, 11}, {25, 34}},
+		},
+		{Name: "min_follow", Field: "follow", Gt: &follow},
+	}
+}
+
+// 规则名作为指标名的一部分
+var filterRuleNameRe = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+func (c *FilterConfig) Validate() error {
+	if c.Disable {
+		return nil
+	}
+	if len(c.Rules) == 0 {
+		c.Rules = DefaultFilterRules()
+	}
+	names := map[string]bool{}
+	for i, r := range c.Rules {
+		if !filterRuleNameRe.MatchString(r.Name) {
+			return fmt.Errorf("filter.rule[%d].name %q is invalid, must be [a-zA-Z0-9_]+", i, r.Name)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("filter.rule[%d].name %q is duplicated", i, r.Name)
+		}
+		names[r.Name] = true
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("filter.rule %s: %s", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *FilterRule) Validate() error {
+	if _, ok := resultSTFields[r.Field]; !ok {
+		return fmt.Errorf("field %q is invalid, must be one of %s", r.Field, strings.Join(resultSTFieldNames(), ", "))
+	}
+	for _, rg := range append(append([][]int64{}, r.InRanges...), r.NotInRanges...) {
+		if len(rg) != 2 || rg[0] > rg[1] {
+			return fmt.Errorf("range %v is invalid, must be [min, max]", rg)
+		}
+	}
+	if len(r.In) == 0 && len(r.NotIn) == 0 && len(r.InRanges) == 0 && len(r.NotInRanges) == 0 &&
+		r.Gt == nil && r.Gte == nil && r.Lt == nil && r.Lte == nil {
+		return fmt.Errorf("no condition")
+	}
+	return nil
+}
+
+// Match 值是否满足规则的所有条件
+func (r *FilterRule) Match(v int64) bool {
+	if len(r.In) > 0 && !containsInt64(r.In, v) {
+		return false
+	}
+	if containsInt64(r.NotIn, v) {
+		return false
+	}
+	if len(r.InRanges) > 0 && !inRanges(r.InRanges, v) {
+		return false
+	}
+	if inRanges(r.NotInRanges, v) {
+		return false
+	}
+	if (r.Gt != nil && v <= *r.Gt) || (r.Gte != nil && v < *r.Gte) ||
+		(r.Lt != nil && v >= *r.Lt) || (r.Lte != nil && v > *r.Lte) {
+		return false
+	}
+	return true
+}
+
+func containsInt64(s []int64, v int64) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func inRanges(ranges [][]int64, v int64) bool {
+	for _, rg := range ranges {
+		if v >= rg[0] && v <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterError 消息被规则拒绝，errors.Is(err, ErrorFiltered)为true
+type FilterError struct {
+	Rule  string
+	Field string
+	Value int64
+}
+
+func (e *FilterError) Error() string {
+	if len(e.Field) == 0 {
+		return fmt.Sprintf("%s: rule %s rejected", ErrorFiltered, e.Rule)
+	}
+	return fmt.Sprintf("%s: rule %s rejected %s=%d", ErrorFiltered, e.Rule, e.Field, e.Value)
+}
+
+func (e *FilterError) Unwrap() error {
+	return ErrorFiltered
+}
+
+// Check 依次检查规则，返回第一条不满足的规则对应的*FilterError
+func (c *FilterConfig) Check(rs *ResultST) error {
+	if c == nil || c.Disable {
+		return nil
+	}
+	for _, r := range c.Rules {
+		v := resultSTFields[r.Field](rs)
+		if !r.Match(v) {
+			return &FilterError{Rule: r.Name, Field: r.Field, Value: v}
+		}
+	}
+	return nil
+}
+
+// resultSTFields 可用于过滤的ResultST字段
+var resultSTFields = map[string]func(rs *ResultST) int64{
+	"event":  func(rs *ResultST) int64 { return int64(rs.Event) },
+	"state":  func(rs *ResultST) int64 { return int64(rs.State) },
+	"follow": func(rs *ResultST) int64 { return int64(rs.Follow) },
+}
+
+func resultSTFieldNames() []string {
+	names := []string{}
+	for name := range resultSTFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// msgFilter 当前生效的过滤规则，热加载时整体替换
+var msgFilter atomic.Value
+
+// SetFilter 替换当前生效的过滤规则
+func SetFilter(c *FilterConfig) {
+	msgFilter.Store(c)
+}
+
+func currentFilter() *FilterConfig {
+	c, _ := msgFilter.Load().(*FilterConfig)
+	return c
+}
+
+func init() {
+	c := &FilterConfig{}
+	c.Validate()
+	SetFilter(c)
+}
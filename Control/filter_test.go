@@ -0,0 +1,102 @@
+package Control
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// 原先写死在Newprocess_dataFreqLogger中的判断
+func legacyFiltered(rs *ResultST) bool {
+	st := rs.State
+	return rs.Event != 2 ||
+		(st >= 25 && st <= 34) || (st >= 5 && st <= 11) || st == 16 || st == 17 || st == 20 || st == 36 || st == 41 || st == 42 || st == 3 ||
+		rs.Follow <= 150
+}
+
+func TestDefaultFilterRules(t *testing.T) {
+	c := &FilterConfig{}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for event := 0; event < 4; event++ {
+		for state := 0; state < 50; state++ {
+			for _, follow := range []int{0, 150, 151, 1000} {
+				rs := &ResultST{Event: event, State: state, Follow: follow}
+				err := c.Check(rs)
+				if (err != nil) != legacyFiltered(rs) {
+					t.Fatalf("%+v: filter %v, legacy %v", rs, err, legacyFiltered(rs))
+				}
+				if err != nil && !errors.Is(err, ErrorFiltered) {
+					t.Fatalf("%v is not ErrorFiltered", err)
+				}
+			}
+		}
+	}
+}
+
+func TestFilterConfig(t *testing.T) {
+	var cfg struct {
+		Filter FilterConfig `toml:"filter"`
+	}
+	data := `
+[filter]
+[[filter.rule]]
+name = "only_create"
+field = "event"
+in = [2]
+[[filter.rule]]
+name = "bad_state"
+field = "state"
+not_in = [3]
+not_in_ranges = [[5, 11]]
+[[filter.rule]]
+name = "big_v"
+field = "follow"
+gte = 500
+lt = 100000
+`
+	if _, err := toml.Decode(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Filter.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		rs   ResultST
+		rule string
+	}{
+		{ResultST{Event: 2, State: 1, Follow: 500}, ""},
+		{ResultST{Event: 1, State: 1, Follow: 500}, "only_create"},
+		{ResultST{Event: 2, State: 7, Follow: 500}, "bad_state"},
+		{ResultST{Event: 2, State: 1, Follow: 499}, "big_v"},
+		{ResultST{Event: 2, State: 1, Follow: 100000}, "big_v"},
+	}
+	for _, c := range cases {
+		err := cfg.Filter.Check(&c.rs)
+		var fe *FilterError
+		if c.rule == "" {
+			if err != nil {
+				t.Errorf("%+v: unexcepted %s", c.rs, err)
+			}
+			continue
+		}
+		if !errors.As(err, &fe) || fe.Rule != c.rule {
+			t.Errorf("%+v: %v, except rule %s", c.rs, err, c.rule)
+		}
+	}
+
+	invalid := []*FilterRule{
+		{Name: "bad name", Field: "event", In: []int64{2}},
+		{Name: "no_field", Field: "uid", In: []int64{2}},
+		{Name: "bad_range", Field: "state", InRanges: [][]int64{{9, 1}}},
+		{Name: "no_cond", Field: "state"},
+	}
+	for _, r := range invalid {
+		c := &FilterConfig{Rules: []*FilterRule{r}}
+		if err := c.Validate(); err == nil {
+			t.Errorf("rule %s should be invalid", r.Name)
+		}
+	}
+}
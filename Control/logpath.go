@@ -0,0 +1,126 @@
+package Control
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"process_data/lib/codec"
+	"process_data/lib/wredis"
+)
+
+// DefaultPathTemplate FreqLog文件相对log_file_path的路径
+const DefaultPathTemplate = "{date}/{hour}/{bucket}_pvlog.txt"
+
+// pathVars path_template中可用的变量及其取值的正则
+var pathVars = map[string]string{
+	"date":   `\d{4}-\d{2}-\d{2}`,
+	"hour":   `\d{2}`,
+	"minute": `\d{2}`,
+	"bucket": `\d+`,
+}
+
+var pathVarRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validateLogPath 检查path_template与time_zone，设置默认值
+func (c *WorkerConfig) validateLogPath() error {
+	if len(c.PathTemplate) == 0 {
+		c.PathTemplate = DefaultPathTemplate
+	}
+	for _, m := range pathVarRe.FindAllStringSubmatch(c.PathTemplate, -1) {
+		if _, ok := pathVars[m[1]]; !ok {
+			return fmt.Errorf("worker.path_template: unknown variable {%s}, must be one of {date} {hour} {minute} {bucket}", m[1])
+		}
+	}
+	if strings.HasSuffix(c.PathTemplate, "/") || strings.HasPrefix(c.PathTemplate, "/") {
+		return fmt.Errorf("worker.path_template %q must be a relative file path", c.PathTemplate)
+	}
+	if len(c.TimeLayout) == 0 {
+		c.TimeLayout = codec.DefaultTimeLayout
+	}
+	c.location = time.Local
+	if len(c.TimeZone) > 0 {
+		loc, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return fmt.Errorf("worker.time_zone: %s", err)
+		}
+		c.location = loc
+	}
+	return nil
+}
+
+func (c *WorkerConfig) loc() *time.Location {
+	if c.location == nil {
+		return time.Local
+	}
+	return c.location
+}
+
+// EventTime 消息的时间，取自time_field，未配置或消息中没有时为处理时间
+func (c *WorkerConfig) EventTime(data codec.Record) (time.Time, error) {
+	if len(c.TimeField) > 0 {
+		t, err := data.Time(c.TimeField, c.TimeLayout, c.loc())
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !t.IsZero() {
+			return t.In(c.loc()), nil
+		}
+	}
+	return time.Now().In(c.loc()), nil
+}
+
+// LogDirPattern 匹配path_template生成的目录(相对log_file_path)，path_template不含目录时为nil
+func (c *WorkerConfig) LogDirPattern() *regexp.Regexp {
+	tmpl := c.PathTemplate
+	if len(tmpl) == 0 {
+		tmpl = DefaultPathTemplate
+	}
+	dir := filepath.Dir(tmpl)
+	if dir == "." {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, m := range pathVarRe.FindAllStringSubmatchIndex(dir, -1) {
+		b.WriteString(regexp.QuoteMeta(dir[last:m[0]]))
+		b.WriteString(pathVars[dir[m[2]:m[3]]])
+		last = m[1]
+	}
+	b.WriteString(regexp.QuoteMeta(dir[last:]))
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// LogFile 按path_template生成FreqLog文件的目录和文件名，bucketKey哈希后对log_file_num取模
+func (c *WorkerConfig) LogFile(t time.Time, bucketKey string) (string, string) {
+	num := c.LogFileNum
+	if num <= 0 {
+		num = 1
+	}
+	tmpl := c.PathTemplate
+	if len(tmpl) == 0 {
+		tmpl = DefaultPathTemplate
+	}
+	t = t.In(c.loc())
+	bucket := wredis.FNV32aHash(bucketKey) % uint64(num)
+	p := pathVarRe.ReplaceAllStringFunc(tmpl, func(v string) string {
+		switch v {
+		case "{date}":
+			return t.Format("2006-01-02")
+		case "{hour}":
+			return t.Format("15")
+		case "{minute}":
+			return t.Format("04")
+		case "{bucket}":
+			return strconv.FormatUint(bucket, 10)
+		}
+		return v
+	})
+	dir, name := filepath.Split(p)
+	return c.LogFilePath + dir, name
+}
@@ -0,0 +1,118 @@
+package Control
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"process_data/lib/codec"
+)
+
+func TestLogFileEventTime(t *testing.T) {
+	c := &WorkerConfig{LogFilePath: "/tmp/pvlog/", LogFileNum: 64, TimeField: "time", TimeZone: "Asia/Shanghai"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		data codec.Record
+		dir  string
+	}{
+		{codec.Record{"time": "2018-12-26 18:59:57"}, "/tmp/pvlog/2018-12-26/18/"},
+		{codec.Record{"time": int64(1545821997)}, "/tmp/pvlog/2018-12-26/18/"}, // 2018-12-26 10:59:57 UTC
+		{codec.Record{"time": time.Date(2018, 12, 26, 23, 30, 0, 0, time.UTC)}, "/tmp/pvlog/2018-12-27/07/"},
+	}
+	for _, tc := range cases {
+		et, err := c.EventTime(tc.data)
+		if err != nil {
+			t.Errorf("%v: %s", tc.data, err)
+			continue
+		}
+		dir, name := c.LogFile(et, "2780123000")
+		if dir != tc.dir || !strings.HasSuffix(name, "_pvlog.txt") {
+			t.Errorf("%v: %s%s, except dir %s", tc.data, dir, name, tc.dir)
+		}
+	}
+
+	// 消息中没有时间时为处理时间
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	before := time.Now().In(loc)
+	et, err := c.EventTime(codec.Record{})
+	if err != nil || et.Before(before.Add(-time.Second)) || et.Location().String() != "Asia/Shanghai" {
+		t.Errorf("fallback %s %v", et, err)
+	}
+	if _, err := c.EventTime(codec.Record{"time": "2018/12/26"}); err == nil {
+		t.Error("invalid time should fail")
+	}
+}
+
+func TestLogFileTemplate(t *testing.T) {
+	c := &WorkerConfig{LogFilePath: "/data/", LogFileNum: 1, PathTemplate: "{date}/{hour}{minute}/ad_{bucket}.log"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	dir, name := c.LogFile(time.Date(2019, 1, 13, 1, 39, 0, 0, time.Local), "x")
+	if dir != "/data/2019-01-13/0139/" || name != "ad_0.log" {
+		t.Errorf("%s %s", dir, name)
+	}
+
+	for _, bad := range []*WorkerConfig{
+		{PathTemplate: "{date}/{day}/{bucket}.txt"},
+		{PathTemplate: "{date}/{hour}/"},
+		{PathTemplate: "/{date}/{bucket}.txt"},
+		{TimeZone: "Mars/Olympus"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%+v: except error", bad)
+		}
+	}
+}
+
+// 封存与删除只处理path_template生成的目录，不能使用默认的/tmp/
+func TestLogDirPattern(t *testing.T) {
+	c := &WorkerConfig{PathTemplate: "ad.{date}/{hour}{minute}/ad_{bucket}.log"}
+	re := c.LogDirPattern()
+	for dir, match := range map[string]bool{
+		"ad.2019-01-13/0139":       true,
+		"adx2019-01-13/0139":       false,
+		"ad.2019-01-13":            false,
+		"other/ad.2019-01-13/0139": false,
+	} {
+		if re.MatchString(dir) != match {
+			t.Errorf("%s: except match %v", dir, match)
+		}
+	}
+	if (&WorkerConfig{PathTemplate: "{bucket}_pvlog.txt"}).LogDirPattern() != nil {
+		t.Error("template without directory")
+	}
+
+	for path, ok := range map[string]bool{"": false, "/tmp/": false, "/": false, "/data/freqlog": false, "/data/freqlog/": true} {
+		cfg := &Config{WorkerConfig: WorkerConfig{LogFilePath: path}}
+		cfg.FreqLog.SealDelay.Duration = 10 * time.Minute
+		cfg.WorkerConfig.Validate()
+		cfg.FreqLog.Validate()
+		if err := cfg.validateFreqLogScan(); (err == nil) != ok {
+			t.Errorf("log_file_path %q: %v", path, err)
+		}
+	}
+}
+
+// 重放积压消息时按日志中的时间写入对应小时的目录
+func TestAdLogEventTime(t *testing.T) {
+	s, _ := GetScene("freq")
+	d, _ := NewTopicDecoders(s, nil)
+	c := &WorkerConfig{LogFilePath: "/tmp/", LogFileNum: 64, TimeField: "time"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := d.Decode("", []byte("ad_5c2205801427|pos56e566f71a201|33|CMCC|2780123000|iphone|3333_2001|108C393010|39.187.201.240|||||2018-12-26 18:59:57|ua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := s.Parser(data, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, _ := rec.GetLogFile(); dir != "/tmp/2018-12-26/18/" {
+		t.Errorf("dir %s", dir)
+	}
+}
@@ -1,37 +1,94 @@
 package Control
 
 import (
-	"errors"
-	"strconv"
-	"strings"
+	"fmt"
 	"time"
-	"process_data/lib/wredis"
+	"process_data/lib/codec"
 )
 
 type LogStruct struct {
 	Uid         string
 	Adid        string
+	Position    string
+	Carrier     string
+	Platform    string
+	Time        time.Time // 日志时间，日志中没有时为零值
+	UA          string
 	LogFilePath string
 	LogFileName string
 }
 
+// AdLogColumns | 分隔的广告日志的列，如
+// ad_5c2205801427|pos56e566f71a201|33|CMCC|2780123000|iphone|3333_2001|108C393010|39.187.201.240|||||2018-12-26 18:59:57|iPhone9%2C2%5F%5Fweibo...
+func AdLogColumns() []*codec.Column {
+	return []*codec.Column{
+		{Name: "adid", Index: 0, Required: true},
+		{Name: "position", Index: 1},
+		{Name: "carrier", Index: 3},
+		{Name: "uid", Index: 4, Required: true},
+		{Name: "platform", Index: 5},
+		{Name: "ip", Index: 8},
+		{Name: "time", Index: 13, Type: codec.ColumnTime},
+		{Name: "ua", Index: 14, URLDecode: true},
+	}
+}
+
+// freqLogCodec freq场景的默认解码器
+var freqLogCodec = codec.Config{
+	Type:      codec.TypeCSV,
+	Fields:    AdLogColumns(),
+	Delimiter: "|",
+}
+
+var freqLogDecoder, _ = codec.New(&freqLogCodec)
+
+// NewFreqLogger 解析 | 分隔的广告日志
 func NewFreqLogger(
 	msg []byte,
 	logpath string,
 	lognumber int,
 ) (*LogStruct, error) {
-	logArr := strings.Split(string(msg), "|")
-	if len(logArr) < 4 {
-		return nil, errors.New("logger not valid")
-	}
-	fileDateDir := time.Now().Format("2006-01-02/15/")
-	bucket := wredis.FNV32aHash(logArr[4]) % uint64(lognumber)
-	loggerStruct := LogStruct{
-		Uid:         logArr[4],
-		Adid:        logArr[0],
-		LogFilePath: logpath + fileDateDir,
-		LogFileName: strconv.FormatUint(bucket, 10) + "_pvlog.txt",
+	data, err := freqLogDecoder.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return newFreqLogStruct(data, &WorkerConfig{LogFilePath: logpath, LogFileNum: lognumber})
+}
+
+func newFreqLogStruct(data codec.Record, cfg *WorkerConfig) (*LogStruct, error) {
+	loggerStruct := LogStruct{}
+	strs := []struct {
+		name     string
+		v        *string
+		required bool
+	}{
+		{"adid", &loggerStruct.Adid, true},
+		{"uid", &loggerStruct.Uid, true},
+		{"position", &loggerStruct.Position, false},
+		{"carrier", &loggerStruct.Carrier, false},
+		{"platform", &loggerStruct.Platform, false},
+		{"ua", &loggerStruct.UA, false},
+	}
+	for _, f := range strs {
+		if _, ok := data[f.name]; !ok && f.required {
+			return nil, fmt.Errorf("column %s is missing", f.name)
+		}
+		s, err := data.String(f.name)
+		if err != nil {
+			return nil, err
+		}
+		*f.v = s
+	}
+	t, err := data.Time("time", codec.DefaultTimeLayout, cfg.loc())
+	if err != nil {
+		return nil, err
+	}
+	loggerStruct.Time = t
+	eventTime, err := cfg.EventTime(data)
+	if err != nil {
+		return nil, err
 	}
+	loggerStruct.LogFilePath, loggerStruct.LogFileName = cfg.LogFile(eventTime, loggerStruct.Uid)
 	return &loggerStruct, nil
 }
 func (l *LogStruct) Ignore() bool {
@@ -43,6 +100,16 @@ func (l *LogStruct) Ignore() bool {
 
 
 
+// GetLogFile FreqLog文件的目录和文件名
+func (l *LogStruct) GetLogFile() (string, string) {
+	return l.LogFilePath, l.LogFileName
+}
+
+// GetRedisValue adid对应的uid
+func (l *LogStruct) GetRedisValue() (string, error) {
+	return l.Uid, nil
+}
+
 func (l *LogStruct) GetRedisKey() string {
 	if len(l.Adid) > 0 {
 		return l.Adid
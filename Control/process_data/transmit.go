@@ -0,0 +1,140 @@
+package process_data
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+
+	redis "github.com/gomodule/redigo/redis"
+
+	"process_data/config"
+	"process_data/lib/wredis"
+)
+
+// Transmit 一条转发，写入源mid的转发集合
+// 集合成员为uid/mid/follow的JSON，重复消费同一条转发不会产生重复成员
+type Transmit struct {
+	Uid           string `json:"uid"`
+	Mid           string `json:"mid"`
+	FollowerCount int    `json:"follow"`
+	Timestamp     int64  `json:"-"` // 消息的时间(秒)，取自worker.time_field，未配置或消息中没有时为处理时间；score为timestamp时使用
+	Member        string `json:"-"` // 集合成员，为空时为uid/mid/follow的JSON，[expr.value]映射后为映射结果
+}
+
+// TransmitKey 源mid的转发集合
+func TransmitKey(srcMid string) string {
+	return srcMid + "_transmit_new"
+}
+
+// addTransmitScript 写入转发后只保留score最大的top_n个，并刷新过期时间
+// KEYS[1] 转发集合 ARGV: score member top_n ttl
+var addTransmitScript = wredis.NewScript(`
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+local n = tonumber(ARGV[3])
+if n > 0 then
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -n-1)
+end
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+func (vrs *MemStorager) transmitArgs(t *Transmit) ([]interface{}, error) {
+	member := []byte(t.Member)
+	if len(member) == 0 {
+		b, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		member = b
+	}
+	score := int64(t.FollowerCount)
+	if vrs.transmit.Score == config.TransmitScoreTimestamp {
+		score = t.Timestamp
+	}
+	return []interface{}{score, member, vrs.transmit.TopN, atomic.LoadInt64(&vrs.ttl)}, nil
+}
+
+// AddTransmit 将转发写入源mid的转发集合
+func (vrs *MemStorager) AddTransmit(srcMid string, t *Transmit) error {
+	key := TransmitKey(srcMid)
+	args, err := vrs.transmitArgs(t)
+	if err != nil {
+		return err
+	}
+	if _, err := vrs.wr.EvalByHash(addTransmitScript, key, args...); err != nil {
+		vrs.Logger.Infof("add transmit %s to %s failed: %s", t.Mid, key, err)
+		return err
+	}
+	return nil
+}
+
+// AddTransmitBatch 批量写入转发，按实例分组pipeline发送，返回值与srcMids一一对应
+func (vrs *MemStorager) AddTransmitBatch(srcMids []string, ts []*Transmit) []error {
+	errs := make([]error, len(srcMids))
+	p := vrs.wr.NewPipeline()
+	index := []int{}
+	for i, srcMid := range srcMids {
+		args, err := vrs.transmitArgs(ts[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		p.Eval(addTransmitScript, TransmitKey(srcMid), args...)
+		index = append(index, i)
+	}
+	for j, r := range p.Flush() {
+		if r.Err != nil {
+			i := index[j]
+			vrs.Logger.Infof("add transmit %s to %s failed: %s", ts[i].Mid, TransmitKey(srcMids[i]), r.Err)
+			errs[i] = r.Err
+		}
+	}
+	return errs
+}
+
+// TopTransmits 源mid的前n个转发，按score从大到小
+func (vrs *MemStorager) TopTransmits(srcMid string, n int) ([]*Transmit, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	values, err := redis.Values(vrs.wr.DoByHash("ZREVRANGE", TransmitKey(srcMid), 0, n-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	transmits := []*Transmit{}
+	for i := 0; i+1 < len(values); i += 2 {
+		member, err := redis.Bytes(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		score, err := redis.Int64(values[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		transmits = append(transmits, vrs.decodeTransmit(member, score))
+	}
+	return transmits, nil
+}
+
+// decodeTransmit 解析集合成员，成员不是uid/mid/follow的JSON(如[expr.value]映射后的值)时只返回Member与score
+func (vrs *MemStorager) decodeTransmit(member []byte, score int64) *Transmit {
+	t := &Transmit{}
+	// 重新编码与成员一致时才是AddTransmit写入的JSON
+	if err := json.Unmarshal(member, t); err != nil {
+		*t = Transmit{}
+	} else if b, _ := json.Marshal(t); !bytes.Equal(b, member) {
+		*t = Transmit{}
+	}
+	t.Member = string(member)
+	if vrs.transmit.Score == config.TransmitScoreTimestamp {
+		t.Timestamp = score
+	} else {
+		t.FollowerCount = int(score)
+	}
+	return t
+}
+
+// TransmitCount 源mid的转发集合中的转发数，最多为top_n
+func (vrs *MemStorager) TransmitCount(srcMid string) (int64, error) {
+	return redis.Int64(vrs.wr.DoByHash("ZCARD", TransmitKey(srcMid)))
+}
@@ -0,0 +1,137 @@
+package process_data
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+
+	"process_data/config"
+	"process_data/lib/logging"
+	ltime "process_data/lib/time"
+)
+
+func newTestStorager(t *testing.T, s *miniredis.Miniredis, score string) *MemStorager {
+	cfg := &config.RedisCluster{
+		Name:     "transmit_test",
+		Hasher:   "FNV32",
+		Nodes:    []config.RedisNode{{Address: s.Addr()}},
+		TTL:      ltime.Duration{Duration: time.Hour},
+		Transmit: config.TransmitConfig{Score: score, TopN: 3},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	vrs, err := NewRedisStorager(logging.DefaultLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vrs
+}
+
+func TestTransmit(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	vrs := newTestStorager(t, s, config.TransmitScoreFollower)
+	defer vrs.CloseRedis()
+
+	for i := 1; i <= 5; i++ {
+		tr := &Transmit{Uid: fmt.Sprintf("u%d", i), Mid: fmt.Sprintf("m%d", i), FollowerCount: i * 100}
+		if err := vrs.AddTransmit("src", tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 重复写入不增加成员
+	if err := vrs.AddTransmit("src", &Transmit{Uid: "u5", Mid: "m5", FollowerCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只保留粉丝数最多的top_n个
+	if n, err := vrs.TransmitCount("src"); err != nil || n != 3 {
+		t.Fatalf("TransmitCount = %d, %v, except 3", n, err)
+	}
+	top, err := vrs.TopTransmits("src", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Mid != "m5" || top[1].Mid != "m4" || top[0].FollowerCount != 500 {
+		t.Fatalf("TopTransmits = %+v", top)
+	}
+	if ttl := s.TTL(TransmitKey("src")); ttl != time.Hour {
+		t.Fatalf("ttl %s, except 1h", ttl)
+	}
+}
+
+func TestTransmitBatch(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	vrs := newTestStorager(t, s, config.TransmitScoreTimestamp)
+	defer vrs.CloseRedis()
+
+	srcMids := []string{"a", "b", "a", "a", "a"}
+	ts := []*Transmit{}
+	for i := range srcMids {
+		ts = append(ts, &Transmit{Uid: "u", Mid: fmt.Sprintf("m%d", i), FollowerCount: 1000 - i, Timestamp: int64(i + 1)})
+	}
+	for i, err := range vrs.AddTransmitBatch(srcMids, ts) {
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	if n, _ := vrs.TransmitCount("a"); n != 3 {
+		t.Fatalf("TransmitCount(a) = %d, except 3", n)
+	}
+	if n, _ := vrs.TransmitCount("b"); n != 1 {
+		t.Fatalf("TransmitCount(b) = %d, except 1", n)
+	}
+	// 按时间保留最近的
+	top, err := vrs.TopTransmits("a", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 3 || top[0].Mid != "m4" || top[0].Timestamp != 5 || top[2].Mid != "m2" {
+		t.Fatalf("TopTransmits = %+v", top)
+	}
+}
+
+// TestReloadRedis 热加载与写入并发，go test -race检查
+func TestReloadRedis(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	vrs := newTestStorager(t, s, config.TransmitScoreFollower)
+	defer vrs.CloseRedis()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := vrs.AddTransmit("src", &Transmit{Uid: "u", Mid: fmt.Sprintf("m%d", i), FollowerCount: i}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 1; i <= 10; i++ {
+		cfg := &config.RedisCluster{MaxIdle: i, MaxActive: i * 2, TTL: ltime.Duration{Duration: time.Duration(i) * time.Hour}}
+		if err := vrs.ReloadRedis(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if ttl := s.TTL(TransmitKey("src")); ttl != 10*time.Hour {
+		t.Fatalf("ttl %s, except 10h", ttl)
+	}
+	if n, _ := vrs.TransmitCount("src"); n != 3 {
+		t.Fatalf("TransmitCount = %d, except 3", n)
+	}
+}
@@ -1,6 +1,8 @@
 package process_data
 
 import (
+	"sync/atomic"
+
 	"process_data/config"
 	"process_data/lib/logging"
 	"process_data/lib/wredis"
@@ -8,24 +10,50 @@ import (
 )
 
 type MemStorager struct {
-	Logger   logging.Logger
-	rediscfg *config.RedisCluster
-	wr       *wredis.WRedis
+	Logger    logging.Logger
+	transmit  config.TransmitConfig // 创建时复制，worker只读，需重启生效
+	maxIdle   int                   // 连接池大小，只在ReloadRedis中读写
+	maxActive int
+	wr        *wredis.WRedis
+	ttl       int64 // 过期时间，单位秒，热加载时原子更新
 }
 
 func NewRedisStorager(lg logging.Logger, config *config.RedisCluster) (*MemStorager, error) {
-	vrs := &MemStorager{Logger: lg, rediscfg: config}
-	wr, err := wredis.NewWithConfig(vrs.rediscfg)
+	vrs := &MemStorager{
+		Logger:    lg,
+		transmit:  config.Transmit,
+		maxIdle:   config.MaxIdle,
+		maxActive: config.MaxActive,
+	}
+	wr, err := wredis.NewWithConfig(config)
 	if err != nil {
 		return nil, err
 	}
 	vrs.wr = wr
+	vrs.ttl = int64(config.TTL.Seconds())
 	return vrs, nil
 }
 
 
 
 
+// ReloadRedis 更新ttl，连接池大小变化时重建连接池，其余配置需重启生效
+// 重建连接池失败时ttl也不更新
+func (vrs *MemStorager) ReloadRedis(cfg *config.RedisCluster) error {
+	if cfg.MaxIdle == vrs.maxIdle && cfg.MaxActive == vrs.maxActive {
+		atomic.StoreInt64(&vrs.ttl, int64(cfg.TTL.Seconds()))
+		return nil
+	}
+	if err := vrs.wr.Resize(cfg.MaxIdle, cfg.MaxActive); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&vrs.ttl, int64(cfg.TTL.Seconds()))
+	vrs.Logger.Infof("redis pool resized, max_idle: %d -> %d, max_active: %d -> %d",
+		vrs.maxIdle, cfg.MaxIdle, vrs.maxActive, cfg.MaxActive)
+	vrs.maxIdle, vrs.maxActive = cfg.MaxIdle, cfg.MaxActive
+	return nil
+}
+
 func (vrs *MemStorager) CloseRedis() error {
 
 	err := vrs.wr.Close()
@@ -33,22 +61,31 @@ func (vrs *MemStorager) CloseRedis() error {
 
 }
 
-func (vrs *MemStorager) SetRedis(key string,value string) error {
-
-	_, err := vrs.wr.DoByHash("SET", key,value)
+// SetRedis SET key value EX ttl，一次往返且写入与过期时间原子生效
+func (vrs *MemStorager) SetRedis(key string, value string) error {
+	_, err := vrs.wr.DoByHash("SET", key, value, "EX", atomic.LoadInt64(&vrs.ttl))
 	if err != nil {
 		vrs.Logger.Infof("set %s failed: %s", key, err)
 		return err
 	}
+	return nil
+}
 
-	_, err = vrs.wr.DoByHash("EXPIRE", key, 86400*5)
-
-	if err != nil {
-		vrs.Logger.Infof("expire %s failed")
-		return err
+// SetRedisBatch 批量SET key value EX ttl，按实例分组pipeline发送，返回值与keys一一对应
+func (vrs *MemStorager) SetRedisBatch(keys []string, values []string) []error {
+	ttl := atomic.LoadInt64(&vrs.ttl)
+	p := vrs.wr.NewPipeline()
+	for i, key := range keys {
+		p.Send("SET", key, values[i], "EX", ttl)
 	}
-
-	return nil
+	errs := make([]error, len(keys))
+	for i, r := range p.Flush() {
+		if r.Err != nil {
+			vrs.Logger.Infof("set %s failed: %s", keys[i], r.Err)
+			errs[i] = r.Err
+		}
+	}
+	return errs
 }
 
 func (vrs *MemStorager) GetRedis(key string) (reply string, err error) {
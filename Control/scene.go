@@ -0,0 +1,180 @@
+package Control
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"process_data/Control/process_data"
+	"process_data/config"
+	"process_data/lib/codec"
+	"process_data/lib/graphite"
+	"process_data/lib/logging"
+)
+
+// Record 场景解析后的一条消息
+type Record interface {
+	Ignore() bool
+	GetRedisKey() string
+	GetRedisValue() (string, error)
+	GetLogFile() (path string, name string)
+}
+
+// TransmitRecord 转发记录，写入源mid的转发集合而不是SET GetRedisKey
+type TransmitRecord interface {
+	GetTransmit() (srcMid string, t *process_data.Transmit)
+}
+
+// Parser 将解码后的kafka消息解析为Record，FreqLog文件见WorkerConfig.LogFile
+type Parser func(data codec.Record, cfg *WorkerConfig) (Record, error)
+
+// StoragerFactory 创建场景使用的RedisStorager
+type StoragerFactory func(lg logging.Logger, cfg *config.RedisCluster) (RedisStorager, error)
+
+// Handler 处理一条kafka消息
+type Handler func(w *Worker, msg *config.KafkaConsumerMsg) error
+
+// Scene 一个kafka到redis的处理场景，由Config.Scene选择
+type Scene struct {
+	Name        string
+	Codec       codec.Config // 默认解码器，kafka_consumer未配置decoder时使用，type为空时为json
+	Parser      Parser
+	NewStorager StoragerFactory
+	Handler     Handler
+	ExprFields  []string // [expr]可用的字段，加载配置时检查；为空时字段取自解码后的消息，不检查
+}
+
+var sceneMap = map[string]*Scene{}
+
+func init() {
+	RegisterScene(&Scene{
+		Name:        "process_data",
+		Codec:       codec.Config{Type: codec.TypeJSON},
+		Parser:      parseProcessData,
+		NewStorager: newMemStorager,
+		Handler:     ProcessRecord,
+		ExprFields:  ResultSTFields,
+	})
+	RegisterScene(&Scene{
+		Name:        "freq",
+		Codec:       freqLogCodec,
+		Parser:      parseFreqLog,
+		NewStorager: newMemStorager,
+		Handler:     ProcessRecord,
+	})
+}
+
+// RegisterScene 注册场景，重复注册同名场景会panic
+func RegisterScene(s *Scene) {
+	if s == nil || len(s.Name) == 0 {
+		panic("Control: RegisterScene scene name is empty")
+	}
+	if s.Parser == nil || s.NewStorager == nil || s.Handler == nil {
+		panic(fmt.Sprintf("Control: RegisterScene scene %q is incomplete", s.Name))
+	}
+	if _, ok := sceneMap[s.Name]; ok {
+		panic(fmt.Sprintf("Control: RegisterScene called twice for scene %q", s.Name))
+	}
+	sceneMap[s.Name] = s
+}
+
+// GetScene 获取已注册的场景
+func GetScene(name string) (*Scene, error) {
+	s, ok := sceneMap[name]
+	if !ok {
+		return nil, fmt.Errorf("scene %q is not registered, available scenes: %s",
+			name, strings.Join(SceneNames(), ","))
+	}
+	return s, nil
+}
+
+// SceneNames 已注册的场景名，按字母序
+func SceneNames() []string {
+	names := make([]string, 0, len(sceneMap))
+	for name := range sceneMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProcessRecord 默认的处理流程：解码 -> 解析 -> 过滤 -> 写redis -> 写FreqLog文件
+// 非法及写入失败的消息写入死信；被过滤、写入成功及已写入死信的消息会被确认
+// 未配置死信时非法消息直接确认，redis写入失败的消息按退避时间重试，见Worker.waitRetry
+func ProcessRecord(w *Worker, msg *config.KafkaConsumerMsg) error {
+	//msg.Value 是字节数组，注意类型转换  处理业务逻辑
+	var rec Record
+	data, err := w.decoders.Decode(msg.Topic, msg.Value)
+	if err == nil {
+		rec, err = w.scene.Parser(data, &w.WorkerCnf)
+	}
+	if err == nil {
+		rec, err = currentExpr().Apply(rec, data)
+	}
+	if errors.Is(err, ErrorFiltered) {
+		graphite.Add(FRQ_MSG_IGNORE, 1)
+		var fe *FilterError
+		if errors.As(err, &fe) {
+			graphite.Add(FRQ_MSG_FILTER+"."+fe.Rule, 1)
+		}
+		msg.Ack()
+		return err
+	}
+	if err != nil {
+		graphite.Add(FRQ_MSG_INVALID, 1)
+		w.msgLogger(msg).Debugf("invalid msg(%s): %s", msg.Value, err)
+		w.rejectRecord(msg, err)
+		return err
+	}
+	if rec.Ignore() {
+		graphite.Add(FRQ_MSG_IGNORE, 1)
+		msg.Ack()
+		return nil
+	}
+
+	if w.batching() {
+		return w.addBatch(msg, rec)
+	}
+	var backoff time.Duration
+	for {
+		err := w.setRedis(rec)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrorMarshal) {
+			w.rejectRecord(msg, err)
+			return err
+		}
+		if w.deadLetter != nil || !w.waitRetry(&backoff) {
+			w.sendDeadLetter(msg, err)
+			return err
+		}
+	}
+	return w.finishRecord(msg, rec)
+}
+
+func parseProcessData(data codec.Record, cfg *WorkerConfig) (Record, error) {
+	lg, err := newProcessDataLogStruct(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return lg, nil
+}
+
+func parseFreqLog(data codec.Record, cfg *WorkerConfig) (Record, error) {
+	lg, err := newFreqLogStruct(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return lg, nil
+}
+
+func newMemStorager(lg logging.Logger, cfg *config.RedisCluster) (RedisStorager, error) {
+	st, err := process_data.NewRedisStorager(lg, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
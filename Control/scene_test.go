@@ -0,0 +1,137 @@
+package Control
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"process_data/config"
+	"process_data/lib/codec"
+)
+
+func TestGetScene(t *testing.T) {
+	for _, name := range []string{"process_data", "freq"} {
+		s, err := GetScene(name)
+		if err != nil {
+			t.Errorf("scene %s: %s", name, err)
+			continue
+		}
+		if s.Name != name {
+			t.Errorf("scene %s: got %s", name, s.Name)
+		}
+	}
+
+	if _, err := GetScene("unknown"); err == nil {
+		t.Error("unknown scene should be rejected")
+	}
+}
+
+func TestSceneParser(t *testing.T) {
+	var tests = []struct {
+		scene string
+		msg   string
+		key   string
+	}{
+		{"process_data", `{"uid":"1","mid":"2","follow":200,"src_uid":"3","src_mid":"4","state":1,"event":2}`, "4_transmit_new"},
+		{"freq", "ad_5c2205801427|pos56e566f71a201|33|CMCC|2780123000|iphone|", "ad_5c2205801427"},
+	}
+	for _, tt := range tests {
+		s, _ := GetScene(tt.scene)
+		d, _ := NewTopicDecoders(s, nil)
+		data, err := d.Decode("", []byte(tt.msg))
+		if err != nil {
+			t.Errorf("scene %s: %s", tt.scene, err)
+			continue
+		}
+		rec, err := s.Parser(data, &WorkerConfig{LogFilePath: "/tmp/", LogFileNum: 64})
+		if err != nil {
+			t.Errorf("scene %s: %s", tt.scene, err)
+			continue
+		}
+		if rec.GetRedisKey() != tt.key {
+			t.Errorf("scene %s: key %s except %s", tt.scene, rec.GetRedisKey(), tt.key)
+		}
+	}
+}
+
+func TestTopicDecoders(t *testing.T) {
+	s, _ := GetScene("process_data")
+	cfg := &config.KafkaConsumerConfig{
+		TopicDecoders: map[string]*codec.Config{
+			"transmit_csv": {Type: codec.TypeCSV, Columns: []string{"uid", "mid", "follow", "src_uid", "src_mid", "state", "event"}},
+		},
+	}
+	d, err := NewTopicDecoders(s, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := map[string]string{
+		"transmit":     `{"uid":"1","mid":"2","follow":200,"src_uid":"3","src_mid":"4","state":1,"event":2}`,
+		"transmit_csv": "1|2|200|3|4|1|2",
+	}
+	for topic, msg := range msgs {
+		data, err := d.Decode(topic, []byte(msg))
+		if err != nil {
+			t.Errorf("topic %s: %s", topic, err)
+			continue
+		}
+		rec, err := s.Parser(data, &WorkerConfig{LogFilePath: "/tmp/", LogFileNum: 64})
+		if err != nil {
+			t.Errorf("topic %s: %s", topic, err)
+			continue
+		}
+		if _, tm := rec.(TransmitRecord).GetTransmit(); tm.FollowerCount != 200 || tm.Uid != "1" {
+			t.Errorf("topic %s: %+v", topic, tm)
+		}
+	}
+	if _, err := d.Decode("transmit", []byte("1|2|200")); err == nil {
+		t.Error("csv message on json topic should fail")
+	}
+
+	cfg.TopicDecoders["transmit_pb"] = &codec.Config{Type: codec.TypeProtobuf, Descriptor: "/nonexistent.pb", Message: "a.B"}
+	if _, err := NewTopicDecoders(s, cfg); err == nil {
+		t.Error("missing descriptor file should fail")
+	}
+}
+
+func TestAdLog(t *testing.T) {
+	s, _ := GetScene("freq")
+	d, _ := NewTopicDecoders(s, nil)
+	parse := func(msg string) (*LogStruct, error) {
+		data, err := d.Decode("", []byte(msg))
+		if err != nil {
+			return nil, err
+		}
+		rec, err := s.Parser(data, &WorkerConfig{LogFilePath: "/tmp/", LogFileNum: 64})
+		if err != nil {
+			return nil, err
+		}
+		return rec.(*LogStruct), nil
+	}
+
+	l, err := parse("ad_5c2205801427|pos56e566f71a201|33|CMCC|2780123000|iphone|3333_2001|108C393010|39.187.201.240|||||2018-12-26 18:59:57|iPhone9%2C2%5F%5Fweibo%5F%5F8.12.3%5F%5Fiphone%5F%5Fos12.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LogStruct{
+		Uid: "2780123000", Adid: "ad_5c2205801427", Position: "pos56e566f71a201", Carrier: "CMCC", Platform: "iphone",
+		Time: time.Date(2018, 12, 26, 18, 59, 57, 0, time.Local), UA: "iPhone9,2__weibo__8.12.3__iphone__os12.0.1",
+	}
+	if l.Uid != want.Uid || l.Adid != want.Adid || l.Position != want.Position || l.Carrier != want.Carrier ||
+		l.Platform != want.Platform || !l.Time.Equal(want.Time) || l.UA != want.UA {
+		t.Errorf("%+v, except %+v", l, want)
+	}
+
+	l, err = parse("ad_5c2205801427|pos56e566f71a201|33|CMIC|2432234234|iphone|")
+	if err != nil || l.Uid != "2432234234" || !l.Time.IsZero() {
+		t.Errorf("%+v %v", l, err)
+	}
+
+	// 原先4列的日志会越界panic
+	if _, err := parse("ad_5c2205801427|pos56e566f71a201|33|CMCC"); err == nil || !strings.Contains(err.Error(), "column 4 (uid) is missing") {
+		t.Errorf("%v, except uid missing", err)
+	}
+	if _, err := parse("ad_1|pos|33|CMCC|1|iphone||||||||2018-12-26|"); err == nil || !strings.Contains(err.Error(), "column 13 (time)") {
+		t.Errorf("%v, except time error", err)
+	}
+}
@@ -2,6 +2,9 @@ package Control
 
 import (
 	"errors"
+
+	"process_data/Control/process_data"
+	"process_data/config"
 )
 
 var (
@@ -13,6 +16,20 @@ type RedisStorager interface {
     GetRedis(string) (string, error)
     SetRedis(string,string) error
 	CloseRedis() error
+
+	// 转发集合，见process_data.Transmit
+	AddTransmit(srcMid string, t *process_data.Transmit) error
+	TopTransmits(srcMid string, n int) ([]*process_data.Transmit, error)
+	TransmitCount(srcMid string) (int64, error)
 }
 
+// RedisReloader 支持热加载的RedisStorager，目前仅支持调整连接池大小
+type RedisReloader interface {
+	ReloadRedis(*config.RedisCluster) error
+}
 
+// RedisBatchStorager 支持批量写入的RedisStorager，返回值与keys一一对应
+type RedisBatchStorager interface {
+	SetRedisBatch(keys []string, values []string) []error
+	AddTransmitBatch(srcMids []string, ts []*process_data.Transmit) []error
+}
@@ -2,12 +2,16 @@ package Control
 
 import (
 	_ "encoding/json"
-	_ "errors"
+	"errors"
 	"fmt"
+	"process_data/Control/process_data"
 	"process_data/config"
+	"process_data/lib/graphite"
 	"process_data/lib/logging"
 	"process_data/lib/rtm"
+	ltime "process_data/lib/time"
 	"sync"
+	"time"
 
 	//"github.com/json-iterator/go"
 	//"time"
@@ -20,6 +24,17 @@ type WorkerConfig struct {
 	Routines    int    `toml:"routines",json:"routines"`
 	LogFileNum  int    `toml:"log_file_num",json:"log_file_num"`
 	LogFilePath string `toml:"log_file_path",json:"log_file_path"`
+
+	// batch_size大于1时批量写入redis：攒够batch_size条或每隔batch_interval写入一次，写入后再确认消息
+	BatchSize     int            `toml:"batch_size" json:"batch_size"`
+	BatchInterval ltime.Duration `toml:"batch_interval" json:"batch_interval"` // default 100ms
+
+	// FreqLog文件为 log_file_path + path_template，日期与小时取自消息中的time_field，没有时为处理时间
+	PathTemplate string         `toml:"path_template" json:"path_template"` // default "{date}/{hour}/{bucket}_pvlog.txt"
+	TimeField    string         `toml:"time_field" json:"time_field"`       // 为空时使用处理时间
+	TimeLayout   string         `toml:"time_layout" json:"time_layout"`     // time_field为字符串时的格式，default "2006-01-02 15:04:05"
+	TimeZone     string         `toml:"time_zone" json:"time_zone"`         // 如 Asia/Shanghai，默认本地时区
+	location     *time.Location
 }
 
 
@@ -38,11 +53,18 @@ func (c *WorkerConfig) Validate() error {
 	if c.LogFilePath == "" {
 		c.LogFilePath = "/tmp/"
 	}
+	if c.BatchInterval.Duration == 0 {
+		c.BatchInterval.Duration = 100 * time.Millisecond
+	}
+	if err := c.validateLogPath(); err != nil {
+		return err
+	}
 	return nil
 }
 
 type Worker struct {
 	Scene      string
+	scene      *Scene
 	Logger     logging.Logger
 	ID         int
 	cfg        *Config
@@ -50,7 +72,24 @@ type Worker struct {
 	WorkerCnf  WorkerConfig
 	inMsgCh    config.KafkaConsumerMsgCh
 	notifctnCh rtm.NotifctnCh
+	stopOnce   sync.Once
 	rediswr    RedisStorager
+	metricNode string         // worker.<id>
+	deadLetter DeadLetterSink // 为nil时不写死信
+	noRetry    bool           // redis写入失败时不重试，如重放死信
+	decoders   *TopicDecoders
+	freqLogs   *logging.FreqLogPool // 为nil时每次写入打开文件
+
+	batcher RedisBatchStorager // 为nil时逐条写入redis
+	batch   []batchRecord      // 等待批量写入redis的记录
+}
+
+// batchRecord 已解析、等待写入redis的消息
+type batchRecord struct {
+	msg   *config.KafkaConsumerMsg
+	rec   Record
+	key   string
+	value string
 }
 
 func NewWorker(
@@ -61,34 +100,59 @@ func NewWorker(
 	rdstg RedisStorager,
 	inCh config.KafkaConsumerMsgCh,
 ) (*Worker, error) {
+	sc, err := GetScene(scene)
+	if err != nil {
+		return nil, err
+	}
+	decoders, err := NewTopicDecoders(sc, nil)
+	if err != nil {
+		return nil, err
+	}
 	w := &Worker{
 		Scene:      scene,
-		Logger:     lg,
+		scene:      sc,
+		Logger:     lg.With(logging.Fields{"worker": id}),
+		cfg:        cfg,
 		inMsgCh:    inCh,
 		rediswr:    rdstg,
 		ID:         id,
+		metricNode: fmt.Sprintf("%s.%d", FRQ_WORKER_NODE_NAME, id),
 		notifctnCh: make(rtm.NotifctnCh),
+		decoders:   decoders,
 	}
+	w.batcher, _ = rdstg.(RedisBatchStorager)
 	return w, nil
 }
 
 func (w *Worker) Start(wg *sync.WaitGroup) error {
-	w.Logger.Infof("Worker:%d started", w.ID)
+	w.Logger.Info("worker started")
 	w.wg = wg
 
+	var flushC <-chan time.Time // 未启用批量写入时为nil，select时永远阻塞
+	if w.batching() {
+		ticker := time.NewTicker(w.WorkerCnf.BatchInterval.Duration)
+		defer ticker.Stop()
+		flushC = ticker.C
+	}
+
 	for {
 		select {
 		case msg, ok := <-w.inMsgCh:
 			if !ok {
-				w.Logger.Errorf("Worker:%d message channel closed", w.ID)
+				w.Logger.Error("message channel closed")
+				w.flushBatch()
 				w.stop()
 				return nil
 			}
 			if err := w.process(msg); err != nil {
 				continue
 			}
+		case <-flushC:
+			w.flushBatch()
 		case n, ok := <-w.notifctnCh:
-			w.Logger.Errorf("Worker:%d (%d,%v) stoping", w.ID, n, ok)
+			w.Logger.Errorf("(%d,%v) stoping", n, ok)
+			w.flushBatch()
+			w.stop()
 			return nil
 		}
 	}
@@ -97,16 +161,223 @@ func (w *Worker) Start(wg *sync.WaitGroup) error {
 }
 
 func (w *Worker) process(msg *config.KafkaConsumerMsg) error {
-      if w.Scene == "process_data" {
-      	//msg.Value 是字节数组，注意类型转换  处理业务逻辑
+	if !msg.Received.IsZero() {
+		graphite.Timing(FRQ_TIME_QUEUE, time.Since(msg.Received))
+	}
+	graphite.Add(FRQ_MSG_QPS, 1)
+	graphite.AddQPS(w.metricNode, 1)
+	return w.scene.Handler(w, msg)
+}
 
-            fmt.Printf("consume:"+string(msg.Value)+"\n")
-           }
+// ErrorMarshal 记录序列化为redis value失败，重试也不会成功
+var ErrorMarshal = errors.New("marshal redis value failed")
 
-		return nil
+// setRedis 将解析后的记录写入redis，序列化失败时返回的错误包含ErrorMarshal
+func (w *Worker) setRedis(rec Record) error {
+	key := rec.GetRedisKey()
+	value, err := rec.GetRedisValue()
+	if err != nil {
+		graphite.Add(FRQ_MSG_RDS_FAIL, 1)
+		w.Logger.Errorf("marshal %s failed: %s", key, err)
+		return fmt.Errorf("%w: %s", ErrorMarshal, err)
+	}
+	start := time.Now()
+	if tr, ok := rec.(TransmitRecord); ok {
+		err = w.rediswr.AddTransmit(tr.GetTransmit())
+	} else {
+		err = w.rediswr.SetRedis(key, value)
+	}
+	graphite.Timing(FRQ_TIME_REDIS, time.Since(start))
+	if err != nil {
+		graphite.Add(FRQ_MSG_RDS_FAIL, 1)
+		w.Logger.Errorf("set redis %s failed: %s", key, err)
+		return err
+	}
+	graphite.Add(FRQ_MSG_RDS_SUCCESS, 1)
+	return nil
+}
+
+// batching 是否批量写入redis
+func (w *Worker) batching() bool {
+	return w.batcher != nil && w.WorkerCnf.BatchSize > 1
+}
+
+// addBatch 记录加入批量写入，达到batch_size时写入redis
+func (w *Worker) addBatch(msg *config.KafkaConsumerMsg, rec Record) error {
+	key := rec.GetRedisKey()
+	value, err := rec.GetRedisValue()
+	if err != nil {
+		graphite.Add(FRQ_MSG_RDS_FAIL, 1)
+		w.Logger.Errorf("marshal %s failed: %s", key, err)
+		w.rejectRecord(msg, err)
+		return err
 	}
+	w.batch = append(w.batch, batchRecord{msg: msg, rec: rec, key: key, value: value})
+	if len(w.batch) >= w.WorkerCnf.BatchSize {
+		w.flushBatch()
+	}
+	return nil
+}
 
+// flushBatch 批量写入redis，写入成功的记录再写文件并确认消息
+// 写入失败的记录写入死信，未配置死信时按退避时间重试失败的记录
+func (w *Worker) flushBatch() {
+	var backoff time.Duration
+	for len(w.batch) > 0 {
+		errs := w.setRedisBatch()
+		failed := w.batch[:0]
+		for i, b := range w.batch {
+			if errs[i] != nil {
+				graphite.Add(FRQ_MSG_RDS_FAIL, 1)
+				w.Logger.Errorf("set redis %s failed: %s", b.key, errs[i])
+				if w.deadLetter == nil {
+					failed = append(failed, b)
+					continue
+				}
+				w.sendDeadLetter(b.msg, errs[i])
+				continue
+			}
+			graphite.Add(FRQ_MSG_RDS_SUCCESS, 1)
+			w.finishRecord(b.msg, b.rec)
+		}
+		w.batch = failed
+		if len(failed) > 0 && !w.waitRetry(&backoff) {
+			w.Logger.Errorf("worker stopped, %d messages not written to redis are left unacknowledged", len(failed))
+			break
+		}
+	}
+	w.batch = w.batch[:0]
+}
+
+// 未配置死信时redis写入失败的重试间隔
+const (
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+)
 
+// waitRetry 未配置死信时redis写入失败的消息不跳过，等待退避时间后重试，退避时间从minRetryBackoff开始翻倍
+// 重试期间不再读取消息，consumer的未确认消息达到max_pending后暂停拉取；worker停止时返回false，消息不确认
+func (w *Worker) waitRetry(backoff *time.Duration) bool {
+	if w.noRetry {
+		return false
+	}
+	if *backoff *= 2; *backoff < minRetryBackoff {
+		*backoff = minRetryBackoff
+	}
+	if *backoff > maxRetryBackoff {
+		*backoff = maxRetryBackoff
+	}
+	graphite.Add(FRQ_MSG_RDS_RETRY, 1)
+	timer := time.NewTimer(*backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.notifctnCh:
+		return false
+	}
+}
+
+// setRedisBatch 转发记录写入转发集合，其余记录SET，返回值与w.batch一一对应
+func (w *Worker) setRedisBatch() []error {
+	errs := make([]error, len(w.batch))
+	keys, values, setIndex := []string{}, []string{}, []int{}
+	srcMids, transmits, transmitIndex := []string{}, []*process_data.Transmit{}, []int{}
+	for i, b := range w.batch {
+		if tr, ok := b.rec.(TransmitRecord); ok {
+			srcMid, t := tr.GetTransmit()
+			srcMids, transmits = append(srcMids, srcMid), append(transmits, t)
+			transmitIndex = append(transmitIndex, i)
+			continue
+		}
+		keys, values = append(keys, b.key), append(values, b.value)
+		setIndex = append(setIndex, i)
+	}
+	if len(keys) > 0 {
+		start := time.Now()
+		for j, err := range w.batcher.SetRedisBatch(keys, values) {
+			errs[setIndex[j]] = err
+		}
+		graphite.Timing(FRQ_TIME_REDIS_BATCH, time.Since(start))
+	}
+	if len(srcMids) > 0 {
+		start := time.Now()
+		for j, err := range w.batcher.AddTransmitBatch(srcMids, transmits) {
+			errs[transmitIndex[j]] = err
+		}
+		graphite.Timing(FRQ_TIME_REDIS_BATCH, time.Since(start))
+	}
+	return errs
+}
+
+// finishRecord redis写入成功后写文件，文件的缓冲写入磁盘后确认消息
+func (w *Worker) finishRecord(msg *config.KafkaConsumerMsg, rec Record) error {
+	logPath, logName := rec.GetLogFile()
+	if err := w.writeFile(logPath, logName, msg.Value, msg.Ack); err != nil {
+		w.sendDeadLetter(msg, err)
+		return err
+	}
+	graphite.Add(FRQ_MSG_SUCC, 1)
+	return nil
+}
+
+// msgLogger 附加消息的topic、partition、offset
+func (w *Worker) msgLogger(msg *config.KafkaConsumerMsg) logging.Logger {
+	return w.Logger.With(logging.Fields{"topic": msg.Topic, "partition": msg.Partition, "offset": msg.Offset})
+}
+
+// sendDeadLetter 将处理失败的消息写入死信，写入成功后确认消息
+func (w *Worker) sendDeadLetter(msg *config.KafkaConsumerMsg, reason error) {
+	if w.deadLetter == nil {
+		return
+	}
+	if err := w.deadLetter.Write(NewDeadLetter(msg, reason)); err != nil {
+		graphite.Add(FRQ_MSG_DEAD_LETTER_FAIL, 1)
+		w.msgLogger(msg).Errorf("write dead letter failed: %s", err)
+		return
+	}
+	graphite.Add(FRQ_MSG_DEAD_LETTER, 1)
+	msg.Ack()
+}
+
+// rejectRecord 非法的消息重试也不会成功，写入死信；未启用死信时直接确认
+// 写入死信失败时不确认，重启后重新消费
+func (w *Worker) rejectRecord(msg *config.KafkaConsumerMsg, reason error) {
+	if w.deadLetter == nil {
+		msg.Ack()
+		return
+	}
+	w.sendDeadLetter(msg, reason)
+}
+
+// writeFile 将原始消息追加到按小时、按桶划分的FreqLog文件，写入磁盘后调用ack
+// 使用句柄池时ack在缓冲写入文件后由池调用，写入失败时不调用
+func (w *Worker) writeFile(logPath, logName string, b []byte, ack func()) error {
+	defer func(start time.Time) { graphite.Timing(FRQ_TIME_FILE_WRITE, time.Since(start)) }(time.Now())
+	if w.freqLogs != nil {
+		if err := w.freqLogs.WriteAck(logPath, logName, b, ack); err != nil {
+			graphite.Add(FRQ_MSG_WRFILE_FAIL, 1)
+			w.Logger.Errorf("write %s%s failed: %s", logPath, logName, err)
+			return err
+		}
+		graphite.Add(FRQ_MSG_WRFILE_SUCCESS, 1)
+		return nil
+	}
+	freqLogger := logging.NewFreqLog(logPath, logName)
+	if err := freqLogger.Validate(); err != nil {
+		graphite.Add(FRQ_MSG_WRFILE_DIR__FAIL, 1)
+		w.Logger.Errorf("create dir %s failed: %s", logPath, err)
+		return err
+	}
+	if _, err := freqLogger.Write(b); err != nil {
+		graphite.Add(FRQ_MSG_WRFILE_FAIL, 1)
+		w.Logger.Errorf("write %s%s failed: %s", logPath, logName, err)
+		return err
+	}
+	graphite.Add(FRQ_MSG_WRFILE_SUCCESS, 1)
+	ack()
+	return nil
+}
 
 func (w *Worker) stop() error {
 	defer func() {
@@ -114,11 +385,15 @@ func (w *Worker) stop() error {
 			w.wg.Done()
 		}
 	}()
-	w.Logger.Infof("stop worker %d ,wg Done", w.ID)
+	w.Logger.Info("stop worker, wg Done")
 	return nil
 }
 
+// Stop 通知worker退出，不等待退出完成，可重复调用
 func (w *Worker) Stop() error {
+	w.stopOnce.Do(func() {
+		close(w.notifctnCh)
+	})
 	return nil
 }
 
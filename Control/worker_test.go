@@ -1,8 +1,16 @@
 package Control
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"process_data/Control/process_data"
+	"process_data/config"
 	"process_data/lib/logging"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestProcess(t *testing.T) {
@@ -50,3 +58,126 @@ func BenchmarkProcess(b *testing.B) {
 		}
 	}
 }
+
+// batchStorager 记录每次批量写入的key，前fails次SET批量写入失败
+type batchStorager struct {
+	batches [][]string
+	fails   int
+}
+
+func (s *batchStorager) GetRedis(key string) (string, error) { return "", ErrorNotFound }
+func (s *batchStorager) SetRedis(key, value string) error   { return nil }
+func (s *batchStorager) CloseRedis() error                  { return nil }
+func (s *batchStorager) AddTransmit(srcMid string, t *process_data.Transmit) error {
+	return nil
+}
+func (s *batchStorager) TopTransmits(srcMid string, n int) ([]*process_data.Transmit, error) {
+	return nil, nil
+}
+func (s *batchStorager) TransmitCount(srcMid string) (int64, error) { return 0, nil }
+func (s *batchStorager) SetRedisBatch(keys, values []string) []error {
+	s.batches = append(s.batches, keys)
+	errs := make([]error, len(keys))
+	if s.fails > 0 {
+		s.fails--
+		for i := range errs {
+			errs[i] = errors.New("redis down")
+		}
+	}
+	return errs
+}
+func (s *batchStorager) AddTransmitBatch(srcMids []string, ts []*process_data.Transmit) []error {
+	s.batches = append(s.batches, srcMids)
+	return make([]error, len(srcMids))
+}
+
+// 批量写入redis，攒够batch_size或flush后才确认消息
+func TestWorkerBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st := &batchStorager{}
+	w, err := NewWorker("freq", 0, &Config{}, logging.DefaultLogger(), st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WorkerCnf = WorkerConfig{LogFileNum: 64, LogFilePath: dir + "/", BatchSize: 3}
+
+	acked := 0
+	send := func(i int) {
+		msg := &config.KafkaConsumerMsg{
+			Value:   []byte(fmt.Sprintf("ad_%d|pos|33|CMCC|%d|iphone|", i, 2780123000+i)),
+			AckFunc: func() { acked++ },
+		}
+		if err := w.process(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(1)
+	send(2)
+	if acked != 0 || len(st.batches) != 0 {
+		t.Fatalf("acked %d, batches %d before batch_size reached", acked, len(st.batches))
+	}
+	send(3)
+	if acked != 3 || len(st.batches) != 1 || len(st.batches[0]) != 3 {
+		t.Fatalf("acked %d, batches %v after batch_size reached", acked, st.batches)
+	}
+	send(4)
+	w.flushBatch()
+	if acked != 4 || len(st.batches) != 2 {
+		t.Fatalf("acked %d, batches %v after flush", acked, st.batches)
+	}
+}
+
+// 未配置死信时redis写入失败的消息按退避时间重试，不跳过；worker停止时不确认
+func TestWorkerRedisRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st := &batchStorager{fails: 2}
+	w, err := NewWorker("freq", 0, &Config{}, logging.DefaultLogger(), st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WorkerCnf = WorkerConfig{LogFileNum: 64, LogFilePath: dir + "/", BatchSize: 2}
+
+	var acked int32
+	send := func(i int) {
+		msg := &config.KafkaConsumerMsg{
+			Value:   []byte(fmt.Sprintf("ad_%d|pos|33|CMCC|%d|iphone|", i, 2780123000+i)),
+			AckFunc: func() { atomic.AddInt32(&acked, 1) },
+		}
+		if err := w.process(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(1)
+	send(2)
+	if acked != 2 || len(st.batches) != 3 {
+		t.Fatalf("acked %d, batches %d after retry", acked, len(st.batches))
+	}
+
+	st.fails = 1 << 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send(3)
+		send(4)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	w.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker should stop retrying")
+	}
+	if n := atomic.LoadInt32(&acked); n != 2 {
+		t.Errorf("acked %d, messages failed to write redis should not be acked", n)
+	}
+}
@@ -13,6 +13,10 @@ import (
 var usage = `
 Usage:
 	process_data Control  server  --config=<x.toml> [--test]
+	process_data Control  replay-dlq  --config=<x.toml> --file=<dead_letter.log>
+
+Options:
+	--file=<dead_letter.log>  死信文件, .gz为压缩后的文件, "-"从标准输入读取
 `
 
 var (
@@ -24,7 +28,9 @@ type cmd struct {
 	conf struct {
 		IsCmdFreqControl bool   `docopt:"Control"`
 		IsSubCmdServer   bool   `docopt:"server"`
+		IsSubCmdReplay   bool   `docopt:"replay-dlq"`
 		CfgFname         string `docopt:"--config"`
+		DLQFname         string `docopt:"--file"`
 		IsTest           bool   `docopt:"--test"`
 	}
 }
@@ -49,6 +55,15 @@ func (c *cmd) subCmdServer() int {
 	return 0
 }
 
+func (c *cmd) subCmdReplay() int {
+	cl := Control.New(c.conf.CfgFname)
+	if err := cl.ReplayDeadLetter(c.conf.DLQFname); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
 func (c *cmd) Run() int {
 
 	opts, err := docopt.ParseDoc(usage)
@@ -71,6 +86,9 @@ func (c *cmd) Run() int {
 	if c.conf.IsSubCmdServer {
 		return c.subCmdServer()
 	}
+	if c.conf.IsSubCmdReplay {
+		return c.subCmdReplay()
+	}
 
 	return 0
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Shopify/sarama"
+	"process_data/lib/codec"
 	"process_data/lib/logging"
 	"strings"
 	"time"
@@ -13,29 +14,30 @@ type KafkaConfig struct {
 	Hosts            []string                `toml:"brokers" json:"brokers"`
 	Timeout          *time.Duration          `toml:"timeout"`
 	Metadata         MetaConfig              `toml:"metadata"`
-	KeepAlive        *time.Duration          `toml:"keep_alive`
-	MaxMessageBytes  *int                    `toml:"max_message_bytes`
-	RequiredACKs     *int                    `toml:"required_acks`
-	BrokerTimeout    *time.Duration          `toml:"broker_timeout`
+	KeepAlive        *time.Duration          `toml:"keep_alive"`
+	MaxMessageBytes  *int                    `toml:"max_message_bytes"`
+	RequiredACKs     *int                    `toml:"required_acks"`
+	BrokerTimeout    *time.Duration          `toml:"broker_timeout"`
 	Compression      *string                 `toml:"compression"`
 	CompressionMode  sarama.CompressionCodec `toml:"-"`
 	CompressionLevel *int                    `toml:"compression_level"`
-	MaxRetries       *int                    `toml:"max_retries`
+	MaxRetries       *int                    `toml:"max_retries"`
+	RetryBackoff     *time.Duration          `toml:"retry_backoff"` // 生产者重试及broker断开后重新选择leader的等待时间
 	ClientID         string                  `toml:"client_id"`
 	Username         string                  `toml:"username"`
 	Password         string                  `toml:"password"`
-	Codec            *string                 `toml:"codec"`
+	Codec            *string                 `toml:"codec"` // 消费者的解码器类型，同decoder.type
 }
 
 // MetaConfig Metadata的相关配置
 type MetaConfig struct {
 	Retry       MetaRetryConfig `toml:"retry"`
-	RefreshFreq *time.Duration  `toml:"refresh_frequency`
+	RefreshFreq *time.Duration  `toml:"refresh_frequency"`
 }
 
 type MetaRetryConfig struct {
-	Max     *int           `toml:"max`
-	Backoff *time.Duration `toml:"backoff`
+	Max     *int           `toml:"max"`
+	Backoff *time.Duration `toml:"backoff"`
 }
 
 // compressionModes 生产者的对数据的压缩算法
@@ -55,16 +57,33 @@ type KafkaConsumerConfig struct {
 	Topics            []string `toml:"topics" json:"topics"`
 	Routines          int      `toml:"routines"`
 	ChannelBufferSize int      `toml:"channel_buffer_size"`
+	MaxPending        int      `toml:"max_pending"` // 每个partition已拉取未确认的消息数上限，达到时暂停拉取，default 100000
 
 	GroupID         string `toml:"groupid" json:"groupid"`
 	AutoOffsetReset string `toml:"auto_offset_reset" json:"auto_offset_reset"` //earliest or latest
 	InitialOffset   int64
+
+	// 消息的解码器，type为空时使用场景的默认解码器；topic_decoder按topic覆盖
+	Decoder       codec.Config             `toml:"decoder" json:"decoder"`
+	TopicDecoders map[string]*codec.Config `toml:"topic_decoder" json:"topic_decoder"`
 }
 
 // KafkaConsumerMsg 消费者的配置
 type KafkaConsumerMsg struct {
-	Value []byte
-	Type  int //value的类型，自定义
+	Value     []byte
+	Type      int //value的类型，自定义
+	Topic     string
+	Partition int32
+	Offset    int64
+	AckFunc   func()    // 由消费者设置，消息处理完成后调用以提交offset
+	Received  time.Time // 消费者从kafka收到消息的时间，用于统计排队耗时；重放的消息为零值
+}
+
+// Ack 确认消息已处理完成，只有连续确认的消息offset才会被提交
+func (m *KafkaConsumerMsg) Ack() {
+	if m.AckFunc != nil {
+		m.AckFunc()
+	}
 }
 
 type KafkaConsumerMsgCh chan *KafkaConsumerMsg
@@ -78,7 +97,12 @@ func (ch KafkaConsumerMsgCh) Capacity() int {
 
 type KafkaProducerMsg struct {
 	Value []byte
-	Type  int //value的类型，自定义
+	Type  int    //value的类型，自定义
+	Key   []byte // 可选，分区的key
+	Topic string // 可选，为空时写入Topics[0]
+
+	// 可选，需有缓冲；写入kafka或local_file后写入nil，两者都失败时写入错误
+	Result chan error
 }
 
 type KafkaProducerMsgCh chan *KafkaProducerMsg
@@ -158,9 +182,39 @@ func (c *KafkaConsumerConfig) Validate() error {
 	if c.ChannelBufferSize == 0 {
 		c.ChannelBufferSize = 10000
 	}
+	if c.MaxPending <= 0 {
+		c.MaxPending = 100000
+	}
+
+	if c.Codec != nil && len(c.Decoder.Type) == 0 {
+		c.Decoder.Type = *c.Codec
+	}
+	if len(c.Decoder.Type) > 0 {
+		if err := c.Decoder.Validate(); err != nil {
+			return fmt.Errorf("kafka.decoder: %s", err)
+		}
+	}
+	for topic, d := range c.TopicDecoders {
+		if !containsString(c.Topics, topic) {
+			return fmt.Errorf("kafka.topic_decoder.%s: topic is not in kafka.topics", topic)
+		}
+		if err := d.Validate(); err != nil {
+			return fmt.Errorf("kafka.topic_decoder.%s: %s", topic, err)
+		}
+	}
 
 	return nil
 }
+
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *KafkaProducerConfig) Validate() error {
 	if err := c.KafkaConfig.Validate(); err != nil {
 		return err
@@ -176,11 +230,12 @@ func (c *KafkaProducerConfig) Validate() error {
 		c.ChannelBufferSize = 10000
 	}
 
-	if len(c.File.FileName) == 0 {
+	// broker不可达或发送失败时，消息写入local_file
+	if c.File == nil || len(c.File.FileName) == 0 {
 		return fmt.Errorf("kafka_prodocer.local_file.filename is invalid")
 	}
 	if err := c.File.Validate(); err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	return nil
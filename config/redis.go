@@ -24,10 +24,47 @@ func (c *RedisServerConfig) Validate() error {
 
 type RedisNode struct {
 	Address string `toml:"address" json:"address"`
+	Weight  int    `toml:"weight" json:"weight"` // 仅hasher为KETAMA时有效, 默认1
+}
+
+// Redis部署模式
+const (
+	RedisModeSharding = ""        // 默认，客户端按hasher分片到各独立实例
+	RedisModeCluster  = "cluster" // Redis Cluster，redis_node为种子节点，按CRC16 slot路由
+)
+
+// 转发集合的排序方式
+const (
+	TransmitScoreFollower  = "follower"  // 按转发者粉丝数，保留粉丝数最多的top_n
+	TransmitScoreTimestamp = "timestamp" // 按消息的时间(worker.time_field，没有时为处理时间)，保留最近的top_n
+)
+
+// TransmitConfig 每个源mid的转发集合(sorted set)
+type TransmitConfig struct {
+	Score string `toml:"score" json:"score"` // default follower
+	TopN  int    `toml:"top_n" json:"top_n"` // 每个源mid最多保留的转发数 default 1000
+}
+
+func (c *TransmitConfig) Validate() error {
+	switch c.Score {
+	case "":
+		c.Score = TransmitScoreFollower
+	case TransmitScoreFollower, TransmitScoreTimestamp:
+	default:
+		return fmt.Errorf("\"transmit.score\" %q is invalid, must be follower or timestamp", c.Score)
+	}
+	if c.TopN == 0 {
+		c.TopN = 1000
+	}
+	if c.TopN < 0 {
+		return fmt.Errorf("\"transmit.top_n\" is invalid")
+	}
+	return nil
 }
 
 type RedisCluster struct {
 	Name               string         `toml:"name" json:"name"`
+	Mode               string         `toml:"mode" json:"mode"`
 	Database           int            `toml:"database" json:"database"` // default 0
 	Hasher             string         `toml:"hasher" json:"hasher"`
 	MaxIdle            int            `toml:"max_idle" json:"max_idle"`
@@ -38,7 +75,10 @@ type RedisCluster struct {
 	IdleTimeout        ltime.Duration `toml:"idle_timeout" json:"idle_timeout"`                 //单位: min
 	Nodes              []RedisNode    `toml:"redis_node" json:"redis_node"`
 	MaxRetry           int            `toml:"max_retry" json:"max_retry"` //命令执行重试次数 default 0
+	TTL                ltime.Duration `toml:"ttl" json:"ttl"`             //写入key的过期时间 default 120h
+	Transmit           TransmitConfig `toml:"transmit" json:"transmit"`
 	Servers            []string
+	Weights            []int
 }
 
 func (c *RedisCluster) Validate() error {
@@ -46,6 +86,17 @@ func (c *RedisCluster) Validate() error {
 		return fmt.Errorf("\"name\" is invalid")
 	}
 
+	switch c.Mode {
+	case RedisModeSharding:
+	case RedisModeCluster:
+		// Redis Cluster只支持db0
+		if c.Database != 0 {
+			return fmt.Errorf("\"database\" must be 0 in cluster mode")
+		}
+	default:
+		return fmt.Errorf("\"mode\" %q is invalid, must be empty or cluster", c.Mode)
+	}
+
 	if c.MaxIdle == 0 {
 		c.MaxIdle = 5
 	}
@@ -62,18 +113,33 @@ func (c *RedisCluster) Validate() error {
 	if c.IdleTimeout.Duration == 0 {
 		c.IdleTimeout.Duration = 5 * time.Minute
 	}
+	if c.TTL.Duration == 0 {
+		c.TTL.Duration = 5 * 24 * time.Hour
+	}
+	if c.TTL.Duration < time.Second {
+		return fmt.Errorf("\"ttl\" is invalid, must be at least 1s")
+	}
+	if err := c.Transmit.Validate(); err != nil {
+		return err
+	}
 
 	if len(c.Nodes) == 0 {
 		return fmt.Errorf("\"redis_node\" is invalid")
 	}
 	servers := []string{}
+	weights := []int{}
 	for i, node := range c.Nodes {
 		if len(node.Address) == 0 {
 			return fmt.Errorf("\"redis_node\"[%d] is invalid", i)
 		}
+		if node.Weight < 0 {
+			return fmt.Errorf("\"redis_node\"[%d].weight is invalid", i)
+		}
 		servers = append(servers, node.Address)
+		weights = append(weights, node.Weight)
 	}
 	c.Servers = servers
+	c.Weights = weights
 
 	return nil
 }
@@ -0,0 +1,102 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// confluentMagic Confluent格式消息的第一个字节，其后为4字节大端序的schema id
+const confluentMagic = 0
+
+// avroCodec 按schema解码一条avro二进制数据
+// union按标准JSON展开，即 {"string": "a"} 解码为 "a"
+type avroCodec struct {
+	codec *goavro.Codec
+}
+
+func loadAvroCodec(fname string) (*avroCodec, error) {
+	schema, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	c, err := goavro.NewCodecForStandardJSONFull(string(schema))
+	if err != nil {
+		return nil, fmt.Errorf("avro schema %s: %s", fname, err)
+	}
+	return &avroCodec{codec: c}, nil
+}
+
+func (c *avroCodec) decode(data []byte) (Record, error) {
+	native, _, err := c.codec.NativeFromBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	text, err := c.codec.TextualFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+	return JSONDecoder{}.Decode(text)
+}
+
+// avroDecoder 所有消息使用同一个schema文件
+type avroDecoder struct {
+	*avroCodec
+}
+
+func newAvroDecoder(fname string) (*avroDecoder, error) {
+	c, err := loadAvroCodec(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &avroDecoder{avroCodec: c}, nil
+}
+
+func (d *avroDecoder) Decode(msg []byte) (Record, error) {
+	return d.decode(msg)
+}
+
+// confluentAvroDecoder Confluent格式，按消息头中的schema id读取schema_dir/<id>.avsc
+// 读取成功的schema缓存在内存中，新增schema不需重启
+type confluentAvroDecoder struct {
+	dir    string
+	mu     sync.RWMutex
+	codecs map[uint32]*avroCodec
+}
+
+func newConfluentAvroDecoder(dir string) *confluentAvroDecoder {
+	return &confluentAvroDecoder{dir: dir, codecs: map[uint32]*avroCodec{}}
+}
+
+func (d *confluentAvroDecoder) Decode(msg []byte) (Record, error) {
+	if len(msg) < 5 || msg[0] != confluentMagic {
+		return nil, fmt.Errorf("avro: message is not in confluent format")
+	}
+	c, err := d.codec(binary.BigEndian.Uint32(msg[1:5]))
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(msg[5:])
+}
+
+func (d *confluentAvroDecoder) codec(id uint32) (*avroCodec, error) {
+	d.mu.RLock()
+	c, ok := d.codecs[id]
+	d.mu.RUnlock()
+	if ok {
+		return c, nil
+	}
+	c, err := loadAvroCodec(filepath.Join(d.dir, strconv.FormatUint(uint64(id), 10)+".avsc"))
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.codecs[id] = c
+	d.mu.Unlock()
+	return c, nil
+}
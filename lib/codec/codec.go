@@ -0,0 +1,197 @@
+// Package codec 将kafka消息解码为Record，按topic选择解码器
+//
+//	json      JSON对象
+//	csv       按分隔符切分，columns为各列的字段名，或用field逐列配置类型
+//	avro      schema文件，或Confluent格式(magic byte + schema id)从schema_dir读取<id>.avsc
+//	protobuf  descriptor set文件(protoc --include_imports --descriptor_set_out)中的message
+//
+// 解码器在加载配置时创建，可被多个goroutine同时使用
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TypeJSON     = "json"
+	TypeCSV      = "csv"
+	TypeAvro     = "avro"
+	TypeProtobuf = "protobuf"
+)
+
+// Record 解码后的一条消息，字段名到值
+// 值为nil, bool, 数字(json.Number/int64/uint64/float64), string, time.Time, []interface{}, map[string]interface{}
+type Record map[string]interface{}
+
+// Get 实现expr.Env
+func (r Record) Get(name string) (interface{}, bool) {
+	v, ok := r[name]
+	return v, ok
+}
+
+// String 字段的字符串值，数字转为十进制，字段不存在时为空
+func (r Record) String(name string) (string, error) {
+	switch v := r[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(DefaultTimeLayout), nil
+	default:
+		return "", fmt.Errorf("%s: cannot use %T as string", name, v)
+	}
+}
+
+// Int 字段的整数值，数字字符串会被解析，字段不存在时为0
+func (r Record) Int(name string) (int64, error) {
+	switch v := r[name].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return v, nil
+	case uint64:
+		return int64(v), nil
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, fmt.Errorf("%s: %v is not an integer", name, v)
+		}
+		return int64(v), nil
+	case json.Number:
+		n, err := strconv.ParseInt(v.String(), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s is not an integer", name, v)
+		}
+		return n, nil
+	case string:
+		if len(v) == 0 {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %q is not an integer", name, v)
+		}
+		return n, nil
+	case time.Time:
+		return v.Unix(), nil
+	default:
+		return 0, fmt.Errorf("%s: cannot use %T as integer", name, v)
+	}
+}
+
+// Time 字段的时间值，字符串按layout在loc时区解析，数字为Unix秒，字段不存在时为零值
+func (r Record) Time(name string, layout string, loc *time.Location) (time.Time, error) {
+	switch v := r[name].(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return v, nil
+	case string:
+		if len(v) == 0 {
+			return time.Time{}, nil
+		}
+		t, err := time.ParseInLocation(layout, v, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s: %s", name, err)
+		}
+		return t, nil
+	}
+	sec, err := r.Int(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// Decoder 将一条消息解码为Record
+type Decoder interface {
+	Decode(msg []byte) (Record, error)
+}
+
+// Config 解码器的配置
+type Config struct {
+	Type string `toml:"type" json:"type"` // json, csv, avro, protobuf
+
+	// csv: columns与field二选一
+	Columns   []string  `toml:"columns" json:"columns,omitempty"`     // 各列的字段名，为空或"-"的列不解码
+	Fields    []*Column `toml:"field" json:"field,omitempty"`         // 逐列配置
+	Delimiter string    `toml:"delimiter" json:"delimiter,omitempty"` // default "|"
+	TimeZone  string    `toml:"time_zone" json:"time_zone,omitempty"` // time列的时区，如 Asia/Shanghai，默认本地时区
+	location  *time.Location
+
+	// avro: schema与schema_dir二选一，schema_dir时消息为Confluent格式
+	Schema    string `toml:"schema" json:"schema,omitempty"`         // schema文件
+	SchemaDir string `toml:"schema_dir" json:"schema_dir,omitempty"` // <schema id>.avsc 所在目录
+
+	// protobuf
+	Descriptor string `toml:"descriptor" json:"descriptor,omitempty"` // descriptor set文件
+	Message    string `toml:"message" json:"message,omitempty"`       // message的全名，如 pkg.Msg
+}
+
+func (c *Config) Validate() error {
+	switch c.Type {
+	case TypeJSON:
+	case TypeCSV:
+		if (len(c.Columns) == 0) == (len(c.Fields) == 0) {
+			return fmt.Errorf("codec csv: one of columns and field must be set")
+		}
+		if len(c.Delimiter) == 0 {
+			c.Delimiter = "|"
+		}
+		if err := validateColumns(c.Fields); err != nil {
+			return fmt.Errorf("codec csv: %s", err)
+		}
+		c.location = time.Local
+		if len(c.TimeZone) > 0 {
+			loc, err := time.LoadLocation(c.TimeZone)
+			if err != nil {
+				return fmt.Errorf("codec csv: time_zone: %s", err)
+			}
+			c.location = loc
+		}
+	case TypeAvro:
+		if (len(c.Schema) == 0) == (len(c.SchemaDir) == 0) {
+			return fmt.Errorf("codec avro: one of schema and schema_dir must be set")
+		}
+	case TypeProtobuf:
+		if len(c.Descriptor) == 0 || len(c.Message) == 0 {
+			return fmt.Errorf("codec protobuf: descriptor and message must be set")
+		}
+	default:
+		return fmt.Errorf("codec type %q is invalid, must be one of json, csv, avro, protobuf", c.Type)
+	}
+	return nil
+}
+
+// New 创建解码器，avro与protobuf在此时读取schema
+func New(c *Config) (Decoder, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Type {
+	case TypeCSV:
+		return newCSVDecoder(c), nil
+	case TypeAvro:
+		if len(c.SchemaDir) > 0 {
+			return newConfluentAvroDecoder(c.SchemaDir), nil
+		}
+		return newAvroDecoder(c.Schema)
+	case TypeProtobuf:
+		return newProtobufDecoder(c.Descriptor, c.Message)
+	}
+	return JSONDecoder{}, nil
+}
@@ -0,0 +1,264 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// checkRecord 按String/Int比较字段
+func checkRecord(t *testing.T, r Record, strs map[string]string, ints map[string]int64) {
+	t.Helper()
+	for name, want := range strs {
+		if got, err := r.String(name); err != nil || got != want {
+			t.Errorf("%s = %q %v, except %q", name, got, err, want)
+		}
+	}
+	for name, want := range ints {
+		if got, err := r.Int(name); err != nil || got != want {
+			t.Errorf("%s = %d %v, except %d", name, got, err, want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	d, err := New(&Config{Type: TypeJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Decode([]byte(`{"uid":"1","mid":4611686018427387905,"follow":"200","user":{"name":"a"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, r, map[string]string{"uid": "1", "mid": "4611686018427387905", "none": ""},
+		map[string]int64{"follow": 200, "mid": 4611686018427387905, "none": 0})
+	if _, err := r.Int("user"); err == nil {
+		t.Error("Int on object should fail")
+	}
+	for _, msg := range []string{`[1]`, `null`, `{"a":`} {
+		if _, err := d.Decode([]byte(msg)); err == nil {
+			t.Errorf("%s: except error", msg)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	d, err := New(&Config{Type: TypeCSV, Columns: []string{"adid", "position", "", "carrier", "uid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Decode([]byte("ad_1|pos|33|CMCC|2780123000|iphone|"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, r, map[string]string{"adid": "ad_1", "carrier": "CMCC", "uid": "2780123000"}, nil)
+	if len(r) != 4 {
+		t.Errorf("%v, except 4 fields", r)
+	}
+	r, _ = d.Decode([]byte("ad_1|pos|33|CMCC"))
+	if _, ok := r["uid"]; ok {
+		t.Errorf("%v: uid should not exist", r)
+	}
+	if _, err := New(&Config{Type: TypeCSV}); err == nil {
+		t.Error("csv without columns should fail")
+	}
+}
+
+func TestCSVFields(t *testing.T) {
+	c := &Config{Type: TypeCSV, Fields: []*Column{
+		{Name: "id", Index: 0, Required: true},
+		{Name: "n", Index: 1, Type: ColumnInt},
+		{Name: "score", Index: 2, Type: ColumnFloat},
+		{Name: "ts", Index: 3, Type: ColumnTime},
+		{Name: "ua", Index: 4, URLDecode: true},
+		{Name: "tail", Index: 6, Required: true},
+	}}
+	d, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Decode([]byte("a|12|1.5|2018-12-26 18:59:57|iPhone9%2C2%5F%5Fweibo||z|extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2018, 12, 26, 18, 59, 57, 0, time.Local)
+	if r["n"] != int64(12) || r["score"] != 1.5 || !r["ts"].(time.Time).Equal(ts) || r["ua"] != "iPhone9,2__weibo" || r["tail"] != "z" {
+		t.Errorf("%v", r)
+	}
+	if got, _ := r.Int("ts"); got != ts.Unix() {
+		t.Errorf("Int(ts) = %d", got)
+	}
+
+	// 非string列为空时字段不存在
+	r, err = d.Decode([]byte("a||||||z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r["n"]; ok {
+		t.Errorf("%v: n should not exist", r)
+	}
+
+	errs := map[string]string{
+		"a|1|1|2018-12-26 18:59:57|ua|": "column 6 (tail) is missing",
+		"a|x||||z|":                     "column 1 (n)",
+		"a|||2018/12/26||z|":            "column 3 (ts)",
+		"a||||%zz||z":                   "column 4 (ua)",
+	}
+	for msg, want := range errs {
+		if _, err := d.Decode([]byte(msg)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, except %s", msg, err, want)
+		}
+	}
+
+	for _, cols := range [][]*Column{
+		{{Name: "a"}, {Name: "a", Index: 1}},
+		{{Name: "a", Type: "date"}},
+		{{Name: "", Index: 1}},
+		{{Name: "a", Index: -1}},
+	} {
+		if err := (&Config{Type: TypeCSV, Fields: cols}).Validate(); err == nil {
+			t.Errorf("%+v: except error", cols[len(cols)-1])
+		}
+	}
+}
+
+const testAvroSchema = `{
+	"type": "record", "name": "Transmit",
+	"fields": [
+		{"name": "uid", "type": "string"},
+		{"name": "follow", "type": "long"},
+		{"name": "src_mid", "type": ["null", "string"]}
+	]
+}`
+
+func TestAvro(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "42.avsc"), []byte(testAvroSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := goavro.NewCodec(testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.BinaryFromNative(nil, map[string]interface{}{
+		"uid": "1", "follow": int64(800), "src_mid": goavro.Union("string", "4"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(&Config{Type: TypeAvro, Schema: filepath.Join(dir, "42.avsc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, r, map[string]string{"uid": "1", "src_mid": "4"}, map[string]int64{"follow": 800})
+
+	d, err = New(&Config{Type: TypeAvro, SchemaDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{confluentMagic, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], 42)
+	r, err = d.Decode(append(header, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, r, map[string]string{"uid": "1", "src_mid": "4"}, map[string]int64{"follow": 800})
+
+	binary.BigEndian.PutUint32(header[1:], 43)
+	if _, err := d.Decode(append(header, data...)); err == nil {
+		t.Error("unknown schema id should fail")
+	}
+	if _, err := d.Decode(data); err == nil {
+		t.Error("message without confluent header should fail")
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("transmit.proto"),
+		Package: proto.String("weibo"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Transmit"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("uid"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				{Name: proto.String("follow"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				{Name: proto.String("tags"), Number: proto.Int32(3), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()},
+			},
+		}},
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fdp}}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "codec*.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(b)
+	f.Close()
+
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := fd.Messages().ByName("Transmit")
+	m := dynamicpb.NewMessage(md)
+	m.Set(md.Fields().ByName("uid"), protoreflect.ValueOf("1"))
+	m.Set(md.Fields().ByName("follow"), protoreflect.ValueOf(int64(800)))
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(&Config{Type: TypeProtobuf, Descriptor: f.Name(), Message: "weibo.Transmit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecord(t, r, map[string]string{"uid": "1"}, map[string]int64{"follow": 800})
+	if tags, ok := r["tags"].([]interface{}); !ok || len(tags) != 0 {
+		t.Errorf("tags = %#v", r["tags"])
+	}
+	if _, err := New(&Config{Type: TypeProtobuf, Descriptor: f.Name(), Message: "weibo.Nope"}); err == nil {
+		t.Error("unknown message should fail")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []*Config{
+		{Type: "xml"},
+		{Type: TypeAvro},
+		{Type: TypeAvro, Schema: "a.avsc", SchemaDir: "schemas"},
+		{Type: TypeProtobuf, Descriptor: "a.pb"},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v: except error", c)
+		}
+	}
+}
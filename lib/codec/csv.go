@@ -0,0 +1,130 @@
+package codec
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ColumnString = "string"
+	ColumnInt    = "int"
+	ColumnFloat  = "float"
+	ColumnTime   = "time"
+)
+
+// DefaultTimeLayout time列的默认格式
+const DefaultTimeLayout = "2006-01-02 15:04:05"
+
+// Column csv的一列
+type Column struct {
+	Name      string `toml:"name" json:"name"`
+	Index     int    `toml:"index" json:"index"`                     // 从0开始
+	Type      string `toml:"type" json:"type"`                       // string(default), int, float, time
+	Layout    string `toml:"layout" json:"layout,omitempty"`         // time列的格式，default "2006-01-02 15:04:05"
+	URLDecode bool   `toml:"url_decode" json:"url_decode,omitempty"` // 先做URL解码
+	Required  bool   `toml:"required" json:"required,omitempty"`     // 列数不足时解码失败
+}
+
+func validateColumns(cols []*Column) error {
+	names := map[string]bool{}
+	for _, col := range cols {
+		if len(col.Name) == 0 {
+			return fmt.Errorf("column %d: name is empty", col.Index)
+		}
+		if names[col.Name] {
+			return fmt.Errorf("column %s is duplicated", col.Name)
+		}
+		names[col.Name] = true
+		if col.Index < 0 {
+			return fmt.Errorf("column %s: index %d is invalid", col.Name, col.Index)
+		}
+		switch col.Type {
+		case "":
+			col.Type = ColumnString
+		case ColumnString, ColumnInt, ColumnFloat:
+		case ColumnTime:
+			if len(col.Layout) == 0 {
+				col.Layout = DefaultTimeLayout
+			}
+		default:
+			return fmt.Errorf("column %s: type %q is invalid, must be one of string, int, float, time", col.Name, col.Type)
+		}
+	}
+	return nil
+}
+
+// csvDecoder 按分隔符切分，不做引号转义
+// 列数不足时缺少的字段不存在，required的列缺少时解码失败；非string列为空时字段不存在
+type csvDecoder struct {
+	columns   []*Column
+	delimiter string
+	location  *time.Location // time列的时区
+	n         int            // 需要切分出的列数
+}
+
+func newCSVDecoder(c *Config) *csvDecoder {
+	d := &csvDecoder{columns: c.Fields, delimiter: c.Delimiter, location: c.location}
+	if len(d.columns) == 0 {
+		for i, name := range c.Columns {
+			if len(name) == 0 || name == "-" {
+				continue
+			}
+			d.columns = append(d.columns, &Column{Name: name, Index: i, Type: ColumnString})
+		}
+	}
+	for _, col := range d.columns {
+		if col.Index+1 > d.n {
+			d.n = col.Index + 1
+		}
+	}
+	return d
+}
+
+func (d *csvDecoder) Decode(msg []byte) (Record, error) {
+	fields := strings.SplitN(string(msg), d.delimiter, d.n+1)
+	r := make(Record, len(d.columns))
+	for _, col := range d.columns {
+		if col.Index >= len(fields) {
+			if col.Required {
+				return nil, fmt.Errorf("column %d (%s) is missing, got %d columns", col.Index, col.Name, len(fields))
+			}
+			continue
+		}
+		v, err := col.value(fields[col.Index], d.location)
+		if err != nil {
+			return nil, fmt.Errorf("column %d (%s): %s", col.Index, col.Name, err)
+		}
+		if v != nil {
+			r[col.Name] = v
+		}
+	}
+	return r, nil
+}
+
+func (col *Column) value(s string, loc *time.Location) (interface{}, error) {
+	if col.URLDecode {
+		u, err := url.QueryUnescape(s)
+		if err != nil {
+			return nil, err
+		}
+		s = u
+	}
+	if col.Type == ColumnString {
+		return s, nil
+	}
+	if len(s) == 0 {
+		return nil, nil
+	}
+	switch col.Type {
+	case ColumnInt:
+		return strconv.ParseInt(s, 10, 64)
+	case ColumnFloat:
+		return strconv.ParseFloat(s, 64)
+	case ColumnTime:
+		return time.ParseInLocation(col.Layout, s, loc)
+	}
+	return s, nil
+}
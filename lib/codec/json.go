@@ -0,0 +1,23 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// JSONDecoder 解码JSON对象，数字保留为json.Number
+type JSONDecoder struct{}
+
+func (JSONDecoder) Decode(msg []byte) (Record, error) {
+	d := json.NewDecoder(bytes.NewReader(msg))
+	d.UseNumber()
+	var r Record
+	if err := d.Decode(&r); err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("message is not a JSON object")
+	}
+	return r, nil
+}
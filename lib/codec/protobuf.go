@@ -0,0 +1,110 @@
+package codec
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufDecoder 按descriptor set中的message解码
+// 字段名为proto中的字段名，未设置的字段为默认值，enum为名字，bytes为string
+type protobufDecoder struct {
+	desc protoreflect.MessageDescriptor
+}
+
+func newProtobufDecoder(fname string, message string) (*protobufDecoder, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, fmt.Errorf("protobuf descriptor %s: %s", fname, err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("protobuf descriptor %s: %s", fname, err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("protobuf descriptor %s: message %s: %s", fname, message, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("protobuf descriptor %s: %s is not a message", fname, message)
+	}
+	return &protobufDecoder{desc: md}, nil
+}
+
+func (d *protobufDecoder) Decode(msg []byte) (Record, error) {
+	m := dynamicpb.NewMessage(d.desc)
+	if err := proto.Unmarshal(msg, m); err != nil {
+		return nil, err
+	}
+	return protoRecord(m), nil
+}
+
+func protoRecord(m protoreflect.Message) Record {
+	fields := m.Descriptor().Fields()
+	r := make(Record, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		// oneof中未设置的字段与未设置的message字段不存在
+		if (fd.ContainingOneof() != nil || fd.Message() != nil) && !fd.IsList() && !fd.IsMap() && !m.Has(fd) {
+			continue
+		}
+		r[string(fd.Name())] = protoField(fd, m.Get(fd))
+	}
+	return r
+}
+
+func protoField(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		l := v.List()
+		s := make([]interface{}, l.Len())
+		for i := range s {
+			s[i] = protoValue(fd, l.Get(i))
+		}
+		return s
+	case fd.IsMap():
+		m := map[string]interface{}{}
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			m[k.String()] = protoValue(fd.MapValue(), v)
+			return true
+		})
+		return m
+	}
+	return protoValue(fd, v)
+}
+
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return v.Uint()
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return string(v.Bytes())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int64(v.Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return map[string]interface{}(protoRecord(v.Message()))
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// Package expr 用于消息过滤与字段映射的表达式
+//
+//	event == 2 && follow > 500 && !(state in [5..11, 16, 17])
+//	src_uid + ":" + src_mid
+//
+// 值的类型: null, bool, number(float64), string, list, object(JSON对象)
+// 运算符按优先级从低到高: ||  &&  == != < <= > >= in  + -  * / %  ! -(一元)
+// 字段取自Env，a.b.c 取嵌套JSON对象中的字段，不存在时为null
+// 函数: len(x) exists(x) lower(s) upper(s) contains(s, sub) str(x) num(x)
+//
+// Compile在加载配置时检查语法、函数与常量表达式，编译后的Program可被多个goroutine同时使用
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Env 表达式中字段的取值，数字需为float64或整数类型
+type Env interface {
+	Get(name string) (interface{}, bool)
+}
+
+// MapEnv 解码后的JSON对象
+type MapEnv map[string]interface{}
+
+func (m MapEnv) Get(name string) (interface{}, bool) {
+	v, ok := m[name]
+	return v, ok
+}
+
+// Error 编译或求值错误，Pos为出错处在源码中的字节偏移
+type Error struct {
+	Src string
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("expr %q: col %d: %s", e.Src, e.Pos+1, e.Msg)
+}
+
+// Program 编译后的表达式
+type Program struct {
+	src    string
+	fields []string
+	eval   evalFunc
+}
+
+// Compile 编译表达式
+func Compile(src string) (*Program, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	if tokens[0].kind == tokEOF {
+		return nil, &Error{Src: src, Pos: 0, Msg: "empty expression"}
+	}
+	p := &parser{src: src, tokens: tokens, fields: map[string]bool{}}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+	eval, err := n.compile(&compiler{src: src})
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{}
+	for f := range p.fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return &Program{src: src, fields: fields, eval: eval}, nil
+}
+
+// MustCompile 编译失败时panic，用于常量表达式
+func MustCompile(src string) *Program {
+	p, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p *Program) String() string {
+	return p.src
+}
+
+// Fields 表达式引用的字段，用于加载配置时检查字段名
+func (p *Program) Fields() []string {
+	return p.fields
+}
+
+// Eval 求值，env为nil时所有字段为null
+func (p *Program) Eval(env Env) (interface{}, error) {
+	return p.eval(env)
+}
+
+// EvalBool 求值，结果需为bool
+func (p *Program) EvalBool(env Env) (bool, error) {
+	v, err := p.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, &Error{Src: p.src, Pos: 0, Msg: fmt.Sprintf("result is %s, not bool", typeName(v))}
+	}
+	return b, nil
+}
+
+// normalize 将Env返回的整数、json.Number转为float64，time.Time转为Unix秒
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int8:
+		return float64(x)
+	case int16:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case uint:
+		return float64(x)
+	case uint8:
+		return float64(x)
+	case uint16:
+		return float64(x)
+	case uint32:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	case json.Number:
+		if f, err := x.Float64(); err == nil {
+			return f
+		}
+		return x.String()
+	case []byte:
+		return string(x)
+	case time.Time:
+		return float64(x.Unix())
+	}
+	return v
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+type function struct {
+	arity int
+	call  func(args []interface{}) (interface{}, error)
+}
+
+func stringArg(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expects string, got %s", typeName(v))
+	}
+	return s, nil
+}
+
+var funcs = map[string]function{
+	// len 字符串的字符数，list/object的元素数，null为0
+	"len": {1, func(args []interface{}) (interface{}, error) {
+		switch x := args[0].(type) {
+		case nil:
+			return float64(0), nil
+		case string:
+			return float64(utf8.RuneCountInString(x)), nil
+		case []interface{}:
+			return float64(len(x)), nil
+		case map[string]interface{}:
+			return float64(len(x)), nil
+		}
+		return nil, fmt.Errorf("expects string, list or object, got %s", typeName(args[0]))
+	}},
+	"exists": {1, func(args []interface{}) (interface{}, error) {
+		return args[0] != nil, nil
+	}},
+	"lower": {1, func(args []interface{}) (interface{}, error) {
+		s, err := stringArg(args[0])
+		return strings.ToLower(s), err
+	}},
+	"upper": {1, func(args []interface{}) (interface{}, error) {
+		s, err := stringArg(args[0])
+		return strings.ToUpper(s), err
+	}},
+	"contains": {2, func(args []interface{}) (interface{}, error) {
+		s, err := stringArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		sub, err := stringArg(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return strings.Contains(s, sub), nil
+	}},
+	// str 转为字符串，整数不带小数点
+	"str": {1, func(args []interface{}) (interface{}, error) {
+		switch x := args[0].(type) {
+		case nil:
+			return "", nil
+		case string:
+			return x, nil
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(x), nil
+		}
+		b, err := json.Marshal(args[0])
+		return string(b), err
+	}},
+	"num": {1, func(args []interface{}) (interface{}, error) {
+		switch x := args[0].(type) {
+		case float64:
+			return x, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", x)
+			}
+			return f, nil
+		case bool:
+			if x {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("expects string or number, got %s", typeName(args[0]))
+	}},
+}
@@ -0,0 +1,157 @@
+package expr
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testEnv(t testing.TB) MapEnv {
+	var m map[string]interface{}
+	data := `{"event":2,"state":7,"follow":800,"uid":"u1","mid":"m1","src_mid":"s1",
+		"user":{"name":"Bob","tags":["a","b"]},"score":1.5}`
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatal(err)
+	}
+	return MapEnv(m)
+}
+
+func TestEval(t *testing.T) {
+	env := testEnv(t)
+	cases := []struct {
+		src  string
+		want interface{}
+	}{
+		{`event == 2 && follow > 500 && !(state in [5..11])`, false},
+		{`event == 2 && follow > 500 && !(state in [12..20, 3])`, true},
+		{`state in [1, 7, 9]`, true},
+		{`"b" in user.tags`, true},
+		{`"c" in user.tags`, false},
+		{`user.name == "Bob"`, true},
+		{`user.age > 10`, false},
+		{`missing == null`, true},
+		{`exists(missing) || exists(uid)`, true},
+		{`follow / 100 + 1`, float64(9)},
+		{`follow % 300`, float64(200)},
+		{`-score * 2`, float64(-3)},
+		{`uid + ":" + src_mid`, "u1:s1"},
+		{`upper(user.name)`, "BOB"},
+		{`len(user.tags) == 2 && len("汉字") == 2`, true},
+		{`contains(mid, "1")`, true},
+		{`str(follow) + "_" + str(score)`, "800_1.5"},
+		{`num("12") > 11`, true},
+		{`1 + 2 * 3 == 7 && (1 + 2) * 3 == 9`, true},
+		{`false && missing > "x"`, false},
+		{`true || follow / 0 == 0`, true},
+		{`'it\'s' == "it's"`, true},
+		{`[1, 2] == [1, 2]`, true},
+	}
+	for _, c := range cases {
+		p, err := Compile(c.src)
+		if err != nil {
+			t.Errorf("%s: %s", c.src, err)
+			continue
+		}
+		got, err := p.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %s", c.src, err)
+			continue
+		}
+		if !equal(got, c.want) {
+			t.Errorf("%s = %v, want %v", c.src, got, c.want)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	cases := []struct {
+		src string
+		col int
+		msg string
+	}{
+		{``, 1, "empty expression"},
+		{`event == `, 10, "unexpected end of expression"},
+		{`event == 2 &&`, 14, "unexpected end of expression"},
+		{`(event == 2`, 12, `expected ")"`},
+		{`event = 2`, 7, `unexpected character '='`},
+		{`a < b < c`, 7, "cannot be chained"},
+		{`foo(1)`, 1, "unknown function foo"},
+		{`len(1, 2)`, 1, "expects 1 arguments"},
+		{`"abc`, 1, "unterminated string"},
+		{`1 + "a"`, 3, "cannot be applied to number and string"},
+		{`x in [9..1]`, 3, "is empty"},
+		{`[1..2]`, 1, "only allowed on the right side of in"},
+		{`event # 2`, 7, "unexpected character"},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.src)
+		if err == nil {
+			t.Errorf("%q: except error", c.src)
+			continue
+		}
+		e, ok := err.(*Error)
+		if !ok || e.Pos+1 != c.col || !strings.Contains(e.Msg, c.msg) {
+			t.Errorf("%q: %v, except col %d: %s", c.src, err, c.col, c.msg)
+		}
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	env := testEnv(t)
+	for _, src := range []string{`uid > 1`, `follow / (state - 7)`, `!uid`, `uid && true`, `state in uid`} {
+		p, err := Compile(src)
+		if err != nil {
+			t.Fatalf("%s: %s", src, err)
+		}
+		if _, err := p.Eval(env); err == nil {
+			t.Errorf("%s: except runtime error", src)
+		}
+	}
+	p := MustCompile(`follow`)
+	if _, err := p.EvalBool(env); err == nil {
+		t.Error("EvalBool on number should fail")
+	}
+}
+
+func TestFields(t *testing.T) {
+	p := MustCompile(`event == 2 && user.name != "" && len(uid) > 0 && event > 1`)
+	got := strings.Join(p.Fields(), ",")
+	if got != "event,uid,user.name" {
+		t.Errorf("Fields = %s", got)
+	}
+}
+
+// 编译后的Program可被多个worker同时使用
+func TestConcurrentEval(t *testing.T) {
+	p := MustCompile(`event == 2 && follow > 500 && !(state in [5..11, 16, 17, 20, 25..34])`)
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(state int) {
+			defer wg.Done()
+			env := MapEnv{"event": 2, "follow": 600, "state": state}
+			for j := 0; j < 1000; j++ {
+				ok, err := p.EvalBool(env)
+				want := !((state >= 5 && state <= 11) || state == 16 || state == 17 || state == 20 || (state >= 25 && state <= 34))
+				if err != nil || ok != want {
+					t.Errorf("state %d: %v %v", state, ok, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkEvalBool(b *testing.B) {
+	p := MustCompile(`event == 2 && follow > 500 && !(state in [5..11, 16, 17, 20, 25..34])`)
+	env := MapEnv{"event": float64(2), "follow": float64(800), "state": float64(3)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.EvalBool(env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
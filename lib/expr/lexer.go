@@ -0,0 +1,150 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent // 字段，可以是a.b.c
+	tokOp    // 运算符与分隔符
+)
+
+type token struct {
+	kind tokenKind
+	pos  int // 在源码中的字节偏移
+	text string
+	num  float64
+	str  string
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.str)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// 按长度从长到短匹配
+var operators = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "..",
+	"!", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",",
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func lex(src string) ([]token, error) {
+	tokens := []token{}
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case isDigit(c):
+			start := i
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			// 5..11 中的 . 不属于数字
+			if i+1 < len(src) && src[i] == '.' && isDigit(src[i+1]) {
+				i++
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			n, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, &Error{Src: src, Pos: start, Msg: fmt.Sprintf("invalid number %q", src[start:i])}
+			}
+			tokens = append(tokens, token{kind: tokNumber, pos: start, text: src[start:i], num: n})
+
+		case isLetter(c):
+			start := i
+			for i < len(src) {
+				if isLetter(src[i]) || isDigit(src[i]) {
+					i++
+					continue
+				}
+				if src[i] == '.' && i+1 < len(src) && isLetter(src[i+1]) {
+					i++
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, token{kind: tokIdent, pos: start, text: src[start:i]})
+
+		case c == '"' || c == '\'':
+			start := i
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, &Error{Src: src, Pos: start, Msg: err.Error()}
+			}
+			i += n
+			tokens = append(tokens, token{kind: tokString, pos: start, text: src[start:i], str: s})
+
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &Error{Src: src, Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, token{kind: tokOp, pos: i, text: op})
+			i += len(op)
+		}
+	}
+	tokens = append(tokens, token{kind: tokEOF, pos: len(src)})
+	return tokens, nil
+}
+
+// lexString 解析以单引号或双引号包围的字符串，支持 \\ \" \' \n \t 转义，返回值与消耗的字节数
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '\'':
+				b.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
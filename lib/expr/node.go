@@ -0,0 +1,584 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type evalFunc func(env Env) (interface{}, error)
+
+type compiler struct {
+	src string
+}
+
+func (c *compiler) errorf(pos int, format string, args ...interface{}) error {
+	return &Error{Src: c.src, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// node 语法树节点，compile时子节点全为常量的节点直接求值
+type node interface {
+	compile(c *compiler) (evalFunc, error)
+	isConst() bool // 不引用字段，值在编译期确定
+}
+
+func allConst(nodes ...node) bool {
+	for _, n := range nodes {
+		if !n.isConst() {
+			return false
+		}
+	}
+	return true
+}
+
+// fold 子节点全为常量时在编译期求值，常量表达式中的类型错误在编译期报出
+func fold(f evalFunc, children ...node) (evalFunc, error) {
+	if !allConst(children...) {
+		return f, nil
+	}
+	v, err := f(nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(Env) (interface{}, error) { return v, nil }, nil
+}
+
+type constNode struct {
+	value interface{}
+}
+
+func (n *constNode) isConst() bool { return true }
+
+func (n *constNode) compile(c *compiler) (evalFunc, error) {
+	v := n.value
+	return func(Env) (interface{}, error) { return v, nil }, nil
+}
+
+// fieldNode 字段，a.b.c 依次取JSON对象中的字段，不存在时为null
+type fieldNode struct {
+	path []string
+}
+
+func newFieldNode(name string) *fieldNode {
+	return &fieldNode{path: strings.Split(name, ".")}
+}
+
+func (n *fieldNode) isConst() bool { return false }
+
+func (n *fieldNode) compile(c *compiler) (evalFunc, error) {
+	path := n.path
+	return func(env Env) (interface{}, error) {
+		if env == nil {
+			return nil, nil
+		}
+		v, ok := env.Get(path[0])
+		if !ok {
+			return nil, nil
+		}
+		for _, name := range path[1:] {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, nil
+			}
+			v = m[name]
+		}
+		return normalize(v), nil
+	}, nil
+}
+
+type unaryNode struct {
+	pos     int
+	op      string
+	operand node
+}
+
+func (n *unaryNode) isConst() bool { return n.operand.isConst() }
+
+func (n *unaryNode) compile(c *compiler) (evalFunc, error) {
+	operand, err := n.operand.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	var f evalFunc
+	if n.op == "!" {
+		f = func(env Env) (interface{}, error) {
+			v, err := operand(env)
+			if err != nil {
+				return nil, err
+			}
+			b, ok := v.(bool)
+			if !ok {
+				return nil, c.errorf(n.pos, "operator ! expects bool, got %s", typeName(v))
+			}
+			return !b, nil
+		}
+	} else {
+		f = func(env Env) (interface{}, error) {
+			v, err := operand(env)
+			if err != nil {
+				return nil, err
+			}
+			x, ok := v.(float64)
+			if !ok {
+				return nil, c.errorf(n.pos, "operator - expects number, got %s", typeName(v))
+			}
+			return -x, nil
+		}
+	}
+	return fold(f, n.operand)
+}
+
+type logicalNode struct {
+	pos         int
+	op          string
+	left, right node
+}
+
+func (n *logicalNode) isConst() bool { return allConst(n.left, n.right) }
+
+func (n *logicalNode) compile(c *compiler) (evalFunc, error) {
+	left, err := n.left.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	and := n.op == "&&"
+	operand := func(f evalFunc, env Env) (bool, error) {
+		v, err := f(env)
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, c.errorf(n.pos, "operator %s expects bool, got %s", n.op, typeName(v))
+		}
+		return b, nil
+	}
+	f := func(env Env) (interface{}, error) {
+		l, err := operand(left, env)
+		if err != nil {
+			return nil, err
+		}
+		if l != and {
+			// true || x, false && x
+			return l, nil
+		}
+		return operand(right, env)
+	}
+	return fold(f, n.left, n.right)
+}
+
+// compareNode == != < <= > >=
+// ==和!=可用于任意类型，类型不同时不相等；大小比较只用于数字或字符串，任一边为null时结果为false
+type compareNode struct {
+	pos         int
+	op          string
+	left, right node
+}
+
+func (n *compareNode) isConst() bool { return allConst(n.left, n.right) }
+
+func (n *compareNode) compile(c *compiler) (evalFunc, error) {
+	left, err := n.left.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	op := n.op
+	f := func(env Env) (interface{}, error) {
+		l, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(env)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "==":
+			return equal(l, r), nil
+		case "!=":
+			return !equal(l, r), nil
+		}
+		if l == nil || r == nil {
+			return false, nil
+		}
+		cmp, ok := compareValues(l, r)
+		if !ok {
+			return nil, c.errorf(n.pos, "cannot compare %s %s %s", typeName(l), op, typeName(r))
+		}
+		switch op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		}
+		return cmp >= 0, nil
+	}
+	return fold(f, n.left, n.right)
+}
+
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case float64:
+		y, ok := b.(float64)
+		return ok && x == y
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+// arithNode + - * / %，+ 也用于拼接字符串
+type arithNode struct {
+	pos         int
+	op          string
+	left, right node
+}
+
+func (n *arithNode) isConst() bool { return allConst(n.left, n.right) }
+
+func (n *arithNode) compile(c *compiler) (evalFunc, error) {
+	left, err := n.left.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	op := n.op
+	f := func(env Env) (interface{}, error) {
+		l, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(env)
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			if ls, ok := l.(string); ok {
+				if rs, ok := r.(string); ok {
+					return ls + rs, nil
+				}
+			}
+		}
+		x, ok1 := l.(float64)
+		y, ok2 := r.(float64)
+		if !ok1 || !ok2 {
+			return nil, c.errorf(n.pos, "operator %s cannot be applied to %s and %s", op, typeName(l), typeName(r))
+		}
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/":
+			if y == 0 {
+				return nil, c.errorf(n.pos, "division by zero")
+			}
+			return x / y, nil
+		}
+		if y == 0 {
+			return nil, c.errorf(n.pos, "division by zero")
+		}
+		return math.Mod(x, y), nil
+	}
+	return fold(f, n.left, n.right)
+}
+
+// listNode [a, b, lo..hi]，区间只能出现在in的右边
+type listNode struct {
+	pos    int
+	items  []node
+	ranges [][2]node
+}
+
+func (n *listNode) isConst() bool {
+	for _, rg := range n.ranges {
+		if !allConst(rg[0], rg[1]) {
+			return false
+		}
+	}
+	return allConst(n.items...)
+}
+
+func (n *listNode) compile(c *compiler) (evalFunc, error) {
+	if len(n.ranges) > 0 {
+		return nil, c.errorf(n.pos, "range a..b is only allowed on the right side of in")
+	}
+	items := make([]evalFunc, len(n.items))
+	for i, item := range n.items {
+		f, err := item.compile(c)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = f
+	}
+	f := func(env Env) (interface{}, error) {
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			v, err := item(env)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	}
+	return fold(f, n.items...)
+}
+
+// inNode x in [..]，x in list字段
+// 右边为常量列表时编译为集合与区间
+type inNode struct {
+	pos         int
+	left, right node
+}
+
+type numRange struct {
+	lo, hi float64
+}
+
+func (n *inNode) isConst() bool { return allConst(n.left, n.right) }
+
+func (n *inNode) compile(c *compiler) (evalFunc, error) {
+	left, err := n.left.compile(c)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := n.right.(*listNode)
+	if !ok {
+		right, err := n.right.compile(c)
+		if err != nil {
+			return nil, err
+		}
+		f := func(env Env) (interface{}, error) {
+			v, err := left(env)
+			if err != nil {
+				return nil, err
+			}
+			r, err := right(env)
+			if err != nil {
+				return nil, err
+			}
+			switch items := r.(type) {
+			case nil:
+				return false, nil
+			case []interface{}:
+				for _, item := range items {
+					if equal(v, item) {
+						return true, nil
+					}
+				}
+				return false, nil
+			}
+			return nil, c.errorf(n.pos, "operator in expects list, got %s", typeName(r))
+		}
+		return fold(f, n.left, n.right)
+	}
+
+	items := make([]evalFunc, len(list.items))
+	for i, item := range list.items {
+		if items[i], err = item.compile(c); err != nil {
+			return nil, err
+		}
+	}
+	ranges := make([][2]evalFunc, len(list.ranges))
+	for i, rg := range list.ranges {
+		if ranges[i][0], err = rg[0].compile(c); err != nil {
+			return nil, err
+		}
+		if ranges[i][1], err = rg[1].compile(c); err != nil {
+			return nil, err
+		}
+	}
+	evalRange := func(env Env, rg [2]evalFunc) (numRange, error) {
+		lo, err := rg[0](env)
+		if err != nil {
+			return numRange{}, err
+		}
+		hi, err := rg[1](env)
+		if err != nil {
+			return numRange{}, err
+		}
+		x, ok1 := lo.(float64)
+		y, ok2 := hi.(float64)
+		if !ok1 || !ok2 {
+			return numRange{}, c.errorf(n.pos, "range expects numbers, got %s..%s", typeName(lo), typeName(hi))
+		}
+		return numRange{x, y}, nil
+	}
+
+	if list.isConst() {
+		nums := map[float64]bool{}
+		strs := map[string]bool{}
+		others := []interface{}{}
+		for _, item := range items {
+			v, _ := item(nil)
+			switch x := v.(type) {
+			case float64:
+				nums[x] = true
+			case string:
+				strs[x] = true
+			default:
+				others = append(others, x)
+			}
+		}
+		numRanges := []numRange{}
+		for _, rg := range ranges {
+			r, err := evalRange(nil, rg)
+			if err != nil {
+				return nil, err
+			}
+			if r.lo > r.hi {
+				return nil, c.errorf(n.pos, "range %v..%v is empty", r.lo, r.hi)
+			}
+			numRanges = append(numRanges, r)
+		}
+		f := func(env Env) (interface{}, error) {
+			v, err := left(env)
+			if err != nil {
+				return nil, err
+			}
+			switch x := v.(type) {
+			case float64:
+				if nums[x] {
+					return true, nil
+				}
+				for _, r := range numRanges {
+					if x >= r.lo && x <= r.hi {
+						return true, nil
+					}
+				}
+				return false, nil
+			case string:
+				return strs[x], nil
+			}
+			for _, o := range others {
+				if equal(v, o) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return fold(f, n.left)
+	}
+
+	f := func(env Env) (interface{}, error) {
+		v, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			x, err := item(env)
+			if err != nil {
+				return nil, err
+			}
+			if equal(v, x) {
+				return true, nil
+			}
+		}
+		x, isNum := v.(float64)
+		for _, rg := range ranges {
+			r, err := evalRange(env, rg)
+			if err != nil {
+				return nil, err
+			}
+			if isNum && x >= r.lo && x <= r.hi {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return f, nil
+}
+
+type callNode struct {
+	pos  int
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []node
+}
+
+func (n *callNode) isConst() bool { return allConst(n.args...) }
+
+func (n *callNode) compile(c *compiler) (evalFunc, error) {
+	args := make([]evalFunc, len(n.args))
+	for i, arg := range n.args {
+		f, err := arg.compile(c)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = f
+	}
+	fn := n.fn
+	f := func(env Env) (interface{}, error) {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			v, err := arg(env)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		v, err := fn(values)
+		if err != nil {
+			return nil, c.errorf(n.pos, "%s: %s", n.name, err)
+		}
+		return v, nil
+	}
+	return fold(f, n.args...)
+}
@@ -0,0 +1,263 @@
+package expr
+
+import (
+	"fmt"
+)
+
+// 优先级从低到高: || && 比较/in +- */% 一元!-
+type parser struct {
+	src    string
+	tokens []token
+	i      int
+	fields map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isOp(text string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == text
+}
+
+func (p *parser) isKeyword(text string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && t.text == text
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &Error{Src: p.src, Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(text string) error {
+	t := p.next()
+	if t.kind != tokOp || t.text != text {
+		return p.errorf(t, "expected %q, found %s", text, t)
+	}
+	return nil
+}
+
+func (p *parser) parseExpr() (node, error) {
+	return p.parseOr()
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		t := p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{pos: t.pos, op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		t := p.next()
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{pos: t.pos, op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+var compareOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// parseCompare 比较不能连写，a < b < c 为语法错误
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parseAdd()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && compareOps[t.text]:
+		p.next()
+		right, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		left = &compareNode{pos: t.pos, op: t.text, left: left, right: right}
+	case p.isKeyword("in"):
+		p.next()
+		right, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		left = &inNode{pos: t.pos, left: left, right: right}
+	default:
+		return left, nil
+	}
+	if n := p.peek(); (n.kind == tokOp && compareOps[n.text]) || p.isKeyword("in") {
+		return nil, p.errorf(n, "comparison %s cannot be chained, use && or parentheses", n)
+	}
+	return left, nil
+}
+
+func (p *parser) parseAdd() (node, error) {
+	left, err := p.parseMul()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		t := p.next()
+		right, err := p.parseMul()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{pos: t.pos, op: t.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseMul() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") || p.isOp("%") {
+		t := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{pos: t.pos, op: t.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") || p.isOp("-") {
+		t := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{pos: t.pos, op: t.text, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &constNode{value: t.num}, nil
+	case tokString:
+		return &constNode{value: t.str}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &constNode{value: true}, nil
+		case "false":
+			return &constNode{value: false}, nil
+		case "null":
+			return &constNode{value: nil}, nil
+		case "in":
+			return nil, p.errorf(t, "unexpected %s", t)
+		}
+		if p.isOp("(") {
+			return p.parseCall(t)
+		}
+		p.fields[t.text] = true
+		return newFieldNode(t.text), nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			return p.parseList(t)
+		}
+	}
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := funcs[name.text]
+	if !ok {
+		return nil, p.errorf(name, "unknown function %s", name.text)
+	}
+	p.next() // (
+	args := []node{}
+	if !p.isOp(")") {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(args) != fn.arity {
+		return nil, p.errorf(name, "function %s expects %d arguments, got %d", name.text, fn.arity, len(args))
+	}
+	return &callNode{pos: name.pos, name: name.text, fn: fn.call, args: args}, nil
+}
+
+// parseList [1, 2, 5..11, "a"]，a..b 为闭区间，只能用于数字
+func (p *parser) parseList(open token) (node, error) {
+	list := &listNode{pos: open.pos}
+	if p.isOp("]") {
+		p.next()
+		return list, nil
+	}
+	for {
+		item, err := p.parseAdd()
+		if err != nil {
+			return nil, err
+		}
+		if p.isOp("..") {
+			p.next()
+			hi, err := p.parseAdd()
+			if err != nil {
+				return nil, err
+			}
+			list.ranges = append(list.ranges, [2]node{item, hi})
+		} else {
+			list.items = append(list.items, item)
+		}
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,68 @@
+package graphite
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend Graphite之外的指标输出，如Prometheus
+// 包级函数Add、Set、MonitorChan等同时写入Graphite与所有Backend，Graphite未启用时Backend仍接收指标
+type Backend interface {
+	Add(key string, value int64)
+	Set(key string, value int64)
+	Timing(key string, d time.Duration)
+	MonitorChan(key string, channeler Channeler)
+}
+
+var (
+	backendsMu sync.Mutex
+	backends   atomic.Value // []Backend，写时复制
+)
+
+// AddBackend 注册Backend，之后的指标同时写入b
+func AddBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	old := loadBackends()
+	bs := make([]Backend, len(old), len(old)+1)
+	copy(bs, old)
+	backends.Store(append(bs, b))
+}
+
+// RemoveBackend 取消注册b
+func RemoveBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	old := loadBackends()
+	bs := make([]Backend, 0, len(old))
+	for _, o := range old {
+		if o != b {
+			bs = append(bs, o)
+		}
+	}
+	backends.Store(bs)
+}
+
+func loadBackends() []Backend {
+	bs, _ := backends.Load().([]Backend)
+	return bs
+}
+
+func backendAdd(key string, value int64) {
+	for _, b := range loadBackends() {
+		b.Add(key, value)
+	}
+}
+
+func backendSet(key string, value int64) {
+	for _, b := range loadBackends() {
+		b.Set(key, value)
+	}
+}
+
+func backendTiming(key string, d time.Duration) {
+	for _, b := range loadBackends() {
+		b.Timing(key, d)
+	}
+}
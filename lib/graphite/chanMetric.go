@@ -23,7 +23,7 @@ func (cm *chanMetrics) Monitor(key string, channeler Channeler) {
 	if global.cfg.Disable {
 		return
 	}
-	global.logger.Debugf("monitor chan %s value %d", key)
+	global.logger.Debugf("monitor chan %s", key)
 	cm.Lock()
 	cm.m[key] = channeler
 	cm.Unlock()
@@ -0,0 +1,259 @@
+package graphite
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 指标的输出格式，Config.Format
+const (
+	FormatCarbon = "carbon" // Graphite plaintext，tcp
+	FormatStatsd = "statsd" // StatsD，udp，tag使用DogStatsD扩展 |#k:v
+	FormatInflux = "influx" // InfluxDB line protocol，udp或http
+)
+
+// 发送指标的协议，Config.Protocol
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolHTTP = "http"
+)
+
+// Rule 将${node_names}.${metric}中的段映射为tag，仅statsd与influx格式有效
+//
+//	Rule{Pattern: "{topic}.consume.qps", Name: "kafka.consume.qps"}
+//
+// Pattern中的{tag}匹配一段并作为tag的值，Tags为固定的tag；没有匹配的Rule时使用原名
+type Rule struct {
+	Pattern string            `toml:"pattern" json:"pattern"` // .分隔，{tag}匹配一段
+	Name    string            `toml:"name" json:"name"`
+	Tags    map[string]string `toml:"tags" json:"tags"`
+}
+
+const (
+	pointCounter = iota // Add写入的值，本周期的累加值
+	pointGauge          // Set写入的值
+	pointMean           // xxx.time，已除以xxx.qps
+	pointTiming         // Timing写入的耗时
+	pointChan           // MonitorChan的chan长度和容量
+)
+
+// point 一个周期内的一个指标
+type point struct {
+	key      string // ${node_names}.${metric}
+	kind     int
+	value    int64
+	mean     float64
+	sketch   *Sketch
+	length   int
+	capacity int
+}
+
+// tag 一个tag，按名排序后输出
+type tag struct {
+	key, value string
+}
+
+// encoder 将一个周期的指标编码为行，每行以\n结尾
+type encoder struct {
+	format       string
+	prefix       string // carbon为Config.Prefix.${ip}.，其余为Config.Prefix.
+	host         string // statsd与influx的host tag，本机IP
+	rules        []Rule
+	patterns     [][]string
+	ts           int64   // 本周期的时间，秒
+	flushSeconds float64 // 刷新间隔，秒
+}
+
+func newEncoder(cfg *Config, ip string) *encoder {
+	e := &encoder{format: cfg.Format, rules: cfg.Rules, host: ip}
+	if len(e.format) == 0 {
+		e.format = FormatCarbon
+	}
+	if len(cfg.Prefix) != 0 {
+		e.prefix = cfg.Prefix + "."
+		if e.format == FormatCarbon {
+			e.prefix += strings.Replace(ip, ".", "_", -1) + "."
+		}
+	}
+	for _, r := range cfg.Rules {
+		e.patterns = append(e.patterns, strings.Split(r.Pattern, "."))
+	}
+	return e
+}
+
+// encode 按格式编码p
+func (e *encoder) encode(p *point) []string {
+	switch e.format {
+	case FormatStatsd:
+		return e.statsd(p)
+	case FormatInflux:
+		return e.influx(p)
+	}
+	return e.carbon(p)
+}
+
+// name 按rules转换指标名，返回名称与按名排序的tag
+func (e *encoder) name(key string) (string, []tag) {
+	name, tags := key, map[string]string{}
+	parts := strings.Split(key, ".")
+	for i, pattern := range e.patterns {
+		if m, ok := matchRule(pattern, parts); ok {
+			name, tags = e.rules[i].Name, m
+			for k, v := range e.rules[i].Tags {
+				tags[k] = v
+			}
+			break
+		}
+	}
+	if _, ok := tags["host"]; !ok && len(e.host) > 0 {
+		tags["host"] = e.host
+	}
+	sorted := make([]tag, 0, len(tags))
+	for k, v := range tags {
+		sorted = append(sorted, tag{k, v})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+	return e.prefix + name, sorted
+}
+
+func matchRule(pattern, parts []string) (map[string]string, bool) {
+	if len(pattern) != len(parts) {
+		return nil, false
+	}
+	tags := map[string]string{}
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			tags[p[1:len(p)-1]] = parts[i]
+		} else if p != parts[i] {
+			return nil, false
+		}
+	}
+	return tags, true
+}
+
+func ms(ns float64) float64 {
+	return ns / float64(time.Millisecond)
+}
+
+// carbon ${prefix}${key} value timestamp，不支持tag，与之前的输出一致
+func (e *encoder) carbon(p *point) []string {
+	name := e.prefix + p.key
+	switch p.kind {
+	case pointMean:
+		return []string{fmt.Sprintf("%s %0.2f %d\n", name, p.mean/e.flushSeconds, e.ts)}
+	case pointTiming:
+		s := p.sketch
+		lines := make([]string, 0, len(timingQuantiles)+2)
+		for _, q := range timingQuantiles {
+			lines = append(lines, fmt.Sprintf("%s.%s %0.3f %d\n", name, q.name, ms(s.Quantile(q.q)), e.ts))
+		}
+		return append(lines,
+			fmt.Sprintf("%s.max %0.3f %d\n", name, ms(s.Max()), e.ts),
+			fmt.Sprintf("%s.count %d %d\n", name, s.Count(), e.ts))
+	case pointChan:
+		return []string{
+			fmt.Sprintf("%s.length %d %d\n", name, p.length, e.ts),
+			fmt.Sprintf("%s.capacity %d %d\n", name, p.capacity, e.ts),
+		}
+	}
+	return []string{
+		fmt.Sprintf("%s_count %d %d\n", name, p.value, e.ts),
+		fmt.Sprintf("%s %0.2f %d\n", name, float64(p.value)/e.flushSeconds, e.ts),
+	}
+}
+
+// statsd name:value|type|#k:v,...，不带时间戳，由StatsD按接收时间聚合
+// counter为本周期的累加值(|c)，其余为gauge(|g)，耗时的分位数单位毫秒
+func (e *encoder) statsd(p *point) []string {
+	name, tags := e.name(p.key)
+	suffix := "\n"
+	if len(tags) > 0 {
+		var b strings.Builder
+		b.WriteString("|#")
+		for i, t := range tags {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(statsdEscaper.Replace(t.key))
+			b.WriteByte(':')
+			b.WriteString(statsdEscaper.Replace(t.value))
+		}
+		suffix = b.String() + "\n"
+	}
+	name = statsdEscaper.Replace(name)
+	gauge := func(name, value string) []string {
+		// 以+/-开头的gauge为增量，负值需先置0
+		if strings.HasPrefix(value, "-") {
+			return []string{name + ":0|g" + suffix, name + ":" + value + "|g" + suffix}
+		}
+		return []string{name + ":" + value + "|g" + suffix}
+	}
+	switch p.kind {
+	case pointCounter:
+		return []string{name + ":" + strconv.FormatInt(p.value, 10) + "|c" + suffix}
+	case pointGauge:
+		return gauge(name, strconv.FormatInt(p.value, 10))
+	case pointMean:
+		return gauge(name, formatFloat(p.mean/e.flushSeconds))
+	case pointTiming:
+		s := p.sketch
+		var lines []string
+		for _, q := range timingQuantiles {
+			lines = append(lines, gauge(name+"."+q.name, formatFloat(ms(s.Quantile(q.q))))...)
+		}
+		lines = append(lines, gauge(name+".max", formatFloat(ms(s.Max())))...)
+		return append(lines, name+".count:"+strconv.FormatUint(s.Count(), 10)+"|c"+suffix)
+	case pointChan:
+		return append(gauge(name+".length", strconv.Itoa(p.length)), gauge(name+".capacity", strconv.Itoa(p.capacity))...)
+	}
+	return nil
+}
+
+// statsd的指标名与tag不能包含 : | # , 和换行
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "#", "_", ",", "_", "\n", "_")
+
+// influx measurement,k=v,... field=value,... timestamp(纳秒)
+// counter的field为count与rate(每秒)，gauge为value，耗时为p50/p90/p99/max(毫秒)与count，chan为length与capacity
+func (e *encoder) influx(p *point) []string {
+	name, tags := e.name(p.key)
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(name))
+	for _, t := range tags {
+		b.WriteByte(',')
+		b.WriteString(tagEscaper.Replace(t.key))
+		b.WriteByte('=')
+		b.WriteString(tagEscaper.Replace(t.value))
+	}
+	b.WriteByte(' ')
+	switch p.kind {
+	case pointCounter:
+		fmt.Fprintf(&b, "count=%di,rate=%s", p.value, formatFloat(float64(p.value)/e.flushSeconds))
+	case pointGauge:
+		fmt.Fprintf(&b, "value=%di", p.value)
+	case pointMean:
+		fmt.Fprintf(&b, "value=%s", formatFloat(p.mean/e.flushSeconds))
+	case pointTiming:
+		s := p.sketch
+		for _, q := range timingQuantiles {
+			fmt.Fprintf(&b, "%s=%s,", q.name, formatFloat(ms(s.Quantile(q.q))))
+		}
+		fmt.Fprintf(&b, "max=%s,count=%di", formatFloat(ms(s.Max())), s.Count())
+	case pointChan:
+		fmt.Fprintf(&b, "length=%di,capacity=%di", p.length, p.capacity)
+	}
+	fmt.Fprintf(&b, " %d\n", e.ts*int64(time.Second))
+	return []string{b.String()}
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", "_")
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "_")
+)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
@@ -0,0 +1,195 @@
+package graphite
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"process_data/lib/logging"
+	ltime "process_data/lib/time"
+)
+
+var testRules = []Rule{
+	{Pattern: "{topic}.consume.qps", Name: "kafka.consume"},
+	{Pattern: "msg.succ", Name: "msg", Tags: map[string]string{"result": "succ"}},
+}
+
+func testEncoder(format string) *encoder {
+	e := newEncoder(&Config{Format: format, Prefix: "pd", Rules: testRules}, "10.0.0.1")
+	e.ts, e.flushSeconds = 1500000000, 10
+	return e
+}
+
+func TestEncode(t *testing.T) {
+	timing := NewSketch()
+	timing.Add(float64(2 * time.Millisecond))
+	points := []*point{
+		{key: "t1.consume.qps", kind: pointCounter, value: 20},
+		{key: "msg.succ", kind: pointCounter, value: 5},
+		{key: "lag", kind: pointGauge, value: -3},
+		{key: "time.redis", kind: pointTiming, sketch: timing},
+		{key: "inchan", kind: pointChan, length: 1, capacity: 10},
+	}
+	tests := map[string][]string{
+		FormatCarbon: {
+			"pd.10_0_0_1.t1.consume.qps_count 20 1500000000",
+			"pd.10_0_0_1.t1.consume.qps 2.00 1500000000",
+			"pd.10_0_0_1.msg.succ_count 5 1500000000",
+			"pd.10_0_0_1.msg.succ 0.50 1500000000",
+			"pd.10_0_0_1.lag_count -3 1500000000",
+			"pd.10_0_0_1.lag -0.30 1500000000",
+			"pd.10_0_0_1.time.redis.p50 2.000 1500000000",
+			"pd.10_0_0_1.time.redis.p90 2.000 1500000000",
+			"pd.10_0_0_1.time.redis.p99 2.000 1500000000",
+			"pd.10_0_0_1.time.redis.max 2.000 1500000000",
+			"pd.10_0_0_1.time.redis.count 1 1500000000",
+			"pd.10_0_0_1.inchan.length 1 1500000000",
+			"pd.10_0_0_1.inchan.capacity 10 1500000000",
+		},
+		FormatStatsd: {
+			"pd.kafka.consume:20|c|#host:10.0.0.1,topic:t1",
+			"pd.msg:5|c|#host:10.0.0.1,result:succ",
+			"pd.lag:0|g|#host:10.0.0.1",
+			"pd.lag:-3|g|#host:10.0.0.1",
+			"pd.time.redis.p50:2.000|g|#host:10.0.0.1",
+			"pd.time.redis.p90:2.000|g|#host:10.0.0.1",
+			"pd.time.redis.p99:2.000|g|#host:10.0.0.1",
+			"pd.time.redis.max:2.000|g|#host:10.0.0.1",
+			"pd.time.redis.count:1|c|#host:10.0.0.1",
+			"pd.inchan.length:1|g|#host:10.0.0.1",
+			"pd.inchan.capacity:10|g|#host:10.0.0.1",
+		},
+		FormatInflux: {
+			"pd.kafka.consume,host=10.0.0.1,topic=t1 count=20i,rate=2.000 1500000000000000000",
+			"pd.msg,host=10.0.0.1,result=succ count=5i,rate=0.500 1500000000000000000",
+			"pd.lag,host=10.0.0.1 value=-3i 1500000000000000000",
+			"pd.time.redis,host=10.0.0.1 p50=2.000,p90=2.000,p99=2.000,max=2.000,count=1i 1500000000000000000",
+			"pd.inchan,host=10.0.0.1 length=1i,capacity=10i 1500000000000000000",
+		},
+	}
+	for format, except := range tests {
+		e := testEncoder(format)
+		var actual []string
+		for _, p := range points {
+			for _, l := range e.encode(p) {
+				actual = append(actual, strings.TrimSuffix(l, "\n"))
+			}
+		}
+		if !reflect.DeepEqual(actual, except) {
+			t.Errorf("%s:\n%s\nexcept:\n%s", format, strings.Join(actual, "\n"), strings.Join(except, "\n"))
+		}
+	}
+}
+
+func TestEncodeEscape(t *testing.T) {
+	p := &point{key: "a b,c.consume.qps", kind: pointCounter, value: 1}
+	if l := testEncoder(FormatInflux).encode(p)[0]; l != `pd.kafka.consume,host=10.0.0.1,topic=a\ b\,c count=1i,rate=0.100 1500000000000000000`+"\n" {
+		t.Errorf("%q", l)
+	}
+	if l := testEncoder(FormatStatsd).encode(p)[0]; l != "pd.kafka.consume:1|c|#host:10.0.0.1,topic:a b_c\n" {
+		t.Errorf("%q", l)
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	for _, c := range []*Config{
+		{Address: "127.0.0.1:2003", Format: "opentsdb"},
+		{Address: "127.0.0.1:2003", Format: FormatCarbon, Protocol: ProtocolUDP},
+		{Address: "127.0.0.1:8125", Format: FormatStatsd, Protocol: ProtocolHTTP},
+		{Address: "127.0.0.1:8086", Format: FormatInflux, Protocol: ProtocolHTTP},
+		{Address: "127.0.0.1:8089", Format: FormatInflux, Rules: []Rule{{Pattern: "{topic}.qps"}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v: except error", c)
+		}
+	}
+	c := &Config{Address: "127.0.0.1:8089", Format: FormatInflux}
+	if err := c.Validate(); err != nil || c.Protocol != ProtocolUDP {
+		t.Errorf("%+v %v", c, err)
+	}
+	c = &Config{Address: "http://127.0.0.1:8086/write?db=pd", Format: FormatInflux, Protocol: ProtocolHTTP}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGraphiteStatsdUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg := &Config{Address: conn.LocalAddr().String(), Format: FormatStatsd, Rules: testRules}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	g := newGraphite(cfg, logging.DefaultLogger())
+	g.AddQPS("t1.consume", 3)
+	g.flush(false)
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(buf[:n]), "kafka.consume:3|c|#host:") {
+		t.Errorf("%q", buf[:n])
+	}
+}
+
+func TestGraphiteInfluxHTTP(t *testing.T) {
+	bodies := make(chan string, 10)
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Query().Get("db") != "pd" || r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("%s %s", r.URL, r.Header)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	cfg := &Config{
+		Address:       ts.URL + "/write?db=pd",
+		Format:        FormatInflux,
+		Protocol:      ProtocolHTTP,
+		Token:         "secret",
+		FlushInterval: ltime.Duration{Duration: time.Second},
+		Rules:         testRules,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	g := newGraphite(cfg, logging.DefaultLogger())
+	g.AddMetric("msg", "succ", 2)
+	g.flush(false)
+	if g.sender.pending() != 1 {
+		t.Fatalf("pending %d", g.sender.pending())
+	}
+
+	// 失败的请求在重试时一起发送
+	fail = false
+	g.Set("lag", 7)
+	g.flush(true)
+	select {
+	case body := <-bodies:
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "msg,host=") || !strings.Contains(lines[0], ",result=succ count=2i,rate=2.000 ") ||
+			!strings.Contains(lines[1], " value=7i ") {
+			t.Errorf("%q", body)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no request")
+	}
+}
@@ -19,16 +19,38 @@ graphite 记录指标按照指定时间间隔发送这些指标到给定的Graph
 
 特别注意 所有指标均会折算成每秒多少
 
+## 发送
+与Graphite保持一个TCP长连接，连接断开或写入失败时按退避时间(1s起翻倍，最大Config.MaxBackoff)重连。
+未发送成功的指标保存在内存中(最多Config.Backlog条，超出时丢弃最早的)，重连后按原时间戳重发，
+部分写入失败时从第一条未完整写入的指标开始重发。statsd不带时间戳，重发会计入重发时的周期，因此发送失败时直接丢弃。
+Stop会停止Start启动的服务，并做最后一次刷新。
+
+## 格式
+Config.Format 选择输出格式，同一组Add、Set、Timing等调用可写入任一种：
+
+	* carbon Graphite plaintext(默认)，tcp，指标名同上
+	* statsd StatsD，udp，不带${ip}，本机IP与Rule匹配的段作为tag(DogStatsD扩展 |#k:v)
+	* influx InfluxDB line protocol，udp或http，measurement为指标名，本机IP与Rule匹配的段作为tag
+
+如 Rule{Pattern: "{topic}.consume.qps", Name: "kafka.consume.qps"}，influx格式下
+test_topic.consume.qps 输出为 ${prefix}.kafka.consume.qps,host=10.75.29.40,topic=test_topic count=10i,rate=0.167
+
+## 耗时
+Timing 记录耗时的分布，每个刷新周期输出 ${node_names}.p50, .p90, .p99, .max (单位毫秒)
+与 .count (本周期的样本数，不折算成每秒)，分位数由Sketch计算，相对误差不超过1%。
+`.time`后缀的指标仍按原规则除以对应的`.qps`，只能得到平均值。
+
 */
 
 package graphite
 
 import (
-	"bufio"
 	"fmt"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"process_data/lib/logging"
@@ -37,7 +59,7 @@ import (
 )
 
 var (
-	global       *Graphite
+	global       *Graphite // 未调用NewWithConfig前，包级函数不记录任何指标
 	once         sync.Once
 	defaultIPStr string = "127_0_0_1"
 )
@@ -49,14 +71,66 @@ type Config struct {
 	Address       string         `toml:"address" json:"address"` // Graphite的写入地址
 	Prefix        string         `toml:"prefix" json:"prefix"`
 	FlushInterval ltime.Duration `toml:"flush_interval" json:"flush_interval"` // 最小单位为time.Second
+	Backlog       int            `toml:"backlog" json:"backlog"`               // 未发送指标的最大条数，default 100000
+	MaxBackoff    ltime.Duration `toml:"max_backoff" json:"max_backoff"`       // 重连的最大间隔，default 1m
+	WriteTimeout  ltime.Duration `toml:"write_timeout" json:"write_timeout"`   // 连接与写入的超时，default 5s
+	Format        string         `toml:"format" json:"format"`                 // carbon(默认), statsd, influx
+	Protocol      string         `toml:"protocol" json:"protocol"`             // carbon为tcp，statsd为udp，influx为udp(默认)或http
+	Token         string         `toml:"token" json:"token"`                   // influx http的Authorization: Token
+	Rules         []Rule         `toml:"rules" json:"rules"`                   // 指标名的段映射为tag，statsd与influx有效
 }
 
 func (c *Config) Validate() error {
 	if c.Disable {
 		return nil
 	}
-	if !lnet.IsValidAddress("tcp", c.Address) {
-		return fmt.Errorf("graphite.address %s is invalid", c.Address)
+	if len(c.Format) == 0 {
+		c.Format = FormatCarbon
+	}
+	protocols := map[string][]string{
+		FormatCarbon: {ProtocolTCP},
+		FormatStatsd: {ProtocolUDP},
+		FormatInflux: {ProtocolUDP, ProtocolHTTP},
+	}
+	allowed, ok := protocols[c.Format]
+	if !ok {
+		return fmt.Errorf("graphite.format %q is invalid, must be one of carbon, statsd, influx", c.Format)
+	}
+	if len(c.Protocol) == 0 {
+		c.Protocol = allowed[0]
+	}
+	valid := false
+	for _, p := range allowed {
+		valid = valid || p == c.Protocol
+	}
+	if !valid {
+		return fmt.Errorf("graphite.protocol %q is not supported by format %s", c.Protocol, c.Format)
+	}
+
+	// 只检查地址格式，启动时Graphite不可用的指标保存在backlog中
+	if c.Protocol == ProtocolHTTP {
+		if u, err := url.Parse(c.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("graphite.address %s is invalid: must be a http(s) url", c.Address)
+		}
+	} else if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("graphite.address %s is invalid: %s", c.Address, err)
+	}
+	for i, r := range c.Rules {
+		if len(r.Pattern) == 0 || len(r.Name) == 0 {
+			return fmt.Errorf("graphite.rules[%d]: pattern and name are required", i)
+		}
+	}
+	if c.Backlog < 0 {
+		return fmt.Errorf("graphite.backlog %d must not be negative", c.Backlog)
+	}
+	if c.Backlog == 0 {
+		c.Backlog = defaultBacklog
+	}
+	if c.MaxBackoff.Duration < minBackoff {
+		c.MaxBackoff.Duration = defaultMaxBackoff
+	}
+	if c.WriteTimeout.Duration <= 0 {
+		c.WriteTimeout.Duration = defaultWriteTimeout
 	}
 
 	if c.FlushInterval.Duration < time.Second {
@@ -74,11 +148,13 @@ type Metric struct {
 
 type metricDB struct {
 	sync.RWMutex
-	m map[string]int64
+	m      map[string]int64
+	gauges map[string]bool    // 由Set写入的key，statsd与influx按gauge输出
+	timers map[string]*Sketch // 耗时，单位纳秒
 }
 
 func newMetricDB() *metricDB {
-	return &metricDB{m: make(map[string]int64)}
+	return &metricDB{m: make(map[string]int64), gauges: make(map[string]bool), timers: make(map[string]*Sketch)}
 }
 
 // Add key指标的值增加value, key应该为${node_names}.${metric}
@@ -99,6 +175,22 @@ func (m *metricDB) Set(key string, value int64) {
 	}
 	m.Lock()
 	m.m[key] = value
+	m.gauges[key] = true
+	m.Unlock()
+}
+
+// Timing key指标记录一次耗时d
+func (m *metricDB) Timing(key string, d time.Duration) {
+	if global.cfg.Disable {
+		return
+	}
+	m.Lock()
+	s, ok := m.timers[key]
+	if !ok {
+		s = NewSketch()
+		m.timers[key] = s
+	}
+	s.Add(float64(d))
 	m.Unlock()
 }
 
@@ -109,13 +201,27 @@ func (m *metricDB) Delete(key string) {
 	m.Unlock()
 }
 
+const (
+	stateInit    int32 = iota
+	stateStarted       // Start已调用
+	stateStopped       // Start之前调用了Stop
+)
+
 type Graphite struct {
 	cfg         *Config
-	prefix      string // perfix = Config.Prefix + "." + IP  + "."
+	prefix      string // perfix = Config.Prefix + "." + IP  + "."，statsd与influx不含IP
+	encoder     *encoder
+	mu          sync.RWMutex // 保护m与since的替换，写入指标时加读锁
 	m           *metricDB
+	since       time.Time // m开始记录的时间，作为刷新时指标的时间
 	chanMetrics *chanMetrics
 	logger      logging.Logger
+	sender      *sender
+	sendMu      sync.Mutex // 保证sender只被一个刷新使用
+	state       int32
+	stopOnce    sync.Once
 	stopCh      chan int
+	done        chan struct{} // Start返回时关闭
 }
 
 func New(addr string, prefix string, flushInterval time.Duration, logger logging.Logger) *Graphite {
@@ -148,20 +254,19 @@ func newGraphite(cfg *Config, logger logging.Logger) *Graphite {
 	if err != nil {
 		ipv4 = "127.0.0.1"
 	}
-	ipv4UnderlineStr := strings.Replace(ipv4, ".", "_", -1)
-
-	prefix := ""
-	if len(cfg.Prefix) != 0 {
-		prefix = cfg.Prefix + "." + ipv4UnderlineStr + "."
-	}
+	enc := newEncoder(cfg, ipv4)
 
 	g := &Graphite{
 		cfg:         cfg,
-		prefix:      prefix,
+		prefix:      enc.prefix,
+		encoder:     enc,
 		logger:      logger,
 		m:           newMetricDB(),
+		since:       time.Now(),
 		chanMetrics: newChanMetrics(),
+		sender:      newSender(cfg, logger),
 		stopCh:      make(chan int),
+		done:        make(chan struct{}),
 	}
 
 	global = g
@@ -169,84 +274,134 @@ func newGraphite(cfg *Config, logger logging.Logger) *Graphite {
 	return g
 }
 
-// Start 启动定期刷新指标到时序数据库(Graphite)的服务，服务将在goroutine中运行
+// Start 启动定期刷新指标到时序数据库(Graphite)的服务，阻塞直到Stop
 func (g *Graphite) Start() {
-	if g.cfg.Disable {
+	if g.cfg.Disable || !atomic.CompareAndSwapInt32(&g.state, stateInit, stateStarted) {
 		return
 	}
+	defer close(g.done)
+
 	// 时间对齐 假如刷新频率为1分钟，当前时间为 10:10:08 那么需要休眠 52秒再执行
 	// 之后每整分钟时刻执行
+	interval := g.cfg.FlushInterval.Duration
 	unixNano := time.Duration(time.Now().UnixNano())
-	sleepDuration := global.cfg.FlushInterval.Duration - unixNano%global.cfg.FlushInterval.Duration
-	time.Sleep(sleepDuration)
+	select {
+	case <-time.After(interval - unixNano%interval):
+	case <-g.stopCh:
+		g.final()
+		return
+	}
 
-	for _ = range time.Tick(global.cfg.FlushInterval.Duration) {
+	g.flush(false)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
 		select {
+		case <-ticker.C:
+			g.flush(false)
 		case <-g.stopCh:
-			break
-		default:
-			go graphite()
+			g.final()
+			return
 		}
 	}
 }
 
-// Stop 停掉Start启动的服务
+// Stop 停掉Start启动的服务，返回前做最后一次刷新；未调用Start时也会刷新
 func (g *Graphite) Stop() {
 	if g.cfg.Disable {
 		return
 	}
-	close(g.stopCh)
+	g.stopOnce.Do(func() {
+		close(g.stopCh)
+		if atomic.CompareAndSwapInt32(&g.state, stateInit, stateStopped) {
+			g.final()
+			return
+		}
+		<-g.done
+	})
+}
+
+// final 最后一次刷新，忽略重连的退避时间，之后关闭连接
+func (g *Graphite) final() {
+	g.flush(true)
+	g.sendMu.Lock()
+	defer g.sendMu.Unlock()
+	if n := g.sender.pending(); n > 0 {
+		g.logger.Errorf("graphite stopped, %d metrics not sent", n)
+	}
+	g.sender.close()
+}
+
+func (g *Graphite) add(key string, value int64) {
+	g.mu.RLock()
+	g.m.Add(key, value)
+	g.mu.RUnlock()
+}
+
+func (g *Graphite) set(key string, value int64) {
+	g.mu.RLock()
+	g.m.Set(key, value)
+	g.mu.RUnlock()
 }
 
 // Add key指标的值增加value, key应该为${node_names}.${metric}
 func (g *Graphite) Add(key string, value int64) {
-	g.m.Add(key, value)
+	g.add(key, value)
 }
 
 // Add ${node_names}.${metric}的值增加value
 func (g *Graphite) AddMetric(nodeName, meitricName string, value int64) {
-	g.m.Add(nodeName+"."+meitricName, value)
+	g.add(nodeName+"."+meitricName, value)
 }
 
 // Add ${node_names}.qps的值增加value
 func (g *Graphite) AddQPS(nodeName string, value int64) {
-	g.m.Add(nodeName+"."+"qps", value)
+	g.add(nodeName+"."+"qps", value)
 }
 
 // Add ${node_names}.*的值增加value, *为 metrics切片
 func (g *Graphite) AddMetrics(nodeName string, metrics []Metric) {
 	for _, metric := range metrics {
-		g.m.Add(nodeName+"."+metric.Name, metric.Value)
+		g.add(nodeName+"."+metric.Name, metric.Value)
 	}
 }
 
 // Set 设置key指标的值为value, key应该为${node_names}.${metric}
 func (g *Graphite) Set(key string, value int64) {
-	g.m.Set(key, value)
+	g.set(key, value)
 }
 
 // Set 设置${node_names}.${metric}指标的值为value
 func (g *Graphite) SetMetric(nodeName, meitricName string, value int64) {
-	g.m.Set(nodeName+"."+meitricName, value)
+	g.set(nodeName+"."+meitricName, value)
 }
 
 // Set 设置${node_names}.qps指标的值为value
 func (g *Graphite) SetQPS(nodeName string, value int64) {
-	g.m.Set(nodeName+"."+"qps", value)
+	g.set(nodeName+"."+"qps", value)
 }
 
 // Set 设置${node_names}.*指标的值为value, *为 metrics切片
 func (g *Graphite) SetMetrics(nodeName string, metrics []Metric) {
 	for _, metric := range metrics {
-		g.m.Set(nodeName+"."+metric.Name, metric.Value)
+		g.set(nodeName+"."+metric.Name, metric.Value)
 	}
 }
 
-// resetDB 重置DB数据库
-func (g *Graphite) resetDB() map[string]int64 {
-	m := g.m
-	g.m = newMetricDB()
-	return m.m
+// Timing key指标记录一次耗时d, key应该为${node_names}.${metric}
+func (g *Graphite) Timing(key string, d time.Duration) {
+	g.mu.RLock()
+	g.m.Timing(key, d)
+	g.mu.RUnlock()
+}
+
+// resetDB 重置DB数据库，返回旧的DB及其开始记录的时间；返回后旧的DB不会再被写入
+func (g *Graphite) resetDB() (*metricDB, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, since := g.m, g.since
+	g.m, g.since = newMetricDB(), time.Now()
+	return m, since
 }
 
 // MonitorChan 添加对某个chan的监控，
@@ -258,109 +413,185 @@ func (g *Graphite) MonitorChan(key string, channeler Channeler) {
 
 // Add 同 Graphite.Add
 func Add(key string, value int64) {
+	backendAdd(key, value)
+	if global == nil {
+		return
+	}
 	global.Add(key, value)
 }
 
 // AddMetric 同 Graphite.AddMetric
 func AddMetric(nodeName, meitricName string, value int64) {
+	backendAdd(nodeName+"."+meitricName, value)
+	if global == nil {
+		return
+	}
 	global.AddMetric(nodeName, meitricName, value)
 }
 
 // AddQPS 同 Graphite.AddQPS
 func AddQPS(nodeName string, value int64) {
+	backendAdd(nodeName+".qps", value)
+	if global == nil {
+		return
+	}
 	global.AddQPS(nodeName, value)
 }
 
 // AddMetrics 同 Graphite.AddMetrics
 func AddMetrics(nodeName string, metrics []Metric) {
+	for _, metric := range metrics {
+		backendAdd(nodeName+"."+metric.Name, metric.Value)
+	}
+	if global == nil {
+		return
+	}
 	global.AddMetrics(nodeName, metrics)
 }
 
 // Set 同 Graphite.Set
 func Set(key string, value int64) {
+	backendSet(key, value)
+	if global == nil {
+		return
+	}
 	global.Set(key, value)
 }
 
 // SetMetric 同 Graphite.SetMetric
 func SetMetric(nodeName, meitricName string, value int64) {
+	backendSet(nodeName+"."+meitricName, value)
+	if global == nil {
+		return
+	}
 	global.SetMetric(nodeName, meitricName, value)
 }
 
 // SetQPS 同 Graphite.SetQPS
 func SetQPS(nodeName string, value int64) {
+	backendSet(nodeName+".qps", value)
+	if global == nil {
+		return
+	}
 	global.SetQPS(nodeName, value)
 }
 
 // SetMetrics 同 Graphite.SetMetrics
 func SetMetrics(nodeName string, metrics []Metric) {
+	for _, metric := range metrics {
+		backendSet(nodeName+"."+metric.Name, metric.Value)
+	}
+	if global == nil {
+		return
+	}
 	global.SetMetrics(nodeName, metrics)
 }
 
+// Timing 同 Graphite.Timing
+func Timing(key string, d time.Duration) {
+	backendTiming(key, d)
+	if global == nil {
+		return
+	}
+	global.Timing(key, d)
+}
+
 // MonitorChan 添加对某个chan的监控，
 // 定期(FlushInterval)写入这个chan的长度和容量至时序数据库
 // nodeName即为${node_names}，写入监控的数据为 ${node_name}.length, ${node_name}.capacity
 func MonitorChan(nodeName string, channeler Channeler) {
+	for _, b := range loadBackends() {
+		b.MonitorChan(nodeName, channeler)
+	}
+	if global == nil {
+		return
+	}
 	global.chanMetrics.Monitor(nodeName, channeler)
 }
 
+// timingQuantiles Timing输出的分位数
+var timingQuantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+}
+
 func graphite() {
-	now := time.Now().Unix()
-	now = now - now%int64((global.cfg.FlushInterval.Duration/time.Second))
-	flushSeconds := float64(global.cfg.FlushInterval.Duration) / float64(time.Second)
+	global.flush(false)
+}
 
-	// 无论本次发送是否成功，均重置数据库
-	m := global.resetDB()
+// flush 将本周期的指标加入backlog并发送，无论本次发送是否成功，均重置数据库
+func (g *Graphite) flush(force bool) {
+	lines := g.collect()
 
-	var w *bufio.Writer
-	conn, err := net.Dial("tcp", global.cfg.Address)
-	if err != nil {
-		global.logger.Errorf("Dial(%s) failed: %s", global.cfg.Address, err)
-		w = bufio.NewWriter(global.logger.Output())
-	} else {
-		defer conn.Close()
+	g.sendMu.Lock()
+	defer g.sendMu.Unlock()
+	g.sender.push(lines)
+	if err := g.sender.send(force); err != nil {
+		g.logger.Errorf("send to %s failed, %d metrics pending: %s", g.cfg.Address, g.sender.pending(), err)
+		return
+	}
+	g.logger.Infof("%d metrics flushed", len(lines))
+}
 
-		w = bufio.NewWriter(conn)
+// collect 重置数据库，返回本周期的指标行
+// 指标的时间为本周期开始时间按FlushInterval对齐，如10:10:20开始、10:11:00刷新的指标时间为10:10:00
+func (g *Graphite) collect() []string {
+	db, since := g.resetDB()
+	interval := int64(g.cfg.FlushInterval.Duration / time.Second)
+	if interval <= 0 {
+		interval = 1
 	}
-	count := 0
+	enc := *g.encoder
+	enc.ts = since.Unix() - since.Unix()%interval
+	enc.flushSeconds = float64(interval)
+
+	var lines []string
+	add := func(p *point) {
+		for _, l := range enc.encode(p) {
+			g.logger.Debugf("%s", strings.TrimSuffix(l, "\n"))
+			lines = append(lines, l)
+		}
+	}
+
+	m := db.m
 	for k, v := range m {
-		count++
-		if strings.HasSuffix(k, ".time") {
+		switch {
+		case strings.HasSuffix(k, ".time"):
 			timeValue := v
 
 			// 针对xxx.time(耗时)指标，需要除以它的QPS
 			qpsKey := strings.TrimSuffix(k, ".time") + ".qps"
 			qpsValue, ok := m[qpsKey]
-			if ok {
+			if ok && qpsValue != 0 {
 				timeValue = timeValue / qpsValue
 			}
-			fmt.Fprintf(w, "%s%s %0.2f %d\n", global.prefix, k, float64(timeValue)/flushSeconds, now)
-			global.logger.Debugf("%s%s %0.2f %d", global.prefix, k, float64(timeValue)/flushSeconds, now)
-
-		} else {
-			fmt.Fprintf(w, "%s%s_count %d %d\n", global.prefix, k, v, now)
-			global.logger.Debugf("%s%s_count %d %d\n", global.prefix, k, v, now)
-			fmt.Fprintf(w, "%s%s %0.2f %d\n", global.prefix, k, float64(v)/flushSeconds, now)
-			global.logger.Debugf("%s%s %0.2f %d", global.prefix, k, float64(v)/flushSeconds, now)
+			add(&point{key: k, kind: pointMean, mean: float64(timeValue)})
+		case db.gauges[k]:
+			add(&point{key: k, kind: pointGauge, value: v})
+		default:
+			add(&point{key: k, kind: pointCounter, value: v})
 		}
 	}
 
+	// 耗时的分位数，单位毫秒
+	for k, s := range db.timers {
+		add(&point{key: k, kind: pointTiming, sketch: s})
+	}
+
 	// chan的长度和容量
-	chanMetrics := global.chanMetrics
+	chanMetrics := g.chanMetrics
 	if chanMetrics.Length() != 0 {
 		chanMetrics.RLock()
 		for k, v := range chanMetrics.m {
-			fmt.Fprintf(w, "%s%s.length %d %d\n", global.prefix, k, v.Length(), now)
-			global.logger.Debugf("%s%s.length %d %d\n", global.prefix, k, v.Length(), now)
-			fmt.Fprintf(w, "%s%s.capacity %d %d\n", global.prefix, k, v.Capacity(), now)
-			global.logger.Debugf("%s%s.capacity %d %d\n", global.prefix, k, v.Capacity(), now)
+			add(&point{key: k, kind: pointChan, length: v.Length(), capacity: v.Capacity()})
 		}
 		chanMetrics.RUnlock()
 	}
-	if err := w.Flush(); err != nil {
-		global.logger.Errorf("flush failed: %s", err)
-		return
-	}
-	global.logger.Infof("%d metrics flushed", count)
+	return lines
 }
 
 func Flush() {
@@ -2,6 +2,7 @@ package graphite
 
 import (
 	"bufio"
+	"errors"
 	"net"
 	"strconv"
 	"strings"
@@ -87,9 +88,13 @@ func TestGraphite(t *testing.T) {
 	Add("api5.qps", 10)                                   // 10
 	SetMetrics("api5", []Metric{{Name: "qps", Value: 9}}) // 9
 
-	graphite()
+	// 1ms~100ms
+	for i := 1; i <= 100; i++ {
+		Timing("api6", time.Duration(i)*time.Millisecond)
+	}
 
-	time.Sleep(1 * time.Second)
+	// 未调用Start时，Stop做最后一次刷新并关闭连接
+	g.Stop()
 
 	wg.Wait()
 	t.Log(res)
@@ -103,6 +108,8 @@ func TestGraphite(t *testing.T) {
 		{g.prefix + "api3.qps", 5.0},
 		{g.prefix + "api4.qps", 8.0},
 		{g.prefix + "api5.qps", 9.0},
+		{g.prefix + "api6.max", 100.0},
+		{g.prefix + "api6.count", 100.0},
 	}
 
 	for _, tt := range tests {
@@ -111,4 +118,185 @@ func TestGraphite(t *testing.T) {
 			t.Fatalf("%s except %v actual %v", tt.key, tt.except, actual)
 		}
 	}
+
+	// 分位数的相对误差不超过1%
+	for key, except := range map[string]float64{"api6.p50": 50, "api6.p90": 90, "api6.p99": 99} {
+		actual := res[g.prefix+key]
+		if actual < except*0.99 || actual > except*1.01 {
+			t.Errorf("%s except %v actual %v", key, except, actual)
+		}
+	}
+}
+
+// newLineServer 在addr上监听，接收到的行写入返回的chan
+func newLineServer(t *testing.T, addr string) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 1000)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					lines <- strings.TrimSuffix(line, "\n")
+				}
+			}()
+		}
+	}()
+	return ln, lines
+}
+
+func recvLines(t *testing.T, lines chan string, n int) []string {
+	var res []string
+	for len(res) < n {
+		select {
+		case l := <-lines:
+			res = append(res, l)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("except %d lines, got %v", n, res)
+		}
+	}
+	return res
+}
+
+// Graphite不可用时指标保存在backlog中，恢复后按原时间戳重发
+func TestGraphiteBacklog(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := &Config{Address: addr, FlushInterval: ltime.Duration{Duration: time.Second}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	g := newGraphite(cfg, logging.DefaultLogger())
+	g.Add("a.qps", 1)
+	// 两个周期的开始时间在不同的秒
+	time.Sleep(1100 * time.Millisecond)
+	g.flush(false)
+	if g.sender.pending() != 2 {
+		t.Fatalf("pending %d", g.sender.pending())
+	}
+	first := strings.Fields(g.sender.backlog[0])[2]
+
+	// 退避时间内不重连
+	time.Sleep(1100 * time.Millisecond)
+	ln, lines := newLineServer(t, addr)
+	defer ln.Close()
+	g.Add("b.qps", 1)
+	g.flush(false)
+	if g.sender.pending() != 0 {
+		t.Fatalf("pending %d", g.sender.pending())
+	}
+
+	got := map[string]string{}
+	for _, l := range recvLines(t, lines, 4) {
+		f := strings.Fields(l)
+		got[f[0]] = f[2]
+	}
+	if got["a.qps"] != first || got["a.qps_count"] != first {
+		t.Errorf("a.qps should keep timestamp %s: %v", first, got)
+	}
+	if got["b.qps"] == first {
+		t.Errorf("b.qps timestamp: %v", got)
+	}
+
+	// 对端关闭后重连
+	ln.Close()
+	g.sender.t.(*connTransport).conn.(*net.TCPConn).CloseRead()
+	g.Add("c.qps", 1)
+	g.flush(false)
+	if g.sender.pending() != 2 {
+		t.Fatalf("pending %d", g.sender.pending())
+	}
+
+	// backlog满时丢弃最早的
+	g.sender.maxBacklog = 3
+	g.Add("d.qps", 1)
+	g.flush(false)
+	if g.sender.pending() != 3 || !strings.HasPrefix(g.sender.backlog[0], "c.qps") {
+		t.Errorf("backlog %v", g.sender.backlog)
+	}
+}
+
+// partialTransport 只写入前n个字节后返回错误
+type partialTransport struct {
+	n   int
+	buf []byte
+}
+
+func (t *partialTransport) Write(b []byte) (int, error) {
+	if len(b) > t.n {
+		t.buf = append(t.buf, b[:t.n]...)
+		return t.n, errors.New("broken pipe")
+	}
+	t.buf = append(t.buf, b...)
+	return len(b), nil
+}
+
+func (t *partialTransport) Alive() bool  { return true }
+func (t *partialTransport) Close() error { return nil }
+
+// 部分写入失败时从第一条未完整写入的行开始重发，不重复发送已写入的行
+func TestSenderPartialWrite(t *testing.T) {
+	s := newSender(&Config{Address: "127.0.0.1:0"}, logging.DefaultLogger())
+	s.t = &partialTransport{n: len("a 1 1\nb 2 1\nc ")}
+	s.push([]string{"a 1 1\n", "b 2 1\n", "c 3 1\n", "d 4 1\n"})
+	if err := s.send(false); err == nil {
+		t.Fatal("except error")
+	}
+	if s.pending() != 2 || s.backlog[0] != "c 3 1\n" {
+		t.Fatalf("backlog %q", s.backlog)
+	}
+
+	// statsd不保存backlog
+	s = newSender(&Config{Address: "127.0.0.1:0", Format: FormatStatsd}, logging.DefaultLogger())
+	s.t = &partialTransport{}
+	s.push([]string{"a:1|c\n", "b:2|c\n"})
+	if err := s.send(false); err == nil {
+		t.Fatal("except error")
+	}
+	if s.pending() != 0 {
+		t.Fatalf("statsd backlog %q", s.backlog)
+	}
+}
+
+func TestGraphiteStop(t *testing.T) {
+	ln, lines := newLineServer(t, "127.0.0.1:0")
+	defer ln.Close()
+	cfg := &Config{Address: ln.Addr().String(), FlushInterval: ltime.Duration{Duration: time.Minute}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	g := newGraphite(cfg, logging.DefaultLogger())
+	returned := make(chan struct{})
+	go func() {
+		g.Start()
+		close(returned)
+	}()
+	g.Add("stop.qps", 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		g.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	<-returned
+	recvLines(t, lines, 2)
 }
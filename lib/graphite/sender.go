@@ -0,0 +1,247 @@
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"process_data/lib/logging"
+)
+
+const (
+	defaultBacklog      = 100000
+	defaultMaxBackoff   = time.Minute
+	defaultWriteTimeout = 5 * time.Second
+	minBackoff          = time.Second
+)
+
+// 每次写入的最大字节数，写入成功的行才从backlog中移除；超过的单行单独写入
+const (
+	maxPayloadTCP  = 64 << 10
+	maxPayloadUDP  = 1432 // 以太网MTU内不分片
+	maxPayloadHTTP = 1 << 20
+)
+
+// transport 发送一批以\n结尾的行，返回已写入的字节数
+type transport interface {
+	Write(b []byte) (int, error)
+	Alive() bool // 写入前检查连接是否可用
+	Close() error
+}
+
+// connTransport tcp与udp，每次Write为一个udp包
+type connTransport struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (t *connTransport) Write(b []byte) (int, error) {
+	t.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	return t.conn.Write(b)
+}
+
+// Alive Graphite不会向客户端写数据，读到EOF或错误说明对端已关闭连接
+// 在写入前检查，避免向已关闭的连接写入第一批数据时不报错而丢失；udp读到之前发送的ICMP端口不可达错误时重连
+func (t *connTransport) Alive() bool {
+	t.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := t.conn.Read(b[:])
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+func (t *connTransport) Close() error {
+	return t.conn.Close()
+}
+
+// httpTransport 以POST写入，如InfluxDB的/write?db=xxx或/api/v2/write?org=xxx&bucket=xxx
+type httpTransport struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Write 请求失败时视为整批未写入
+func (t *httpTransport) Write(b []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(t.token) > 0 {
+		req.Header.Set("Authorization", "Token "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return len(b), nil
+}
+
+func (t *httpTransport) Alive() bool  { return true }
+func (t *httpTransport) Close() error { return nil }
+
+// sender 保持到Graphite的长连接，不是goroutine-safe的
+// 发送失败的指标保存在backlog中(最多maxBacklog行，超出时丢弃最早的)，重连后按原时间戳重发
+// statsd不带时间戳，重发的计数会计入重发时的周期，因此不保存backlog，发送失败时丢弃
+type sender struct {
+	protocol   string
+	addr       string
+	token      string
+	timeout    time.Duration
+	maxBacklog int
+	maxBackoff time.Duration
+	maxPayload int
+	noBacklog  bool
+	logger     logging.Logger
+
+	t       transport
+	backoff time.Duration
+	retryAt time.Time // 连接失败后，此时刻之前不再重连
+	backlog []string  // 未发送的行，含时间戳与换行符
+}
+
+func newSender(cfg *Config, logger logging.Logger) *sender {
+	s := &sender{
+		protocol:   cfg.Protocol,
+		addr:       cfg.Address,
+		token:      cfg.Token,
+		timeout:    cfg.WriteTimeout.Duration,
+		maxBacklog: cfg.Backlog,
+		maxBackoff: cfg.MaxBackoff.Duration,
+		noBacklog:  cfg.Format == FormatStatsd,
+		logger:     logger,
+	}
+	if len(s.protocol) == 0 {
+		s.protocol = ProtocolTCP
+	}
+	if s.timeout <= 0 {
+		s.timeout = defaultWriteTimeout
+	}
+	if s.maxBacklog <= 0 {
+		s.maxBacklog = defaultBacklog
+	}
+	if s.maxBackoff < minBackoff {
+		s.maxBackoff = defaultMaxBackoff
+	}
+	switch s.protocol {
+	case ProtocolUDP:
+		s.maxPayload = maxPayloadUDP
+	case ProtocolHTTP:
+		s.maxPayload = maxPayloadHTTP
+	default:
+		s.maxPayload = maxPayloadTCP
+	}
+	return s
+}
+
+// dial 建立连接，http不需要连接
+func (s *sender) dial() (transport, error) {
+	if s.protocol == ProtocolHTTP {
+		return &httpTransport{url: s.addr, token: s.token, client: &http.Client{Timeout: s.timeout}}, nil
+	}
+	conn, err := net.DialTimeout(s.protocol, s.addr, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &connTransport{conn: conn, timeout: s.timeout}, nil
+}
+
+// push 加入待发送的行，超出maxBacklog时丢弃最早的
+func (s *sender) push(lines []string) {
+	s.backlog = append(s.backlog, lines...)
+	if n := len(s.backlog) - s.maxBacklog; n > 0 {
+		s.logger.Errorf("graphite backlog is full, drop %d oldest metrics", n)
+		s.backlog = append(s.backlog[:0], s.backlog[n:]...)
+	}
+}
+
+// pending 未发送的行数
+func (s *sender) pending() int {
+	return len(s.backlog)
+}
+
+// send 发送backlog，未连接时按退避时间重连；force为true时忽略退避时间立即重连
+func (s *sender) send(force bool) error {
+	err := s.sendBacklog(force)
+	if err != nil && s.noBacklog && len(s.backlog) > 0 {
+		s.logger.Errorf("graphite drop %d unsent statsd metrics", len(s.backlog))
+		s.backlog = nil
+	}
+	return err
+}
+
+func (s *sender) sendBacklog(force bool) error {
+	if len(s.backlog) == 0 {
+		return nil
+	}
+	if s.t != nil && !s.t.Alive() {
+		s.close()
+	}
+	if s.t == nil {
+		if !force && time.Now().Before(s.retryAt) {
+			return fmt.Errorf("reconnect after %s", s.retryAt.Format(time.RFC3339))
+		}
+		t, err := s.dial()
+		if err != nil {
+			s.fail()
+			return err
+		}
+		s.t = t
+	}
+
+	var buf bytes.Buffer
+	for len(s.backlog) > 0 {
+		buf.Reset()
+		n := 0
+		for n < len(s.backlog) && (n == 0 || buf.Len()+len(s.backlog[n]) <= s.maxPayload) {
+			buf.WriteString(s.backlog[n])
+			n++
+		}
+		if written, err := s.t.Write(buf.Bytes()); err != nil {
+			// 只重发未完整写入的行；写入一半的行在旧连接上没有换行符，连接关闭后对端丢弃
+			for len(s.backlog) > 0 && len(s.backlog[0]) <= written {
+				written -= len(s.backlog[0])
+				s.backlog = s.backlog[1:]
+			}
+			s.close()
+			s.fail()
+			return err
+		}
+		s.backlog = s.backlog[n:]
+	}
+	s.backlog = nil
+	s.backoff = 0
+	return nil
+}
+
+// fail 连接或写入失败，退避时间从minBackoff开始翻倍，最大maxBackoff
+func (s *sender) fail() {
+	s.backoff *= 2
+	if s.backoff < minBackoff {
+		s.backoff = minBackoff
+	}
+	if s.backoff > s.maxBackoff {
+		s.backoff = s.maxBackoff
+	}
+	s.retryAt = time.Now().Add(s.backoff)
+}
+
+func (s *sender) close() {
+	if s.t != nil {
+		s.t.Close()
+		s.t = nil
+	}
+}
@@ -0,0 +1,102 @@
+package graphite
+
+import (
+	"math"
+	"sort"
+)
+
+// sketchAccuracy Sketch分位数的相对误差
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// Sketch 可合并的分位数草图，按对数划分桶(同DDSketch)，分位数的相对误差不超过1%
+// 桶数与值的量级相关，如1us~100s约900个桶，与样本数无关；不是goroutine-safe的
+type Sketch struct {
+	buckets map[int]uint64 // 桶序号 -> 样本数，值v落在 (gamma^(i-1), gamma^i]
+	zero    uint64         // 小于等于0的样本数
+	count   uint64
+	sum     float64
+	min     float64
+	max     float64
+}
+
+func NewSketch() *Sketch {
+	return &Sketch{buckets: map[int]uint64{}}
+}
+
+// Add 添加一个样本
+func (s *Sketch) Add(v float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+	if v <= 0 {
+		s.zero++
+		return
+	}
+	s.buckets[int(math.Ceil(math.Log(v)/sketchLogGamma))]++
+}
+
+// Merge 合并o的样本
+func (s *Sketch) Merge(o *Sketch) {
+	if o.count == 0 {
+		return
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.count += o.count
+	s.sum += o.sum
+	s.zero += o.zero
+	for i, n := range o.buckets {
+		s.buckets[i] += n
+	}
+}
+
+// Quantile q分位数(0<=q<=1)，没有样本时为0
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zero {
+		return math.Max(s.min, math.Min(0, s.max))
+	}
+	seen := s.zero
+	keys := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	for _, i := range keys {
+		seen += s.buckets[i]
+		if seen > rank {
+			// 桶的中点，相对误差不超过sketchAccuracy
+			v := 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+			return math.Max(s.min, math.Min(v, s.max))
+		}
+	}
+	return s.max
+}
+
+func (s *Sketch) Count() uint64 { return s.count }
+func (s *Sketch) Sum() float64  { return s.sum }
+func (s *Sketch) Min() float64  { return s.min }
+func (s *Sketch) Max() float64  { return s.max }
@@ -0,0 +1,53 @@
+package graphite
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSketchQuantile(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	a, b := NewSketch(), NewSketch()
+	values := make([]float64, 0, 20000)
+	for i := 0; i < 20000; i++ {
+		v := math.Exp(r.Float64()*10) * 1000 // 1us~22ms，跨多个量级
+		values = append(values, v)
+		// 分两个Sketch记录再合并
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	a.Merge(b)
+	sort.Float64s(values)
+
+	if a.Count() != uint64(len(values)) || a.Min() != values[0] || a.Max() != values[len(values)-1] {
+		t.Fatalf("count %d min %f max %f", a.Count(), a.Min(), a.Max())
+	}
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99, 0.999} {
+		except := values[int(q*float64(len(values)-1))]
+		actual := a.Quantile(q)
+		if math.Abs(actual-except)/except > sketchAccuracy {
+			t.Errorf("p%v: %f, except %f", q*100, actual, except)
+		}
+	}
+	if a.Quantile(1) != a.Max() || a.Quantile(0) != a.Min() {
+		t.Errorf("q0 %f q1 %f", a.Quantile(0), a.Quantile(1))
+	}
+}
+
+func TestSketchZero(t *testing.T) {
+	s := NewSketch()
+	if s.Quantile(0.5) != 0 {
+		t.Errorf("empty sketch: %f", s.Quantile(0.5))
+	}
+	for _, v := range []float64{0, 0, 0, 100, 100} {
+		s.Add(v)
+	}
+	if p50, p90 := s.Quantile(0.5), s.Quantile(0.9); p50 != 0 || math.Abs(p90-100) > 100*sketchAccuracy {
+		t.Errorf("p50 %f p90 %f", p50, p90)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	cluster "github.com/bsm/sarama-cluster"
 
 	"process_data/config"
+	"process_data/lib/graphite"
 	"process_data/lib/logging"
 	"process_data/lib/rtm"
 )
@@ -25,10 +26,12 @@ type KafkaConsumer struct {
 	notifctnCh rtm.NotifctnCh
 
 	consumer *cluster.Consumer
+	offsets  *offsetTracker // 只提交worker已确认的offset
 
 	// ${topic}为topic名字中的. - 替换为下划线
 	metricTopicQPS   string // ${topic}.consume.qps
 	metricTopicError string // ${topic}.consume.error
+	metricTopicPause string // ${topic}.consume.pause
 
 	msgType int // 消息类型，默认为0，是否启用该字段由业务方决定
 
@@ -42,12 +45,13 @@ func NewKafkaConsumer(id int,
 
 	k := &KafkaConsumer{
 		cfg:        kcfg,
-		Logger:     lg,
 		outCh:      ch,
 		ID:         id,
 		notifctnCh: make(rtm.NotifctnCh),
+		offsets:    newOffsetTracker(),
 	}
 	k.topic = k.cfg.Topics[0]
+	k.Logger = lg.With(logging.Fields{"topic": k.topic, "consumer": id})
 
 	cc, err := k.newClusterConfig()
 	if err != nil {
@@ -63,10 +67,11 @@ func NewKafkaConsumer(id int,
 	s = strings.Replace(s, "-", "_", -1)
 	k.metricTopicQPS = fmt.Sprintf("%s.consume.qps", s)
 	k.metricTopicError = fmt.Sprintf("%s.consume.error", s)
+	k.metricTopicPause = fmt.Sprintf("%s.consume.pause", s)
 
 	consumer, err := cluster.NewConsumer(brokers, groupID, topics, cc)
 	if err != nil {
-		k.Logger.Errorf("Topic(%s) Kafka NewConsumer Error: %s", err, k.topic)
+		k.Logger.Errorf("Kafka NewConsumer Error: %s", err)
 		return nil, err
 	}
 	k.consumer = consumer
@@ -133,7 +138,7 @@ func (k *KafkaConsumer) newClusterConfig() (*cluster.Config, error) {
 	cc.ClientID = k.cfg.ClientID
 
 	if err := cc.Validate(); err != nil {
-		k.Logger.Errorf("Topic(%s) Invalid kafka configuration: %v", k.topic, err)
+		k.Logger.Errorf("Invalid kafka configuration: %v", err)
 		return nil, err
 	}
 
@@ -141,7 +146,7 @@ func (k *KafkaConsumer) newClusterConfig() (*cluster.Config, error) {
 }
 
 func (k *KafkaConsumer) Start(wg *sync.WaitGroup) {
-	k.Logger.Infof("Topic(%s) KafkaConsumer:%d started", k.topic, k.ID)
+	k.Logger.Info("consumer started")
 	k.wg = wg
 
 	isStop := false
@@ -150,29 +155,43 @@ func (k *KafkaConsumer) Start(wg *sync.WaitGroup) {
 		case msg, ok := <-k.consumer.Messages():
 			if !ok {
 				time.Sleep(1 * time.Second)
-				k.Logger.Errorf("Topic(%s) KafkaConsumer:%d message channel be closed", k.topic, k.ID)
+				k.Logger.Error("consumer message channel be closed")
 				if isStop {
 					return
 				}
 				continue
 			}
-			k.consumer.MarkOffset(msg, "")
 			k.Logger.Debugf("%s", msg.Value)
-			k.outCh <- &config.KafkaConsumerMsg{Value: msg.Value, Type: k.msgType}
+			if !k.waitPending(msg.Topic, msg.Partition) {
+				k.stop()
+				return
+			}
+			graphite.Add(k.metricTopicQPS, 1)
+			k.offsets.Add(msg.Topic, msg.Partition, msg.Offset)
+			k.outCh <- &config.KafkaConsumerMsg{
+				Value:     msg.Value,
+				Type:      k.msgType,
+				Topic:     msg.Topic,
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+				AckFunc:   k.ackFunc(msg.Topic, msg.Partition, msg.Offset),
+				Received:  time.Now(),
+			}
 
 		case err, ok := <-k.consumer.Errors():
 			if ok {
-				k.Logger.Errorf("Topic(%s) KafkaConsumer:%d consume Erros: %+v", k.topic, k.ID, err)
+				graphite.Add(k.metricTopicError, 1)
+				k.Logger.Errorf("consume Erros: %+v", err)
 			}
 
-		case err, ok := <-k.consumer.Notifications():
+		case ntf, ok := <-k.consumer.Notifications():
 			if ok {
-				k.Logger.Errorf("Topic(%s) KafkaConsumer:%d Rebalanced: %+v", k.topic, k.ID, err)
+				k.rebalanced(ntf)
 			}
 
 		case n, ok := <-k.notifctnCh:
 			// if n == rtm.NotifctnStop {}
-			k.Logger.Errorf("Topic(%s) KafkaConsumer:%d (%d,%v) stoping", k.topic, k.ID, n, ok)
+			k.Logger.Errorf("(%d,%v) stoping", n, ok)
 			isStop = true
 			k.stop()
 			return
@@ -180,24 +199,84 @@ func (k *KafkaConsumer) Start(wg *sync.WaitGroup) {
 	}
 }
 
+func (k *KafkaConsumer) rebalanced(ntf *cluster.Notification) {
+	k.Logger.Errorf("Rebalanced: %+v", ntf)
+	for topic, partitions := range ntf.Released {
+		k.offsets.Release(topic, partitions)
+	}
+}
+
+// waitPending partition未确认的消息达到max_pending时暂停拉取，直到有消息被确认或partition被回收
+// 如redis不可用时worker重试，未确认的消息不会无限增长；收到停止通知时返回false
+func (k *KafkaConsumer) waitPending(topic string, partition int32) bool {
+	if k.offsets.PartitionPending(topic, partition) < k.cfg.MaxPending {
+		return true
+	}
+	graphite.Add(k.metricTopicPause, 1)
+	k.Logger.Warnf("partition %d has %d unacknowledged messages, pause fetching", partition, k.cfg.MaxPending)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for k.offsets.PartitionPending(topic, partition) >= k.cfg.MaxPending {
+		select {
+		case <-ticker.C:
+		case ntf, ok := <-k.consumer.Notifications():
+			if ok {
+				k.rebalanced(ntf)
+			}
+		case n, ok := <-k.notifctnCh:
+			k.Logger.Errorf("(%d,%v) stoping", n, ok)
+			return false
+		}
+	}
+	k.Logger.Infof("partition %d resume fetching", partition)
+	return true
+}
+
+// OldestAge 最早的未确认消息已拉取的时间
+func (k *KafkaConsumer) OldestAge() time.Duration {
+	return k.offsets.OldestAge()
+}
+
+// ackFunc 返回消息的确认函数，提交该partition连续确认的最大offset
+func (k *KafkaConsumer) ackFunc(topic string, partition int32, offset int64) func() {
+	return func() {
+		if commit, ok := k.offsets.Ack(topic, partition, offset); ok {
+			k.consumer.MarkPartitionOffset(topic, partition, commit, "")
+		}
+	}
+}
+
+// stop 停止拉取消息，不关闭consumer，已确认的offset在Close时提交
 func (k *KafkaConsumer) stop() error {
 	defer func() {
 		if k.wg != nil {
 			k.wg.Done()
 		}
 	}()
+	k.Logger.Info("consumer stop fetching")
+
+	return nil
+}
+
+// Close 关闭consumer并提交已确认的offset，需在Stop之后调用
+func (k *KafkaConsumer) Close() error {
 	// k.Logger.Debugf("KafkaConsumer:%d stoped", k.ID)
 	if err := k.consumer.Close(); err != nil {
-		k.Logger.Infof("Topic(%s) KafkaConsumer:%d stop failed: %+v", k.topic, k.ID, err)
+		k.Logger.Infof("stop failed: %+v", err)
 		// k.Logger.Debugf("KafkaConsumer:%d ", k.ID)
 		return err
 	}
 
-	k.Logger.Infof("Topic(%s) KafkaConsumer:%d stoped", k.topic, k.ID)
+	k.Logger.Info("consumer stoped")
 
 	return nil
 }
 
+// Pending 已拉取但未确认的消息数
+func (k *KafkaConsumer) Pending() int {
+	return k.offsets.Pending()
+}
+
 func (k *KafkaConsumer) Stop() error {
 	k.notifctnCh <- rtm.NotifctnStop
 
@@ -2,13 +2,20 @@
 package kafka
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"process_data/config"
+	"process_data/lib/graphite"
 	"process_data/lib/logging"
 	"process_data/lib/rtm"
 )
 
+// ageInterval 更新最早未确认消息等待时间指标的间隔
+var ageInterval = 10 * time.Second
+
 type KafkaConsumerManager struct {
 	Logger logging.Logger
 	wg     sync.WaitGroup
@@ -21,6 +28,11 @@ type KafkaConsumerManager struct {
 
 	msgType int // 消息类型，默认为0，是否启用该字段由业务方决定
 
+	stopOnce sync.Once
+	stopCh   chan struct{}
+
+	metricTopicAge string // ${topic}.consume.unacked_age，最早的未确认消息已拉取的秒数
+
 	topic string
 }
 
@@ -30,10 +42,13 @@ func NewKafkaConsumerManager(
 	ch config.KafkaConsumerMsgCh) (*KafkaConsumerManager, error) {
 	km := &KafkaConsumerManager{
 		cfg:    kcfg,
-		Logger: lg,
 		outCh:  ch,
+		stopCh: make(chan struct{}),
 	}
 	km.topic = km.cfg.Topics[0]
+	s := strings.Replace(strings.Replace(km.topic, ".", "_", -1), "-", "_", -1)
+	km.metricTopicAge = fmt.Sprintf("%s.consume.unacked_age", s)
+	km.Logger = lg.With(logging.Fields{"topic": km.topic})
 
 	return km, nil
 }
@@ -52,13 +67,13 @@ func (km *KafkaConsumerManager) Init() error {
 			km.Logger,
 			km.outCh)
 		if err != nil {
-			km.Logger.Errorf("Topic(%s) initKafkaConsumer fail: %s", km.topic, err)
+			km.Logger.Errorf("initKafkaConsumer fail: %s", err)
 			return err
 		}
 		consumer.SetMsgType(km.msgType)
 		km.kafkaConsumers[i] = consumer
 	}
-	km.Logger.Infof("Topic(%s) init KafkaConsumer success", km.topic)
+	km.Logger.Info("init KafkaConsumer success")
 
 	return nil
 }
@@ -69,36 +84,92 @@ func (km *KafkaConsumerManager) Start() error {
 		consumer := km.kafkaConsumers[i]
 		go consumer.Start(&km.wg)
 	}
+	go km.monitorAge()
 	return nil
 }
 
+// monitorAge 定期更新最早的未确认消息已拉取的时间，持续增长说明offset无法提交
+func (km *KafkaConsumerManager) monitorAge() {
+	ticker := time.NewTicker(ageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			graphite.Set(km.metricTopicAge, int64(km.OldestAge()/time.Second))
+		case <-km.stopCh:
+			return
+		}
+	}
+}
+
+// OldestAge 所有consumer中最早的未确认消息已拉取的时间
+func (km *KafkaConsumerManager) OldestAge() time.Duration {
+	var age time.Duration
+	for _, consumer := range km.kafkaConsumers {
+		if a := consumer.OldestAge(); a > age {
+			age = a
+		}
+	}
+	return age
+}
+
+// Stop 停止拉取消息、关闭outCh并关闭所有consumer
 func (km *KafkaConsumerManager) Stop() error {
-	km.Logger.Infof("Topic(%s) stop KafkaConsumer", km.topic)
-	for i := 0; i < km.cfg.Routines; i++ {
-		consumer := km.kafkaConsumers[i]
-		consumer.Stop()
-		km.Logger.Infof("Topic(%s) stop KafkaConsumer:%d", km.topic, i)
+	if err := km.StopFetch(); err != nil {
+		return err
 	}
-	km.Logger.Infof("Topic(%s) stoped KafkaConsumer", km.topic)
+	return km.Close()
+}
 
-	km.wg.Wait()
+// StopFetch 停止所有consumer拉取消息并关闭outCh，consumer保持打开以便之后提交offset
+func (km *KafkaConsumerManager) StopFetch() error {
+	km.stopConsumers()
 
 	close(km.outCh) //非常重要
-	km.Logger.Infof("Topic(%s) closed(outCh)", km.topic)
+	km.Logger.Info("closed(outCh)")
 
 	return nil
 }
 
 func (km *KafkaConsumerManager) StopAndDoNotCloseChan() error {
-	km.Logger.Infof("Topic(%s) stop KafkaConsumer", km.topic)
+	km.stopConsumers()
+
+	return km.Close()
+}
+
+// Close 关闭所有consumer，提交已确认的offset
+func (km *KafkaConsumerManager) Close() error {
+	var closeErr error
+	for i := 0; i < km.cfg.Routines; i++ {
+		if err := km.kafkaConsumers[i].Close(); err != nil {
+			closeErr = err
+		}
+	}
+	km.Logger.Info("closed KafkaConsumer")
+
+	return closeErr
+}
+
+// Pending 所有consumer已拉取但未确认的消息数
+func (km *KafkaConsumerManager) Pending() int {
+	n := 0
+	for _, consumer := range km.kafkaConsumers {
+		n += consumer.Pending()
+	}
+	return n
+}
+
+func (km *KafkaConsumerManager) stopConsumers() {
+	km.stopOnce.Do(func() {
+		close(km.stopCh)
+	})
+	km.Logger.Info("stop KafkaConsumer")
 	for i := 0; i < km.cfg.Routines; i++ {
 		consumer := km.kafkaConsumers[i]
 		consumer.Stop()
-		km.Logger.Infof("Topic(%s) stop KafkaConsumer:%d", km.topic, i)
+		km.Logger.With(logging.Fields{"consumer": i}).Info("stop KafkaConsumer")
 	}
-	km.Logger.Infof("Topic(%s) stoped KafkaConsumer", km.topic)
+	km.Logger.Info("stoped KafkaConsumer")
 
 	km.wg.Wait()
-
-	return nil
 }
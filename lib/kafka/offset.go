@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets 一个partition已拉取但未提交的offset
+type partitionOffsets struct {
+	queue   []int64        // 按拉取顺序排列的未提交offset
+	fetched []time.Time    // queue中每个offset的拉取时间
+	acked   map[int64]bool // queue中已确认的offset
+}
+
+// offsetTracker 跟踪每个partition的消息确认情况，只提交连续确认的最大offset
+// 即某条消息未确认时，其后已确认的消息也不会提交，进程崩溃后会从未确认的消息重新消费
+type offsetTracker struct {
+	sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition]*partitionOffsets)}
+}
+
+// Add 记录一条已拉取的消息
+func (t *offsetTracker) Add(topic string, partition int32, offset int64) {
+	t.Lock()
+	defer t.Unlock()
+	tp := topicPartition{topic: topic, partition: partition}
+	p, ok := t.partitions[tp]
+	// offset回退说明partition被重新分配或重置，之前未确认的offset作废
+	if !ok || (len(p.queue) > 0 && offset <= p.queue[len(p.queue)-1]) {
+		p = &partitionOffsets{acked: make(map[int64]bool)}
+		t.partitions[tp] = p
+	}
+	p.queue = append(p.queue, offset)
+	p.fetched = append(p.fetched, time.Now())
+}
+
+// Ack 确认一条消息，返回可提交的offset；ok为false时无需提交
+func (t *offsetTracker) Ack(topic string, partition int32, offset int64) (commit int64, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	p, exists := t.partitions[topicPartition{topic: topic, partition: partition}]
+	if !exists || len(p.queue) == 0 || offset < p.queue[0] {
+		return 0, false
+	}
+	p.acked[offset] = true
+	for len(p.queue) > 0 && p.acked[p.queue[0]] {
+		commit = p.queue[0]
+		ok = true
+		delete(p.acked, commit)
+		p.queue = p.queue[1:]
+		p.fetched = p.fetched[1:]
+	}
+	return commit, ok
+}
+
+// Release partition被分配给其他消费者后，丢弃其未确认的offset
+func (t *offsetTracker) Release(topic string, partitions []int32) {
+	t.Lock()
+	defer t.Unlock()
+	for _, partition := range partitions {
+		delete(t.partitions, topicPartition{topic: topic, partition: partition})
+	}
+}
+
+// PartitionPending partition已拉取未提交的消息数
+func (t *offsetTracker) PartitionPending(topic string, partition int32) int {
+	t.Lock()
+	defer t.Unlock()
+	if p, ok := t.partitions[topicPartition{topic: topic, partition: partition}]; ok {
+		return len(p.queue)
+	}
+	return 0
+}
+
+// OldestAge 最早的未提交消息已拉取的时间，没有时为0
+// 持续增长说明有消息一直未确认，offset无法提交
+func (t *offsetTracker) OldestAge() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	var age time.Duration
+	now := time.Now()
+	for _, p := range t.partitions {
+		if len(p.fetched) > 0 && now.Sub(p.fetched[0]) > age {
+			age = now.Sub(p.fetched[0])
+		}
+	}
+	return age
+}
+
+// Pending 已拉取未提交的消息数
+func (t *offsetTracker) Pending() int {
+	t.Lock()
+	defer t.Unlock()
+	n := 0
+	for _, p := range t.partitions {
+		n += len(p.queue)
+	}
+	return n
+}
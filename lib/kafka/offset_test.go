@@ -0,0 +1,79 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOffsetTrackerAck(t *testing.T) {
+	tr := newOffsetTracker()
+	for _, offset := range []int64{10, 11, 12, 14} {
+		tr.Add("t1", 0, offset)
+	}
+
+	var tests = []struct {
+		ack    int64
+		commit int64
+		ok     bool
+	}{
+		{11, 0, false}, // 10 未确认
+		{12, 0, false},
+		{10, 12, true}, // 10,11,12 连续确认
+		{12, 0, false}, // 重复确认
+		{14, 14, true}, // offset 不连续(如compact)时按拉取顺序推进
+	}
+	for i, tt := range tests {
+		commit, ok := tr.Ack("t1", 0, tt.ack)
+		if commit != tt.commit || ok != tt.ok {
+			t.Errorf("case %d ack %d: actual (%d,%v) except (%d,%v)", i, tt.ack, commit, ok, tt.commit, tt.ok)
+		}
+	}
+	if n := tr.Pending(); n != 0 {
+		t.Errorf("pending %d except 0", n)
+	}
+}
+
+func TestOffsetTrackerPartitions(t *testing.T) {
+	tr := newOffsetTracker()
+	tr.Add("t1", 0, 1)
+	tr.Add("t1", 1, 1)
+	tr.Add("t2", 0, 1)
+
+	if _, ok := tr.Ack("t1", 1, 1); !ok {
+		t.Error("t1/1 should commit")
+	}
+	tr.Release("t2", []int32{0})
+	if _, ok := tr.Ack("t2", 0, 1); ok {
+		t.Error("released partition should not commit")
+	}
+
+	// 重新分配后offset回退
+	tr.Add("t1", 0, 0)
+	if commit, ok := tr.Ack("t1", 0, 0); !ok || commit != 0 {
+		t.Errorf("t1/0 actual (%d,%v) except (0,true)", commit, ok)
+	}
+	if n := tr.Pending(); n != 0 {
+		t.Errorf("pending %d except 0", n)
+	}
+}
+
+func TestOffsetTrackerAge(t *testing.T) {
+	tr := newOffsetTracker()
+	if tr.OldestAge() != 0 {
+		t.Error("empty tracker")
+	}
+	tr.Add("t1", 0, 1)
+	time.Sleep(20 * time.Millisecond)
+	tr.Add("t1", 0, 2)
+	tr.Add("t1", 1, 1)
+	if age := tr.OldestAge(); age < 20*time.Millisecond {
+		t.Errorf("age %s", age)
+	}
+	if n := tr.PartitionPending("t1", 0); n != 2 {
+		t.Errorf("t1/0 pending %d except 2", n)
+	}
+	tr.Ack("t1", 0, 1)
+	if age := tr.OldestAge(); age >= 20*time.Millisecond {
+		t.Errorf("age %s after ack", age)
+	}
+}
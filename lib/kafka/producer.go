@@ -0,0 +1,347 @@
+//Kafka生产者
+package kafka
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"process_data/config"
+	"process_data/lib/graphite"
+	"process_data/lib/logging"
+	"process_data/lib/rtm"
+)
+
+// 连不上broker时，每隔reconnectInterval重新创建一次producer
+var reconnectInterval = 30 * time.Second
+
+type KafkaProducer struct {
+	Logger logging.Logger
+	wg     *sync.WaitGroup
+
+	ID         int
+	cfg        *config.KafkaProducerConfig
+	inCh       config.KafkaProducerMsgCh
+	notifctnCh rtm.NotifctnCh
+	stopOnce   sync.Once
+
+	producer sarama.AsyncProducer // 为nil时消息全部写入本地文件
+
+	// ${topic}为topic名字中的. - 替换为下划线
+	metricTopicQPS   string // ${topic}.produce.qps
+	metricTopicError string // ${topic}.produce.error
+	metricTopicSpill string // ${topic}.produce.spill
+
+	topic string
+}
+
+func NewKafkaProducer(id int,
+	kcfg *config.KafkaProducerConfig,
+	lg logging.Logger,
+	ch config.KafkaProducerMsgCh) (*KafkaProducer, error) {
+
+	k := &KafkaProducer{
+		cfg:        kcfg,
+		Logger:     lg,
+		inCh:       ch,
+		ID:         id,
+		notifctnCh: make(rtm.NotifctnCh),
+	}
+	k.topic = k.cfg.Topics[0]
+
+	s := k.topic
+	s = strings.Replace(s, ".", "_", -1)
+	s = strings.Replace(s, "-", "_", -1)
+	k.metricTopicQPS = fmt.Sprintf("%s.produce.qps", s)
+	k.metricTopicError = fmt.Sprintf("%s.produce.error", s)
+	k.metricTopicSpill = fmt.Sprintf("%s.produce.spill", s)
+
+	if _, err := k.newSaramaConfig(); err != nil {
+		return nil, err
+	}
+	// broker不可达时不返回错误，先写本地文件，Start后定期重连
+	if err := k.connect(); err != nil {
+		k.Logger.Errorf("Topic(%s) KafkaProducer:%d connect failed, spill to %s: %s",
+			k.topic, k.ID, k.cfg.File.FileName, err)
+	}
+
+	return k, nil
+}
+
+func (k *KafkaProducer) newSaramaConfig() (*sarama.Config, error) {
+	sc := sarama.NewConfig()
+	sc.Producer.Return.Errors = true
+	sc.Producer.Return.Successes = true // 用于通知KafkaProducerMsg.Result
+
+	if len(k.cfg.Username) != 0 {
+		sc.Net.SASL.Enable = true
+		sc.Net.SASL.User = k.cfg.Username
+		sc.Net.SASL.Password = k.cfg.Password
+	}
+
+	if k.cfg.Timeout != nil {
+		timeout := *k.cfg.Timeout
+		sc.Net.DialTimeout = timeout
+		sc.Net.ReadTimeout = timeout
+		sc.Net.WriteTimeout = timeout
+	}
+
+	if k.cfg.KeepAlive != nil {
+		sc.Net.KeepAlive = *k.cfg.KeepAlive
+	}
+	if k.cfg.BrokerTimeout != nil {
+		sc.Producer.Timeout = *k.cfg.BrokerTimeout
+	}
+
+	if k.cfg.Metadata.Retry.Max != nil {
+		sc.Metadata.Retry.Max = *k.cfg.Metadata.Retry.Max
+	}
+	if k.cfg.Metadata.Retry.Backoff != nil {
+		sc.Metadata.Retry.Backoff = *k.cfg.Metadata.Retry.Backoff
+	}
+	if k.cfg.Metadata.RefreshFreq != nil {
+		sc.Metadata.RefreshFrequency = *k.cfg.Metadata.RefreshFreq
+	}
+
+	if k.cfg.MaxMessageBytes != nil {
+		sc.Producer.MaxMessageBytes = *k.cfg.MaxMessageBytes
+	}
+	if k.cfg.RequiredACKs != nil {
+		sc.Producer.RequiredAcks = sarama.RequiredAcks(*k.cfg.RequiredACKs)
+	}
+	if k.cfg.MaxRetries != nil {
+		retryMax := *k.cfg.MaxRetries
+		if retryMax >= 0 {
+			sc.Producer.Retry.Max = retryMax
+		}
+	}
+	if k.cfg.RetryBackoff != nil {
+		sc.Producer.Retry.Backoff = *k.cfg.RetryBackoff
+	}
+	sc.Producer.Compression = k.cfg.CompressionMode
+	if k.cfg.CompressionLevel != nil {
+		sc.Producer.CompressionLevel = *k.cfg.CompressionLevel
+	}
+
+	sc.ClientID = k.cfg.ClientID
+
+	if err := sc.Validate(); err != nil {
+		k.Logger.Errorf("Topic(%s) Invalid kafka configuration: %v", k.topic, err)
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// connect 创建sarama async producer
+func (k *KafkaProducer) connect() error {
+	sc, err := k.newSaramaConfig()
+	if err != nil {
+		return err
+	}
+	producer, err := sarama.NewAsyncProducer(k.cfg.Hosts, sc)
+	if err != nil {
+		return err
+	}
+	k.producer = producer
+	return nil
+}
+
+// errors producer为nil时返回nil chan，select时永远阻塞
+func (k *KafkaProducer) errors() <-chan *sarama.ProducerError {
+	if k.producer == nil {
+		return nil
+	}
+	return k.producer.Errors()
+}
+
+func (k *KafkaProducer) successes() <-chan *sarama.ProducerMessage {
+	if k.producer == nil {
+		return nil
+	}
+	return k.producer.Successes()
+}
+
+func (k *KafkaProducer) Start(wg *sync.WaitGroup) {
+	k.Logger.Infof("Topic(%s) KafkaProducer:%d started", k.topic, k.ID)
+	k.wg = wg
+
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-k.inCh:
+			if !ok {
+				k.Logger.Errorf("Topic(%s) KafkaProducer:%d message channel be closed", k.topic, k.ID)
+				k.stop()
+				return
+			}
+			k.send(msg)
+
+		case perr, ok := <-k.errors():
+			if ok {
+				k.produceError(perr)
+			}
+
+		case pm, ok := <-k.successes():
+			if ok {
+				reply(pm, nil)
+			}
+
+		case <-ticker.C:
+			if k.producer != nil {
+				continue
+			}
+			if err := k.connect(); err != nil {
+				k.Logger.Errorf("Topic(%s) KafkaProducer:%d reconnect failed: %s", k.topic, k.ID, err)
+				continue
+			}
+			k.Logger.Infof("Topic(%s) KafkaProducer:%d reconnected", k.topic, k.ID)
+
+		case n, ok := <-k.notifctnCh:
+			k.Logger.Errorf("Topic(%s) KafkaProducer:%d (%d,%v) stoping", k.topic, k.ID, n, ok)
+			k.drain()
+			k.stop()
+			return
+		}
+	}
+}
+
+func (k *KafkaProducer) send(msg *config.KafkaProducerMsg) {
+	if k.producer == nil {
+		err := k.spill(msg.Value)
+		if msg.Result != nil {
+			msg.Result <- err
+		}
+		return
+	}
+	topic := msg.Topic
+	if len(topic) == 0 {
+		topic = k.topic
+	}
+	pm := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(msg.Value), Metadata: msg}
+	if msg.Key != nil {
+		pm.Key = sarama.ByteEncoder(msg.Key)
+	}
+	// 等待Input时继续读取Errors与Successes，否则broker不可用时sarama阻塞在写Errors上，Input不再可写
+	for {
+		select {
+		case k.producer.Input() <- pm:
+			graphite.Add(k.metricTopicQPS, 1)
+			return
+		case perr := <-k.producer.Errors():
+			k.produceError(perr)
+		case pm := <-k.producer.Successes():
+			reply(pm, nil)
+		}
+	}
+}
+
+// produceError 发送失败的消息写入本地文件
+func (k *KafkaProducer) produceError(perr *sarama.ProducerError) {
+	k.Logger.Errorf("Topic(%s) KafkaProducer:%d produce Erros: %+v", k.topic, k.ID, perr.Err)
+	graphite.Add(k.metricTopicError, 1)
+	err := k.spillProducerMessage(perr.Msg)
+	if err != nil {
+		err = fmt.Errorf("produce: %s, spill: %s", perr.Err, err)
+	}
+	reply(perr.Msg, err)
+}
+
+// reply 通知消息的发送结果
+func reply(pm *sarama.ProducerMessage, err error) {
+	if pm == nil {
+		return
+	}
+	if msg, ok := pm.Metadata.(*config.KafkaProducerMsg); ok && msg.Result != nil {
+		msg.Result <- err
+	}
+}
+
+// drain 停止前将chan中剩余的消息发送完
+func (k *KafkaProducer) drain() {
+	for {
+		select {
+		case msg, ok := <-k.inCh:
+			if !ok {
+				return
+			}
+			k.send(msg)
+		default:
+			return
+		}
+	}
+}
+
+func (k *KafkaProducer) spillProducerMessage(pm *sarama.ProducerMessage) error {
+	if pm == nil || pm.Value == nil {
+		return nil
+	}
+	b, err := pm.Value.Encode()
+	if err != nil {
+		k.Logger.Errorf("Topic(%s) KafkaProducer:%d encode failed: %s", k.topic, k.ID, err)
+		return err
+	}
+	return k.spill(b)
+}
+
+// spill 发送失败的消息写入本地文件，每行一条
+func (k *KafkaProducer) spill(b []byte) error {
+	graphite.Add(k.metricTopicSpill, 1)
+	line := make([]byte, 0, len(b)+1)
+	line = append(line, b...)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line = append(line, '\n')
+	}
+	if _, err := k.cfg.File.Write(line); err != nil {
+		k.Logger.Errorf("Topic(%s) KafkaProducer:%d spill failed: %s", k.topic, k.ID, err)
+		return err
+	}
+	return nil
+}
+
+func (k *KafkaProducer) stop() error {
+	defer func() {
+		if k.wg != nil {
+			k.wg.Done()
+		}
+	}()
+	if k.producer == nil {
+		return nil
+	}
+	// AsyncClose后需读完Errors与Successes，失败的消息写入本地文件
+	k.producer.AsyncClose()
+	errs, succs := k.producer.Errors(), k.producer.Successes()
+	for errs != nil || succs != nil {
+		select {
+		case perr, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			k.produceError(perr)
+		case pm, ok := <-succs:
+			if !ok {
+				succs = nil
+				continue
+			}
+			reply(pm, nil)
+		}
+	}
+
+	k.Logger.Infof("Topic(%s) KafkaProducer:%d stoped", k.topic, k.ID)
+
+	return nil
+}
+
+// Stop 通知producer停止，可以多次调用，producer已退出时不阻塞
+func (k *KafkaProducer) Stop() error {
+	k.stopOnce.Do(func() {
+		close(k.notifctnCh)
+	})
+	return nil
+}
@@ -0,0 +1,82 @@
+//Kafka生产者
+package kafka
+
+import (
+	"sync"
+
+	"process_data/config"
+	"process_data/lib/logging"
+)
+
+type KafkaProducerManager struct {
+	Logger logging.Logger
+	wg     sync.WaitGroup
+
+	cfg            *config.KafkaProducerConfig
+	inCh           config.KafkaProducerMsgCh
+	kafkaProducers []*KafkaProducer
+
+	topic string
+}
+
+func NewKafkaProducerManager(
+	kcfg *config.KafkaProducerConfig,
+	lg logging.Logger,
+	ch config.KafkaProducerMsgCh) (*KafkaProducerManager, error) {
+	km := &KafkaProducerManager{
+		cfg:    kcfg,
+		Logger: lg,
+		inCh:   ch,
+	}
+	km.topic = km.cfg.Topics[0]
+
+	return km, nil
+}
+
+func (km *KafkaProducerManager) Init() error {
+	if err := km.cfg.File.Open(); err != nil {
+		km.Logger.Errorf("Topic(%s) open local_file fail: %s", km.topic, err)
+		return err
+	}
+	km.kafkaProducers = make([]*KafkaProducer, km.cfg.Routines)
+	for i := 0; i < km.cfg.Routines; i++ {
+		producer, err := NewKafkaProducer(
+			i,
+			km.cfg,
+			km.Logger,
+			km.inCh)
+		if err != nil {
+			km.Logger.Errorf("Topic(%s) initKafkaProducer fail: %s", km.topic, err)
+			return err
+		}
+		km.kafkaProducers[i] = producer
+	}
+	km.Logger.Infof("Topic(%s) init KafkaProducer success", km.topic)
+
+	return nil
+}
+
+func (km *KafkaProducerManager) Start() error {
+	for i := 0; i < km.cfg.Routines; i++ {
+		km.wg.Add(1)
+		producer := km.kafkaProducers[i]
+		go producer.Start(&km.wg)
+	}
+	return nil
+}
+
+// Stop 停止所有producer，chan中剩余的消息会先发送，发送失败的写入本地文件
+// 调用前需保证不再向chan写入消息
+func (km *KafkaProducerManager) Stop() error {
+	km.Logger.Infof("Topic(%s) stop KafkaProducer", km.topic)
+	for i := 0; i < km.cfg.Routines; i++ {
+		producer := km.kafkaProducers[i]
+		producer.Stop()
+		km.Logger.Infof("Topic(%s) stop KafkaProducer:%d", km.topic, i)
+	}
+	km.Logger.Infof("Topic(%s) stoped KafkaProducer", km.topic)
+
+	km.wg.Wait()
+
+	return nil
+}
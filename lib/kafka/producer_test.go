@@ -0,0 +1,179 @@
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"process_data/config"
+	"process_data/lib/logging"
+)
+
+// broker不可达时消息写入local_file
+func TestKafkaProducerSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process_data_producer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	retryMax := 0
+	cfg := &config.KafkaProducerConfig{
+		KafkaConfig: config.KafkaConfig{Hosts: []string{"127.0.0.1:1"}},
+		Topics:      []string{"spill_test"},
+		File:        &logging.LogFile{FileName: "spill.txt", LogPath: dir},
+	}
+	cfg.Metadata.Retry.Max = &retryMax
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(config.KafkaProducerMsgCh, 10)
+	kpm, err := NewKafkaProducerManager(cfg, logging.DefaultLogger(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kpm.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ch <- &config.KafkaProducerMsg{Value: []byte("m1")}
+	ch <- &config.KafkaProducerMsg{Value: []byte("m2\n")}
+	kpm.Start()
+	kpm.Stop()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "spill-*.txt"))
+	if len(files) != 1 {
+		t.Fatalf("spill files %v", files)
+	}
+	b, _ := ioutil.ReadFile(files[0])
+	if string(b) != "m1\nm2\n" {
+		t.Errorf("spill file %q", b)
+	}
+}
+
+// 启动后broker不可用，发送失败的消息写入local_file，不阻塞在Input上；Stop可以重复调用
+func TestKafkaProducerBrokerDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process_data_producer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("down_test", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	retryMax := 0
+	cfg := &config.KafkaProducerConfig{
+		KafkaConfig: config.KafkaConfig{Hosts: []string{broker.Addr()}, MaxRetries: &retryMax},
+		Topics:      []string{"down_test"},
+		File:        &logging.LogFile{FileName: "spill.txt", LogPath: dir},
+	}
+	backoff := time.Millisecond
+	cfg.Metadata.Retry.Max = &retryMax
+	cfg.Metadata.Retry.Backoff = &backoff
+	cfg.RetryBackoff = &backoff
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(config.KafkaProducerMsgCh)
+	kpm, err := NewKafkaProducerManager(cfg, logging.DefaultLogger(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kpm.Init(); err != nil {
+		t.Fatal(err)
+	}
+	kpm.Start()
+	broker.Close()
+
+	// 超过sarama Errors的缓冲，旧的实现在此死锁
+	const n = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			ch <- &config.KafkaProducerMsg{Value: []byte(fmt.Sprintf("m%d", i))}
+		}
+		kpm.Stop()
+		kpm.kafkaProducers[0].Stop()
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("producer blocked after broker down")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "spill-*.txt"))
+	lines := 0
+	for _, f := range files {
+		b, _ := ioutil.ReadFile(f)
+		lines += bytes.Count(b, []byte("\n"))
+	}
+	if lines != n {
+		t.Errorf("%d messages spilled, except %d", lines, n)
+	}
+}
+
+// 设置Result时，kafka确认或写入local_file后通知发送结果
+func TestKafkaProducerResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process_data_producer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("result_test", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3), // 同sarama.DefaultVersion的ProduceRequest
+	})
+	cfg := &config.KafkaProducerConfig{
+		KafkaConfig: config.KafkaConfig{Hosts: []string{broker.Addr()}},
+		Topics:      []string{"result_test"},
+		File:        &logging.LogFile{FileName: "spill.txt", LogPath: dir},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(config.KafkaProducerMsgCh)
+	kpm, err := NewKafkaProducerManager(cfg, logging.DefaultLogger(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kpm.Init(); err != nil {
+		t.Fatal(err)
+	}
+	kpm.Start()
+	defer kpm.Stop()
+
+	result := make(chan error, 1)
+	ch <- &config.KafkaProducerMsg{Value: []byte("m1"), Result: result}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no result")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "spill-*.txt"))
+	for _, f := range files {
+		if b, _ := ioutil.ReadFile(f); len(b) != 0 {
+			t.Errorf("message acknowledged by kafka should not be spilled: %q", b)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package logging
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	ltime "process_data/lib/time"
+)
+
+// FreqLogPoolConfig [freq_log] FreqLog文件句柄池
+type FreqLogPoolConfig struct {
+	BufferSize    int            `toml:"buffer_size" json:"buffer_size"`       // 每个文件的写缓冲，default 256KB
+	FlushInterval ltime.Duration `toml:"flush_interval" json:"flush_interval"` // default 1s
+	MaxOpenFiles  int            `toml:"max_open_files" json:"max_open_files"` // 超过时关闭最久未写入的文件，default 1024
+	IdleTimeout   ltime.Duration `toml:"idle_timeout" json:"idle_timeout"`     // 超过时间未写入的文件被关闭，如小时切换后的旧文件，default 5m
+	MaxBytes      int64          `toml:"max_bytes" json:"max_bytes"`           // 文件超过大小时切分为 N_pvlog.1.txt、N_pvlog.2.txt...，0不限制
+
+	// 目录超过seal_delay未写入后封存：压缩目录中的文件，再写入marker文件；仅处理path_template生成的目录
+	SealDelay     ltime.Duration `toml:"seal_delay" json:"seal_delay"`         // 0不封存(default)，不小于idle_timeout
+	Compress      string         `toml:"compress" json:"compress"`             // 封存时的压缩: none(default), gzip, zstd
+	Marker        string         `toml:"marker" json:"marker"`                 // default "_SUCCESS"
+	RetentionDays int            `toml:"retention_days" json:"retention_days"` // 删除超过N天未写入的目录，0不删除
+	ScanInterval  ltime.Duration `toml:"scan_interval" json:"scan_interval"`   // 检查封存与过期目录的间隔，default 1m
+}
+
+func (c *FreqLogPoolConfig) Validate() error {
+	if c.BufferSize <= 0 {
+		c.BufferSize = 256 * 1024
+	}
+	if c.FlushInterval.Duration <= 0 {
+		c.FlushInterval.Duration = time.Second
+	}
+	if c.MaxOpenFiles <= 0 {
+		c.MaxOpenFiles = 1024
+	}
+	if c.IdleTimeout.Duration <= 0 {
+		c.IdleTimeout.Duration = 5 * time.Minute
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("freq_log.max_bytes must not be negative")
+	}
+	if c.SealDelay.Duration < 0 {
+		return fmt.Errorf("freq_log.seal_delay must not be negative")
+	}
+	if c.SealDelay.Duration > 0 && c.SealDelay.Duration < c.IdleTimeout.Duration {
+		return fmt.Errorf("freq_log.seal_delay(%s) must not be less than idle_timeout(%s)", c.SealDelay.Duration, c.IdleTimeout.Duration)
+	}
+	switch c.Compress {
+	case "":
+		c.Compress = CompressNone
+	case CompressNone, CompressGzip, CompressZstd:
+	default:
+		return fmt.Errorf("freq_log.compress %q is invalid, must be one of none, gzip, zstd", c.Compress)
+	}
+	if len(c.Marker) == 0 {
+		c.Marker = "_SUCCESS"
+	}
+	if c.RetentionDays < 0 {
+		return fmt.Errorf("freq_log.retention_days must not be negative")
+	}
+	if c.ScanInterval.Duration <= 0 {
+		c.ScanInterval.Duration = time.Minute
+	}
+	return nil
+}
+
+// ScanEnabled 配置了seal_delay或retention_days时定期扫描目录
+func (c *FreqLogPoolConfig) ScanEnabled() bool {
+	return c.SealDelay.Duration > 0 || c.RetentionDays > 0
+}
+
+// ErrFreqLogPoolClosed 句柄池已关闭
+var ErrFreqLogPoolClosed = errors.New("freq log pool closed")
+
+// FreqLogPool 进程内共享的FreqLog文件句柄池，按完整路径复用打开的文件
+// 同一文件的写入串行，缓冲的数据每隔flush_interval及Close时写入文件
+// WriteAck的ack在数据写入文件(Flush成功)后才调用，写入失败的数据不确认
+// 配置了seal_delay或retention_days时定期封存root下空闲的目录并删除过期目录
+type FreqLogPool struct {
+	cfg     FreqLogPoolConfig
+	root    string
+	dirRe   *regexp.Regexp // 封存与删除的目录，匹配相对root的路径
+	onError func(path string, err error, unacked int)
+	mu      sync.Mutex
+	cond    *sync.Cond               // 等待目录封存完成
+	files   map[string]*list.Element // 路径 -> lru中的*pooledFile
+	lru     *list.List               // 最近写入的在前
+	dirs    map[string]int           // 目录 -> 打开的文件数，含正在打开和关闭的
+	opening map[string]*openCall     // 正在打开的文件
+	sealing map[string]bool          // 正在封存或删除的目录，期间不能打开其中的文件
+	closed  bool
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+type pooledFile struct {
+	path      string
+	mu        sync.Mutex
+	f         *os.File
+	w         *bufio.Writer
+	size      int64 // 文件大小，含缓冲中的数据
+	lastWrite time.Time
+	closed    bool     // 已被淘汰或关闭，持有者需重新获取
+	acks      []func() // 缓冲中的数据对应的ack，写入文件后调用
+}
+
+// NewFreqLogPool 创建句柄池并启动定时刷新，root为FreqLog的根目录
+// dirRe匹配root下可以封存与删除的目录(相对root，/分隔)，root或dirRe为空时不扫描
+func NewFreqLogPool(root string, dirRe *regexp.Regexp, cfg *FreqLogPoolConfig) *FreqLogPool {
+	c := *cfg
+	c.Validate()
+	p := &FreqLogPool{
+		cfg:     c,
+		root:    root,
+		dirRe:   dirRe,
+		files:   map[string]*list.Element{},
+		lru:     list.New(),
+		dirs:    map[string]int{},
+		opening: map[string]*openCall{},
+		sealing: map[string]bool{},
+		stopCh:  make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.wg.Add(1)
+	go p.flushLoop()
+	if p.scanning() {
+		p.wg.Add(1)
+		go p.scanLoop()
+	}
+	return p
+}
+
+// SetErrorHandler 设置写入文件(Flush、切分、淘汰、关闭)失败时的回调，unacked为因此不会被确认的行数
+// 写入失败的文件从池中移除，下次写入时重新打开
+func (p *FreqLogPool) SetErrorHandler(fn func(path string, err error, unacked int)) {
+	p.mu.Lock()
+	p.onError = fn
+	p.mu.Unlock()
+}
+
+func (p *FreqLogPool) reportError(path string, err error, unacked int) {
+	p.mu.Lock()
+	fn := p.onError
+	p.mu.Unlock()
+	if fn != nil {
+		fn(path, err, unacked)
+	}
+}
+
+// Write 向dir/name追加一行，目录不存在时创建
+func (p *FreqLogPool) Write(dir, name string, b []byte) error {
+	return p.WriteAck(dir, name, b, nil)
+}
+
+// WriteAck 同Write，该行写入文件后调用ack；写入文件失败时不调用
+func (p *FreqLogPool) WriteAck(dir, name string, b []byte, ack func()) error {
+	path := filepath.Join(dir, name)
+	for {
+		pf, err := p.get(path)
+		if err != nil {
+			return err
+		}
+		pf.mu.Lock()
+		if pf.closed {
+			pf.mu.Unlock()
+			continue
+		}
+		n := int64(len(b))
+		if n == 0 || b[n-1] != '\n' {
+			n++
+		}
+		var acks []func()
+		if p.cfg.MaxBytes > 0 && pf.size > 0 && pf.size+n > p.cfg.MaxBytes {
+			if acks, err = pf.rotate(p.cfg.BufferSize); err != nil {
+				pf.mu.Unlock()
+				runAcks(acks)
+				p.discard(pf)
+				return err
+			}
+		}
+		_, err = pf.w.Write(b)
+		if err == nil && n > int64(len(b)) {
+			err = pf.w.WriteByte('\n')
+		}
+		if err == nil && ack != nil {
+			pf.acks = append(pf.acks, ack)
+		}
+		pf.size += n
+		pf.lastWrite = time.Now()
+		pf.mu.Unlock()
+		runAcks(acks)
+		return err
+	}
+}
+
+func runAcks(acks []func()) {
+	for _, ack := range acks {
+		ack()
+	}
+}
+
+// discard 写入文件失败，从池中移除并关闭pf，缓冲中的数据及其ack被丢弃，由closeFile报告
+// pf已被移除时由移除方关闭
+func (p *FreqLogPool) discard(pf *pooledFile) {
+	p.mu.Lock()
+	e, ok := p.files[pf.path]
+	found := ok && e.Value.(*pooledFile) == pf
+	if found {
+		p.removeLocked(e)
+	}
+	p.mu.Unlock()
+	if found {
+		p.closeFile(pf)
+	}
+}
+
+// openCall 正在打开的文件，同一路径只由一个goroutine打开，其余等待结果
+type openCall struct {
+	done chan struct{}
+	err  error
+}
+
+// get 获取打开的文件，超过max_open_files时关闭最久未写入的文件
+// 打开与关闭文件不持有p.mu，不阻塞其他文件的写入
+func (p *FreqLogPool) get(path string) (*pooledFile, error) {
+	dir := filepath.Dir(path)
+	p.mu.Lock()
+	for {
+		for p.sealing[dir] && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrFreqLogPoolClosed
+		}
+		if e, ok := p.files[path]; ok {
+			p.lru.MoveToFront(e)
+			p.mu.Unlock()
+			return e.Value.(*pooledFile), nil
+		}
+		c, ok := p.opening[path]
+		if !ok {
+			break
+		}
+		p.mu.Unlock()
+		<-c.done
+		if c.err != nil {
+			return nil, c.err
+		}
+		p.mu.Lock()
+	}
+	// 打开前计入目录的打开文件数，打开期间目录不会被封存
+	removeMarker := p.dirs[dir] == 0 && p.scanning()
+	p.dirs[dir]++
+	c := &openCall{done: make(chan struct{})}
+	p.opening[path] = c
+	p.mu.Unlock()
+
+	pf, err := p.open(path, removeMarker)
+
+	p.mu.Lock()
+	delete(p.opening, path)
+	if err == nil && p.closed {
+		pf.close()
+		pf, err = nil, ErrFreqLogPoolClosed
+	}
+	c.err = err
+	close(c.done)
+	if err != nil {
+		p.releaseDirLocked(dir)
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.files[path] = p.lru.PushFront(pf)
+	var evicted []*pooledFile
+	for p.lru.Len() > p.cfg.MaxOpenFiles {
+		evicted = append(evicted, p.removeLocked(p.lru.Back()))
+	}
+	p.mu.Unlock()
+
+	for _, e := range evicted {
+		p.closeFile(e)
+	}
+	return pf, nil
+}
+
+// open 打开文件，目录不存在时创建
+func (p *FreqLogPool) open(path string, removeMarker bool) (*pooledFile, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// 已封存的目录有迟到的数据，删除marker，空闲后重新封存
+	if removeMarker {
+		os.Remove(filepath.Join(dir, p.cfg.Marker))
+	}
+	return &pooledFile{path: path, f: f, w: bufio.NewWriterSize(f, p.cfg.BufferSize), size: st.Size(), lastWrite: time.Now()}, nil
+}
+
+// removeLocked 从池中移除文件，需持有p.mu；调用方在释放p.mu后调用closeFile
+func (p *FreqLogPool) removeLocked(e *list.Element) *pooledFile {
+	pf := p.lru.Remove(e).(*pooledFile)
+	delete(p.files, pf.path)
+	return pf
+}
+
+// closeFile 关闭已从池中移除的文件，失败时通过回调报告；关闭后目录才可以被封存
+func (p *FreqLogPool) closeFile(pf *pooledFile) error {
+	unacked, err := pf.close()
+	if err != nil {
+		p.reportError(pf.path, err, unacked)
+	}
+	p.mu.Lock()
+	p.releaseDirLocked(filepath.Dir(pf.path))
+	p.mu.Unlock()
+	return err
+}
+
+func (p *FreqLogPool) releaseDirLocked(dir string) {
+	if p.dirs[dir]--; p.dirs[dir] <= 0 {
+		delete(p.dirs, dir)
+	}
+}
+
+// flushLocked 写入缓冲，成功时返回已写入数据的ack，需持有pf.mu
+func (pf *pooledFile) flushLocked() ([]func(), error) {
+	if err := pf.w.Flush(); err != nil {
+		return nil, err
+	}
+	acks := pf.acks
+	pf.acks = nil
+	return acks, nil
+}
+
+// rotate 将当前文件改名为下一个序号的文件，重新打开空文件，需持有pf.mu
+// 返回已写入数据的ack，由调用方在释放pf.mu后调用
+func (pf *pooledFile) rotate(bufferSize int) ([]func(), error) {
+	acks, err := pf.flushLocked()
+	if err != nil {
+		return nil, err
+	}
+	if err := pf.f.Close(); err != nil {
+		return nil, err
+	}
+	// 已关闭的文件中的数据已写入，之后失败也不影响这些ack
+	if err := os.Rename(pf.path, rotatedName(pf.path)); err != nil {
+		pf.closed = true
+		return acks, err
+	}
+	f, err := os.OpenFile(pf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		// 文件已关闭，标记为closed以便下次写入时重新打开
+		pf.closed = true
+		return acks, err
+	}
+	pf.f = f
+	pf.w = bufio.NewWriterSize(f, bufferSize)
+	pf.size = 0
+	return acks, nil
+}
+
+// close 写入缓冲并关闭文件，成功写入的数据的ack在返回前调用
+// 返回错误时unacked为未确认的行数
+func (pf *pooledFile) close() (unacked int, err error) {
+	pf.mu.Lock()
+	if pf.closed {
+		unacked = len(pf.acks)
+		pf.acks = nil
+		pf.mu.Unlock()
+		return unacked, nil
+	}
+	pf.closed = true
+	acks, err := pf.flushLocked()
+	if cerr := pf.f.Close(); err == nil && cerr != nil {
+		// 数据已写入，关闭失败不影响ack
+		err = cerr
+	}
+	unacked = len(pf.acks)
+	pf.acks = nil
+	pf.mu.Unlock()
+	runAcks(acks)
+	return unacked, err
+}
+
+func (pf *pooledFile) flush() error {
+	pf.mu.Lock()
+	if pf.closed {
+		pf.mu.Unlock()
+		return nil
+	}
+	acks, err := pf.flushLocked()
+	pf.mu.Unlock()
+	runAcks(acks)
+	return err
+}
+
+// Len 打开的文件数
+func (p *FreqLogPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
+
+// Flush 将所有文件的缓冲写入文件并调用ack，关闭空闲超过idle_timeout的文件
+// 写入失败的文件从池中移除并通过SetErrorHandler的回调报告，返回最后一个错误
+func (p *FreqLogPool) Flush() error {
+	p.mu.Lock()
+	files := make([]*pooledFile, 0, p.lru.Len())
+	var idle []*pooledFile
+	deadline := time.Now().Add(-p.cfg.IdleTimeout.Duration)
+	for e := p.lru.Back(); e != nil; {
+		pf := e.Value.(*pooledFile)
+		prev := e.Prev()
+		pf.mu.Lock()
+		isIdle := pf.lastWrite.Before(deadline)
+		pf.mu.Unlock()
+		if isIdle {
+			idle = append(idle, p.removeLocked(e))
+		} else {
+			files = append(files, pf)
+		}
+		e = prev
+	}
+	p.mu.Unlock()
+
+	var err error
+	for _, pf := range idle {
+		if cerr := p.closeFile(pf); cerr != nil {
+			err = cerr
+		}
+	}
+	for _, pf := range files {
+		if ferr := pf.flush(); ferr != nil {
+			p.discard(pf)
+			err = ferr
+		}
+	}
+	return err
+}
+
+func (p *FreqLogPool) flushLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.FlushInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// 错误已通过回调报告
+			p.Flush()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// Close 停止定时刷新，写入缓冲并关闭所有文件，之后的Write返回ErrFreqLogPoolClosed
+func (p *FreqLogPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	close(p.stopCh)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	files := make([]*pooledFile, 0, p.lru.Len())
+	for p.lru.Len() > 0 {
+		files = append(files, p.removeLocked(p.lru.Back()))
+	}
+	p.mu.Unlock()
+
+	var err error
+	for _, pf := range files {
+		if cerr := p.closeFile(pf); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,350 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	ltime "process_data/lib/time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestFreqLogPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewFreqLogPool("", nil, &FreqLogPoolConfig{MaxOpenFiles: 2, FlushInterval: ltime.Duration{Duration: time.Hour}})
+	// 多个worker并发写同一文件，每行完整
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				line := bytes.Repeat([]byte{byte('a' + i)}, 100)
+				if err := p.Write(dir+"/2019-01-13/01/", "0_pvlog.txt", line); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	fname := filepath.Join(dir, "2019-01-13/01/0_pvlog.txt")
+	if b, _ := ioutil.ReadFile(fname); len(b) != 0 {
+		t.Errorf("buffered data written before flush: %d bytes", len(b))
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+	if len(lines) != 1600 {
+		t.Fatalf("%d lines, except 1600", len(lines))
+	}
+	for _, l := range lines {
+		if len(l) != 100 || bytes.Count(l, l[:1]) != 100 {
+			t.Fatalf("interleaved line %q", l)
+		}
+	}
+
+	// 超过max_open_files时淘汰最久未写入的文件，淘汰时写入缓冲
+	for i := 1; i <= 2; i++ {
+		if err := p.Write(dir, fmt.Sprintf("%d_pvlog.txt", i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.Len() != 2 {
+		t.Errorf("%d open files, except 2", p.Len())
+	}
+	p.Write(dir+"/2019-01-13/01/", "0_pvlog.txt", []byte("y"))
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "1_pvlog.txt")); string(b) != "x\n" {
+		t.Errorf("evicted file content %q", b)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(fname); !bytes.HasSuffix(b, []byte("\ny\n")) {
+		t.Error("Close should flush buffered data")
+	}
+	if err := p.Write(dir, "0_pvlog.txt", []byte("z")); err != ErrFreqLogPoolClosed {
+		t.Errorf("write after close: %v", err)
+	}
+}
+
+// 并发打开与淘汰文件，淘汰的文件在释放锁后关闭，数据不丢失
+func TestFreqLogPoolEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewFreqLogPool("", nil, &FreqLogPoolConfig{MaxOpenFiles: 2, FlushInterval: ltime.Duration{Duration: time.Hour}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("%d_pvlog.txt", (i+j)%4)
+				if err := p.Write(fmt.Sprintf("%s/%d/", dir, j%3), name, []byte("x")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n += int(info.Size()) / 2
+		}
+		return nil
+	})
+	if n != 400 {
+		t.Errorf("%d lines, except 400", n)
+	}
+	if len(p.dirs) != 0 || len(p.opening) != 0 {
+		t.Errorf("dirs %v opening %v after close", p.dirs, p.opening)
+	}
+}
+
+// ack在缓冲写入文件后调用，写入失败时不调用
+func TestFreqLogPoolAck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewFreqLogPool("", nil, &FreqLogPoolConfig{FlushInterval: ltime.Duration{Duration: time.Hour}})
+	defer p.Close()
+	var failed []string
+	p.SetErrorHandler(func(path string, err error, unacked int) {
+		failed = append(failed, fmt.Sprintf("%s %d", filepath.Base(path), unacked))
+	})
+	acked := 0
+	ack := func() { acked++ }
+	p.WriteAck(dir, "0_pvlog.txt", []byte("a"), ack)
+	p.WriteAck(dir, "0_pvlog.txt", []byte("b"), ack)
+	if acked != 0 {
+		t.Fatalf("acked %d before flush", acked)
+	}
+	if err := p.Flush(); err != nil || acked != 2 {
+		t.Fatalf("acked %d: %v", acked, err)
+	}
+
+	// 文件写入失败，缓冲中的数据不确认，文件从池中移除
+	p.WriteAck(dir, "1_pvlog.txt", []byte("c"), ack)
+	p.mu.Lock()
+	p.files[filepath.Join(dir, "1_pvlog.txt")].Value.(*pooledFile).f.Close()
+	p.mu.Unlock()
+	if err := p.Flush(); err == nil {
+		t.Fatal("except flush error")
+	}
+	if acked != 2 || len(failed) != 1 || failed[0] != "1_pvlog.txt 1" || p.Len() != 1 {
+		t.Fatalf("acked %d failed %v open %d", acked, failed, p.Len())
+	}
+	// 重新打开后可以继续写入
+	p.WriteAck(dir, "1_pvlog.txt", []byte("d"), ack)
+	if err := p.Close(); err != nil || acked != 3 {
+		t.Fatalf("acked %d: %v", acked, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "1_pvlog.txt")); string(b) != "d\n" {
+		t.Errorf("%q", b)
+	}
+}
+
+func TestFreqLogPoolIdle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewFreqLogPool("", nil, &FreqLogPoolConfig{
+		FlushInterval: ltime.Duration{Duration: 10 * time.Millisecond},
+		IdleTimeout:   ltime.Duration{Duration: 50 * time.Millisecond},
+	})
+	defer p.Close()
+	if err := p.Write(dir, "0_pvlog.txt", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Len() != 0 {
+		t.Error("idle file should be closed")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "0_pvlog.txt")); string(b) != "x\n" {
+		t.Errorf("content %q", b)
+	}
+}
+
+func TestFreqLogPoolRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewFreqLogPool("", nil, &FreqLogPoolConfig{MaxBytes: 25, FlushInterval: ltime.Duration{Duration: time.Hour}})
+	for i := 0; i < 5; i++ {
+		if err := p.Write(dir, "0_pvlog.txt", []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+	// 每个文件最多2行
+	for name, size := range map[string]int64{"0_pvlog.1.txt": 22, "0_pvlog.2.txt": 22, "0_pvlog.txt": 11} {
+		if st, err := os.Stat(filepath.Join(dir, name)); err != nil || st.Size() != size {
+			t.Errorf("%s: %v %v", name, st, err)
+		}
+	}
+}
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFreqLogPoolSeal(t *testing.T) {
+	root, err := ioutil.TempDir("", "freqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	p := NewFreqLogPool(root, regexp.MustCompile(`^\d{4}-\d{2}-\d{2}/\d{2}$`), &FreqLogPoolConfig{
+		FlushInterval: ltime.Duration{Duration: time.Hour},
+		IdleTimeout:   ltime.Duration{Duration: 10 * time.Millisecond},
+		SealDelay:     ltime.Duration{Duration: 20 * time.Millisecond},
+		ScanInterval:  ltime.Duration{Duration: time.Hour},
+		Compress:      CompressGzip,
+		RetentionDays: 1,
+	})
+	defer p.Close()
+	hour := filepath.Join(root, "2019-01-13", "01")
+	p.Write(hour, "0_pvlog.txt", []byte("a"))
+
+	// 有打开的文件时不封存
+	time.Sleep(30 * time.Millisecond)
+	p.Scan()
+	if fileExists(filepath.Join(hour, "_SUCCESS")) {
+		t.Fatal("dir with open files should not be sealed")
+	}
+	p.Flush() // 关闭空闲文件时写入缓冲
+	time.Sleep(30 * time.Millisecond)
+	if err := p.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(hour, "_SUCCESS")) || fileExists(filepath.Join(hour, "0_pvlog.txt")) {
+		t.Fatal("dir should be sealed")
+	}
+	if s := readGzip(t, filepath.Join(hour, "0_pvlog.txt.gz")); s != "a\n" {
+		t.Errorf("content %q", s)
+	}
+
+	// 迟到的数据删除marker，再次封存时不覆盖已压缩的文件
+	p.Write(hour, "0_pvlog.txt", []byte("b"))
+	if fileExists(filepath.Join(hour, "_SUCCESS")) {
+		t.Error("marker should be removed when dir is reopened")
+	}
+	time.Sleep(30 * time.Millisecond)
+	p.Flush()
+	time.Sleep(30 * time.Millisecond)
+	p.Scan()
+	if s := readGzip(t, filepath.Join(hour, "0_pvlog.1.txt.gz")); s != "b\n" {
+		t.Errorf("content %q", s)
+	}
+	if !fileExists(filepath.Join(hour, "_SUCCESS")) {
+		t.Error("dir should be sealed again")
+	}
+
+	// 过期的目录及变空的上级目录被删除
+	old := time.Now().AddDate(0, 0, -2)
+	for _, name := range []string{"0_pvlog.txt.gz", "0_pvlog.1.txt.gz"} {
+		os.Chtimes(filepath.Join(hour, name), old, old)
+	}
+	p.Write(filepath.Join(root, "2019-01-14", "00"), "0_pvlog.txt", []byte("c"))
+	// 不是path_template生成的目录不处理
+	other := filepath.Join(root, "other")
+	os.Mkdir(other, 0755)
+	ioutil.WriteFile(filepath.Join(other, "x.txt"), nil, 0644)
+	os.Chtimes(filepath.Join(other, "x.txt"), old, old)
+	p.Scan()
+	if !fileExists(filepath.Join(other, "x.txt")) || fileExists(filepath.Join(other, "_SUCCESS")) {
+		t.Error("dir not matching path_template should be kept")
+	}
+	if fileExists(filepath.Join(root, "2019-01-13")) {
+		t.Error("expired dir should be removed")
+	}
+	if !fileExists(filepath.Join(root, "2019-01-14", "00")) {
+		t.Error("dir in use should be kept")
+	}
+}
+
+func TestCompressZstd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "0_pvlog.txt")
+	ioutil.WriteFile(path, []byte("x\n"), 0644)
+	if err := compressFile(path, ".zst"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path + ".zst")
+	d, _ := zstd.NewReader(nil)
+	defer d.Close()
+	if out, err := d.DecodeAll(b, nil); err != nil || string(out) != "x\n" {
+		t.Errorf("%q %v", out, err)
+	}
+	if fileExists(path) {
+		t.Error("source should be removed")
+	}
+
+	c := &FreqLogPoolConfig{Compress: "lz4"}
+	if c.Validate() == nil {
+		t.Error("invalid compress should fail")
+	}
+	c = &FreqLogPoolConfig{IdleTimeout: ltime.Duration{Duration: time.Hour}, SealDelay: ltime.Duration{Duration: time.Minute}}
+	if c.Validate() == nil {
+		t.Error("seal_delay less than idle_timeout should fail")
+	}
+}
@@ -0,0 +1,256 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 封存时的压缩方式
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+func compressExt(c string) string {
+	switch c {
+	case CompressGzip:
+		return ".gz"
+	case CompressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// rotatedName 按大小切分或重新封存时使用的文件名，如 0_pvlog.txt -> 0_pvlog.1.txt
+// 取第一个未被使用(含压缩后的文件)的序号
+func rotatedName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if !fileExists(name) && !fileExists(name+".gz") && !fileExists(name+".zst") {
+			return name
+		}
+	}
+}
+
+// sealDir 扫描时一个目录的状态
+type sealDir struct {
+	files  []string
+	marker bool
+	newest time.Time // 除marker外文件的最后修改时间
+}
+
+func (p *FreqLogPool) scanning() bool {
+	return len(p.root) > 0 && p.dirRe != nil && p.cfg.ScanEnabled()
+}
+
+func (p *FreqLogPool) scanLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.ScanInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Scan()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// Scan 封存root下超过seal_delay未写入的目录，删除超过retention_days未写入的目录
+// 只处理匹配dirRe的目录，有打开文件的目录不处理；root本身不封存
+func (p *FreqLogPool) Scan() error {
+	if !p.scanning() {
+		return nil
+	}
+	root := filepath.Clean(p.root)
+	dirs := map[string]*sealDir{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			// 目录可能在扫描过程中被删除
+			return nil
+		}
+		dir := filepath.Dir(path)
+		if rel, err := filepath.Rel(root, dir); err != nil || !p.dirRe.MatchString(filepath.ToSlash(rel)) {
+			return nil
+		}
+		d := dirs[dir]
+		if d == nil {
+			d = &sealDir{}
+			dirs[dir] = d
+		}
+		if info.Name() == p.cfg.Marker {
+			d.marker = true
+			return nil
+		}
+		d.files = append(d.files, path)
+		if info.ModTime().After(d.newest) {
+			d.newest = info.ModTime()
+		}
+		return nil
+	})
+
+	names := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	var err error
+	for _, dir := range names {
+		d := dirs[dir]
+		if len(d.files) == 0 {
+			continue
+		}
+		switch {
+		case p.cfg.RetentionDays > 0 && d.newest.Before(now.AddDate(0, 0, -p.cfg.RetentionDays)):
+			if rerr := p.removeDir(root, dir); rerr != nil {
+				err = rerr
+			}
+		case p.cfg.SealDelay.Duration > 0 && !d.marker && d.newest.Before(now.Add(-p.cfg.SealDelay.Duration)):
+			if serr := p.sealDir(dir, d.files); serr != nil {
+				err = fmt.Errorf("seal %s: %s", dir, serr)
+			}
+		}
+	}
+	return err
+}
+
+// lockDir 标记目录正在封存，目录中有打开的文件时返回false
+func (p *FreqLogPool) lockDir(dir string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.dirs[dir] > 0 || p.sealing[dir] {
+		return false
+	}
+	p.sealing[dir] = true
+	return true
+}
+
+func (p *FreqLogPool) unlockDir(dir string) {
+	p.mu.Lock()
+	delete(p.sealing, dir)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// sealDir 压缩目录中的文件后写入marker，压缩失败时不写marker，下次扫描重试
+func (p *FreqLogPool) sealDir(dir string, files []string) error {
+	if !p.lockDir(dir) {
+		return nil
+	}
+	defer p.unlockDir(dir)
+
+	ext := compressExt(p.cfg.Compress)
+	for _, path := range files {
+		if strings.HasSuffix(path, ".tmp") {
+			// 上次压缩中断留下的临时文件
+			os.Remove(path)
+			continue
+		}
+		if len(ext) == 0 || strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zst") {
+			continue
+		}
+		if err := compressFile(path, ext); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, p.cfg.Marker), nil, 0644)
+}
+
+// compressFile 压缩为path+ext并删除原文件，压缩后的文件保留原文件的修改时间
+func compressFile(path, ext string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fileExists(path + ext) {
+		// 重新封存时已有同名的压缩文件
+		np := rotatedName(path)
+		if err := os.Rename(path, np); err != nil {
+			return err
+		}
+		path = np
+	}
+	dst := path + ext
+	tmp := dst + ".tmp"
+	if err := writeCompressed(path, tmp, ext); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(dst, st.ModTime(), st.ModTime())
+	return os.Remove(path)
+}
+
+func writeCompressed(src, dst, ext string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var w io.WriteCloser
+	if ext == ".zst" {
+		if w, err = zstd.NewWriter(out, zstd.WithEncoderConcurrency(1)); err != nil {
+			return err
+		}
+	} else {
+		w = gzip.NewWriter(out)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// removeDir 删除过期目录，并删除root下因此变空的上级目录
+func (p *FreqLogPool) removeDir(root, dir string) error {
+	if !p.lockDir(dir) {
+		return nil
+	}
+	defer p.unlockDir(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	for d := filepath.Dir(dir); d != root && strings.HasPrefix(d, root); d = filepath.Dir(d) {
+		// 目录不为空时Remove失败
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
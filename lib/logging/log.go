@@ -9,10 +9,6 @@ import (
 	"github.com/labstack/gommon/log"
 )
 
-const (
-	logFormat = `${time_rfc3339} ${level} ${prefix} ${short_file}:${line}`
-)
-
 // Logger defines the logging interface.
 type Logger interface {
 	Output() io.Writer
@@ -42,6 +38,8 @@ type Logger interface {
 	Panic(i ...interface{})
 	Panicj(j log.JSON)
 	Panicf(format string, args ...interface{})
+	// With 返回附加了fields的子Logger，如worker、topic、partition、offset
+	With(fields Fields) Logger
 }
 
 type LogConfig struct {
@@ -49,6 +47,9 @@ type LogConfig struct {
 	Level string `toml:"level"`
 	level log.Lvl
 
+	// 日志格式 默认为 text, 取值范围：text,json
+	Format string `toml:"format"`
+
 	// 日志文件配置
 	File *LogFile `toml:"file"`
 }
@@ -62,6 +63,13 @@ func (c *LogConfig) Validate() error {
 		}
 		c.level = lvl
 	}
+	switch c.Format {
+	case "":
+		c.Format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("not a valid log format: %q", c.Format)
+	}
 
 	if err := c.File.Validate(); err != nil {
 		return err
@@ -70,12 +78,7 @@ func (c *LogConfig) Validate() error {
 }
 
 func DefaultLogger() Logger {
-	l := log.New("")
-	l.DisableColor()
-	l.SetLevel(log.DEBUG)
-	l.SetHeader(logFormat)
-
-	return l
+	return newLogger(os.Stdout, log.DEBUG, FormatText)
 }
 
 func parseLevel(lvl string) (log.Lvl, error) {
@@ -103,8 +106,6 @@ func SetLevel(lg Logger, name string) error {
 }
 
 func NewLoggerWithConfig(config *LogConfig) Logger {
-	l := log.New("")
-
 	level := log.INFO
 	if len(config.Level) != 0 {
 		lvl, err := parseLevel(config.Level)
@@ -113,15 +114,16 @@ func NewLoggerWithConfig(config *LogConfig) Logger {
 		}
 		level = lvl
 	}
-	l.DisableColor()
-	l.SetLevel(level)
-	l.SetHeader(logFormat)
+	l := newLogger(os.Stdout, level, config.Format)
 
-	if len(config.File.FileName) != 0 {
+	if config.hasFile() {
 		// logFile := config.File
 		if err := config.File.Validate(); err != nil {
 			panic(err.Error())
 		}
+		if err := config.File.Open(); err != nil {
+			panic(err.Error())
+		}
 		l.SetOutput(config.File)
 	} else {
 		l.SetOutput(os.Stdout)
@@ -129,3 +131,37 @@ func NewLoggerWithConfig(config *LogConfig) Logger {
 
 	return l
 }
+
+// hasFile 是否写入日志文件，否则写入标准输出
+func (c *LogConfig) hasFile() bool {
+	return c.File != nil && len(c.File.FileName) != 0
+}
+
+// CheckReloadLoggerConfig 检查next能否热加载到由cur创建的Logger上，不修改任何配置
+// 日志输出在文件与标准输出之间切换需重启
+func CheckReloadLoggerConfig(cur *LogConfig, next *LogConfig) error {
+	if cur.hasFile() != next.hasFile() {
+		return fmt.Errorf("logging.file cannot be added or removed on reload, restart required")
+	}
+	return nil
+}
+
+// ReloadLoggerWithConfig 将next应用到由cur创建的Logger上，next需已通过Validate
+// 日志级别与格式立即生效；日志文件配置有变化时，下次写入切换到新文件
+// CheckReloadLoggerConfig失败时不做任何修改；其余错误为关闭旧文件的错误，此时新配置已生效
+func ReloadLoggerWithConfig(lg Logger, cur *LogConfig, next *LogConfig) error {
+	if err := CheckReloadLoggerConfig(cur, next); err != nil {
+		return err
+	}
+	lg.SetLevel(next.level)
+	if l, ok := lg.(*logger); ok {
+		l.core.setFormat(next.Format)
+	}
+	if !cur.hasFile() {
+		return nil
+	}
+	err := cur.File.Reload(next.File)
+	// 继续使用Logger正在写入的LogFile
+	next.File = cur.File
+	return err
+}
@@ -2,8 +2,10 @@ package logging
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -32,6 +34,14 @@ type LogFile struct {
 	RotationDuration ltime.Duration `toml:"rotation_duration"`
 	RotationCount    int            `toml:"rotation_count"`
 
+	// 以下按文件名中的时间判断文件新旧，Open及每次切换文件时检查，正在写入的和最新的文件不删除
+	//MaxTotalBytes 日志文件的总大小，超过时删除最旧的文件，0不限制
+	MaxTotalBytes int64 `toml:"max_total_bytes"`
+	//MaxAge 删除创建时间早于MaxAge的文件，0不限制
+	MaxAge ltime.Duration `toml:"max_age"`
+	//Compress 切换文件后在后台用gzip压缩旧文件
+	Compress bool `toml:"compress"`
+
 	//jastCreated represents the creation time of the latest log
 	lastCreated time.Time
 
@@ -46,7 +56,19 @@ type LogFile struct {
 
 	//acquire is the mutex utilized to ensure we have no concurrency issues
 	acquire sync.Mutex
-	files   []string
+	current string // 正在写入的文件
+
+	// 后台压缩，运行中再次触发时置pending，完成后重新执行一次
+	compressing bool
+	pending     bool
+	wg          sync.WaitGroup
+}
+
+// logFileInfo 由LogFile创建的日志文件
+type logFileInfo struct {
+	path    string
+	created time.Time // 文件名中的时间
+	size    int64
 }
 
 func (l *LogFile) Validate() error {
@@ -62,55 +84,175 @@ func (l *LogFile) Validate() error {
 	if l.RotationCount == 0 {
 		l.RotationCount = 3
 	}
+	if l.MaxTotalBytes < 0 {
+		return errors.New("max_total_bytes must not be negative")
+	}
+	if l.MaxAge.Duration < 0 {
+		return errors.New("max_age must not be negative")
+	}
+	return nil
+}
+
+// Open 创建目录并处理上次运行留下的文件：删除多余的文件，compress时在后台压缩旧文件
+// 只在实际写入的LogFile上调用，未调用时在第一次Write时处理；Validate不修改硬盘上的文件
+func (l *LogFile) Open() error {
+	l.acquire.Lock()
+	defer l.acquire.Unlock()
 	if err := os.MkdirAll(l.LogPath, 0755); err != nil {
 		return err
 	}
+	err := l.scanDiskLocked()
+	if l.Compress {
+		l.compressRotated()
+	}
+	return err
+}
 
-	if err := l.rotateFileScanDisk(); err != nil {
-		return err
+// splitName 日志文件名的前缀和扩展名，文件名为 前缀 + 时间 + 扩展名
+func (l *LogFile) splitName() (string, string) {
+	// Extract the file extention
+	fileExt := filepath.Ext(l.FileName)
+	// If we have no file extension we append .log
+	if fileExt == "" {
+		fileExt = ".log"
 	}
+	// Remove the file extention from the filename
+	return strings.TrimSuffix(l.FileName, fileExt) + "-", fileExt
+}
 
-	return nil
+// scanFiles 列出LogPath下由当前配置创建的日志文件(含压缩后的)，按文件名中的时间从旧到新排序
+func (l *LogFile) scanFiles() ([]logFileInfo, error) {
+	prefix, ext := l.splitName()
+	infos, err := ioutil.ReadDir(l.LogPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []logFileInfo
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		ts := strings.TrimPrefix(name, prefix)
+		if strings.HasSuffix(ts, ext+".gz") {
+			ts = strings.TrimSuffix(ts, ext+".gz")
+		} else if strings.HasSuffix(ts, ext) {
+			ts = strings.TrimSuffix(ts, ext)
+		} else {
+			continue
+		}
+		created, err := time.ParseInLocation(l.FileNameDateFormat, ts, time.Local)
+		if err != nil {
+			// 不是由LogFile创建的文件
+			continue
+		}
+		files = append(files, logFileInfo{path: filepath.Join(l.LogPath, name), created: created, size: info.Size()})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if !files[i].created.Equal(files[j].created) {
+			return files[i].created.Before(files[j].created)
+		}
+		return files[i].path < files[j].path
+	})
+	return files, nil
 }
 
-// 扫描硬盘，删除多余日志文件
-func (l *LogFile) rotateFileScanDisk() error {
-	// TODO
-	return nil
+// scanDiskLocked 按rotation_count、max_age、max_total_bytes删除最旧的文件，需持有acquire
+func (l *LogFile) scanDiskLocked() error {
+	files, err := l.scanFiles()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	excess := len(files) - l.RotationCount
+	deadline := time.Now().Add(-l.MaxAge.Duration)
+	for i, f := range files {
+		if l.keep(files, i) {
+			continue
+		}
+		remove := (l.RotationCount > 0 && excess > 0) ||
+			(l.MaxAge.Duration > 0 && f.created.Before(deadline)) ||
+			(l.MaxTotalBytes > 0 && total > l.MaxTotalBytes)
+		if !remove {
+			continue
+		}
+		if rerr := os.Remove(f.path); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+			continue
+		}
+		excess--
+		total -= f.size
+	}
+	return err
+}
+
+// keep 正在写入的和最新的文件不删除不压缩，重启后最新的文件可能被继续写入
+func (l *LogFile) keep(files []logFileInfo, i int) bool {
+	return i == len(files)-1 || files[i].path == l.current
 }
 
-// 通过维护一个list来实现rotate的日志文件个数
+// 切换到新文件时检查硬盘上的旧文件，需持有acquire
 func (l *LogFile) rotateFile(filename string) error {
-	n := len(l.files)
-	if n == 0 {
-		l.files = append(l.files, filename)
+	if l.current == filename {
 		return nil
 	}
-	latestLogFile := l.files[n-1]
-	if latestLogFile == filename {
-		return nil
+	l.current = filename
+	err := l.scanDiskLocked()
+	if l.Compress {
+		l.compressRotated()
 	}
-	l.files = append(l.files, filename)
-	if len(l.files) <= l.RotationCount {
-		return nil
+	return err
+}
+
+// compressRotated 启动后台压缩，需持有acquire
+func (l *LogFile) compressRotated() {
+	if l.compressing {
+		l.pending = true
+		return
 	}
-	earliestLogFile := l.files[0]
-	l.files = l.files[1:]
-	if err := os.Remove(earliestLogFile); err != nil {
-		return err
+	l.compressing = true
+	l.wg.Add(1)
+	go l.compressLoop()
+}
+
+func (l *LogFile) compressLoop() {
+	defer l.wg.Done()
+	for {
+		l.acquire.Lock()
+		l.pending = false
+		files, _ := l.scanFiles()
+		var paths []string
+		for i, f := range files {
+			if !l.keep(files, i) && !strings.HasSuffix(f.path, ".gz") {
+				paths = append(paths, f.path)
+			}
+		}
+		l.acquire.Unlock()
+
+		// 压缩时不持有锁，不阻塞Write；文件可能同时被删除，失败时忽略
+		for _, path := range paths {
+			compressFile(path, ".gz")
+		}
+
+		l.acquire.Lock()
+		if len(paths) > 0 {
+			// 压缩后总大小变化
+			l.scanDiskLocked()
+		}
+		if !l.pending {
+			l.compressing = false
+			l.acquire.Unlock()
+			return
+		}
+		l.acquire.Unlock()
 	}
-	return nil
 }
 
 func (l *LogFile) openNew() error {
-	// Extract the file extention
-	fileExt := filepath.Ext(l.FileName)
-	// If we have no file extension we append .log
-	if fileExt == "" {
-		fileExt = ".log"
-	}
-	// Remove the file extention from the filename
-	fileName := strings.TrimSuffix(l.FileName, fileExt)
+	fileName, fileExt := l.splitName()
 	// New file name has the format : filename-timestamp.extension
 	now := time.Now()
 	createTime := now
@@ -120,7 +262,7 @@ func (l *LogFile) openNew() error {
 		createTime = time.Unix(seconds, 0)
 	}
 	// newfileName := fileName + "-" + strconv.FormatInt(createTime.UnixNano(), 10) + fileExt
-	newfileName := fileName + "-" + createTime.Format(l.FileNameDateFormat) + fileExt
+	newfileName := fileName + createTime.Format(l.FileNameDateFormat) + fileExt
 	newfilePath := filepath.Join(l.LogPath, newfileName)
 	os.MkdirAll(l.LogPath, 0755)
 	// Try creating a file. We truncate the file because we are the only authority to write the logs
@@ -147,6 +289,53 @@ func (l *LogFile) rotate() error {
 	return nil
 }
 
+// Reload 使用n的配置替换当前配置，配置有变化时关闭当前文件，下次Write时按新配置创建
+func (l *LogFile) Reload(n *LogFile) error {
+	l.acquire.Lock()
+	defer l.acquire.Unlock()
+	if l.FileName == n.FileName &&
+		l.LogPath == n.LogPath &&
+		l.FileNameDateFormat == n.FileNameDateFormat &&
+		l.FileNameDateAlign == n.FileNameDateAlign &&
+		l.RotationDuration == n.RotationDuration &&
+		l.RotationCount == n.RotationCount &&
+		l.MaxBytes == n.MaxBytes &&
+		l.MaxTotalBytes == n.MaxTotalBytes &&
+		l.MaxAge == n.MaxAge &&
+		l.Compress == n.Compress {
+		return nil
+	}
+	l.FileName = n.FileName
+	l.LogPath = n.LogPath
+	l.FileNameDateFormat = n.FileNameDateFormat
+	l.FileNameDateAlign = n.FileNameDateAlign
+	l.RotationDuration = n.RotationDuration
+	l.RotationCount = n.RotationCount
+	l.MaxBytes = n.MaxBytes
+	l.MaxTotalBytes = n.MaxTotalBytes
+	l.MaxAge = n.MaxAge
+	l.Compress = n.Compress
+	if l.fileInfo != nil {
+		err := l.fileInfo.Close()
+		l.fileInfo = nil
+		return err
+	}
+	return nil
+}
+
+// Close 关闭当前文件并等待后台压缩完成，之后的Write会重新创建文件
+func (l *LogFile) Close() error {
+	defer l.wg.Wait()
+	l.acquire.Lock()
+	defer l.acquire.Unlock()
+	if l.fileInfo == nil {
+		return nil
+	}
+	err := l.fileInfo.Close()
+	l.fileInfo = nil
+	return err
+}
+
 func (l *LogFile) Write(b []byte) (n int, err error) {
 	l.acquire.Lock()
 	defer l.acquire.Unlock()
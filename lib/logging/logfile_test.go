@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ltime "process_data/lib/time"
+)
+
+// createLogFiles 创建n个旧日志文件，第i个的时间为now-(n-i)h
+func createLogFiles(t *testing.T, dir string, now time.Time, n int, size int) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		name := "server-" + now.Add(-time.Duration(n-i)*time.Hour).Format(defaultFileNameDateFormat) + ".log"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func listDir(dir string) []string {
+	infos, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLogFileScanDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := createLogFiles(t, dir, time.Now(), 5, 10)
+	ioutil.WriteFile(filepath.Join(dir, "server-backup.log"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "other-20190113.010000.log"), nil, 0644)
+
+	// Validate不修改硬盘上的文件；Open时删除上次运行留下的多余文件，其他文件不处理
+	l := &LogFile{FileName: "server.log", LogPath: dir, RotationCount: 3}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := listDir(dir); len(got) != 7 {
+		t.Errorf("Validate should not remove files: %v", got)
+	}
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	except := append([]string{"other-20190113.010000.log", "server-backup.log"}, old[2:]...)
+	sort.Strings(except)
+	if got := listDir(dir); strings.Join(got, ",") != strings.Join(except, ",") {
+		t.Errorf("after startup scan %v, except %v", got, except)
+	}
+
+	// 创建新文件后保留rotation_count个文件
+	if _, err := l.Write([]byte("x\n")); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	got := listDir(dir)
+	if len(got) != 5 || got[1] != old[3] || got[2] != old[4] {
+		t.Errorf("after rotate %v", got)
+	}
+}
+
+func TestLogFileRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	old := createLogFiles(t, dir, now, 6, 100)
+	l := &LogFile{FileName: "server.log", LogPath: dir, RotationCount: 10, MaxAge: ltime.Duration{Duration: 150 * time.Minute}}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l.Open()
+	if got := listDir(dir); strings.Join(got, ",") != strings.Join(old[4:], ",") {
+		t.Errorf("max_age: %v", got)
+	}
+
+	createLogFiles(t, dir, now, 6, 100)
+	l = &LogFile{FileName: "server.log", LogPath: dir, RotationCount: 10, MaxTotalBytes: 250}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l.Open()
+	if got := listDir(dir); strings.Join(got, ",") != strings.Join(old[4:], ",") {
+		t.Errorf("max_total_bytes: %v", got)
+	}
+
+	// 最新的文件超过限制时也保留
+	l = &LogFile{FileName: "server.log", LogPath: dir, RotationCount: 10, MaxTotalBytes: 50}
+	l.Validate()
+	l.Open()
+	if got := listDir(dir); len(got) != 1 || got[0] != old[5] {
+		t.Errorf("newest file should be kept: %v", got)
+	}
+}
+
+func TestLogFileCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := createLogFiles(t, dir, time.Now(), 2, 100)
+	l := &LogFile{FileName: "server.log", LogPath: dir, RotationCount: 3, Compress: true}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Write([]byte("x\n")); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// 压缩后的文件计入rotation_count，正在写入的文件不压缩
+	got := listDir(dir)
+	if len(got) != 3 || got[0] != old[0]+".gz" || got[1] != old[1]+".gz" || strings.HasSuffix(got[2], ".gz") {
+		t.Fatalf("%v", got)
+	}
+	if s := readGzip(t, filepath.Join(dir, got[1])); len(s) != 100 {
+		t.Errorf("%d bytes", len(s))
+	}
+}
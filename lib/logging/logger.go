@@ -0,0 +1,278 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// 日志格式
+const (
+	FormatText = "text" // ${time_rfc3339} ${level} ${prefix} ${short_file}:${line} [k=v ...] message
+	FormatJSON = "json" // 每行一个JSON对象: time, level, prefix, caller, With附加的字段, message
+)
+
+// Fields With附加到每条日志的字段
+type Fields map[string]interface{}
+
+const (
+	panicLevel = log.OFF + 1
+	fatalLevel = log.OFF + 2
+)
+
+var levelNames = []string{"-", "DEBUG", "INFO", "WARN", "ERROR", "", "PANIC", "FATAL"}
+
+// loggerCore 由一个Logger及其With创建的子Logger共享
+type loggerCore struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix string
+	level  uint32
+	json   uint32 // 1为json格式
+	pool   sync.Pool
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// logger 实现Logger，子Logger共享输出、级别与格式
+type logger struct {
+	core   *loggerCore
+	fields []field
+	text   string // 文本格式下fields的渲染结果
+}
+
+func newLogger(out io.Writer, level log.Lvl, format string) *logger {
+	c := &loggerCore{out: out, level: uint32(level)}
+	c.pool.New = func() interface{} { return new(bytes.Buffer) }
+	c.setFormat(format)
+	return &logger{core: c}
+}
+
+func (c *loggerCore) setFormat(format string) {
+	var v uint32
+	if format == FormatJSON {
+		v = 1
+	}
+	atomic.StoreUint32(&c.json, v)
+}
+
+// With 返回附加了fields的子Logger，与已有字段同名时覆盖
+func (l *logger) With(fields Fields) Logger {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	n := &logger{core: l.core, fields: make([]field, 0, len(l.fields)+len(keys))}
+	for _, f := range l.fields {
+		if _, ok := fields[f.key]; !ok {
+			n.fields = append(n.fields, f)
+		}
+	}
+	for _, k := range keys {
+		n.fields = append(n.fields, field{k, fields[k]})
+	}
+	var b bytes.Buffer
+	for _, f := range n.fields {
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		fmt.Fprint(&b, f.value)
+		b.WriteByte(' ')
+	}
+	n.text = b.String()
+	return n
+}
+
+func (l *logger) Output() io.Writer {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	return l.core.out
+}
+
+func (l *logger) SetOutput(w io.Writer) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	l.core.out = w
+}
+
+func (l *logger) Prefix() string {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	return l.core.prefix
+}
+
+func (l *logger) SetPrefix(p string) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	l.core.prefix = p
+}
+
+func (l *logger) Level() log.Lvl {
+	return log.Lvl(atomic.LoadUint32(&l.core.level))
+}
+
+func (l *logger) SetLevel(v log.Lvl) {
+	atomic.StoreUint32(&l.core.level, uint32(v))
+}
+
+func (l *logger) Print(i ...interface{})                    { l.log(0, "", i) }
+func (l *logger) Printf(format string, args ...interface{}) { l.log(0, format, args) }
+func (l *logger) Printj(j log.JSON)                         { l.logj(0, j) }
+func (l *logger) Debug(i ...interface{})                    { l.log(log.DEBUG, "", i) }
+func (l *logger) Debugf(format string, args ...interface{}) { l.log(log.DEBUG, format, args) }
+func (l *logger) Debugj(j log.JSON)                         { l.logj(log.DEBUG, j) }
+func (l *logger) Info(i ...interface{})                     { l.log(log.INFO, "", i) }
+func (l *logger) Infof(format string, args ...interface{})  { l.log(log.INFO, format, args) }
+func (l *logger) Infoj(j log.JSON)                          { l.logj(log.INFO, j) }
+func (l *logger) Warn(i ...interface{})                     { l.log(log.WARN, "", i) }
+func (l *logger) Warnf(format string, args ...interface{})  { l.log(log.WARN, format, args) }
+func (l *logger) Warnj(j log.JSON)                          { l.logj(log.WARN, j) }
+func (l *logger) Error(i ...interface{})                    { l.log(log.ERROR, "", i) }
+func (l *logger) Errorf(format string, args ...interface{}) { l.log(log.ERROR, format, args) }
+func (l *logger) Errorj(j log.JSON)                         { l.logj(log.ERROR, j) }
+
+func (l *logger) Fatal(i ...interface{}) {
+	l.log(fatalLevel, "", i)
+	os.Exit(1)
+}
+
+func (l *logger) Fatalf(format string, args ...interface{}) {
+	l.log(fatalLevel, format, args)
+	os.Exit(1)
+}
+
+func (l *logger) Fatalj(j log.JSON) {
+	l.logj(fatalLevel, j)
+	os.Exit(1)
+}
+
+func (l *logger) Panic(i ...interface{}) {
+	l.log(panicLevel, "", i)
+	panic(fmt.Sprint(i...))
+}
+
+func (l *logger) Panicf(format string, args ...interface{}) {
+	l.log(panicLevel, format, args)
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (l *logger) Panicj(j log.JSON) {
+	l.logj(panicLevel, j)
+	panic(j)
+}
+
+func (l *logger) enabled(level log.Lvl) bool {
+	return level >= l.Level() || level == 0
+}
+
+func (l *logger) log(level log.Lvl, format string, args []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+	var msg string
+	if len(format) == 0 {
+		msg = fmt.Sprint(args...)
+	} else {
+		msg = fmt.Sprintf(format, args...)
+	}
+	l.write(level, msg, nil)
+}
+
+func (l *logger) logj(level log.Lvl, j log.JSON) {
+	if !l.enabled(level) {
+		return
+	}
+	l.write(level, "", j)
+}
+
+// write 输出一行日志，j不为nil时为*j方法：json格式下合并到对象中，文本格式下作为消息输出
+func (l *logger) write(level log.Lvl, msg string, j log.JSON) {
+	// write <- log/logj <- Info等 <- 调用者
+	_, file, line, _ := runtime.Caller(3)
+	caller := path.Base(file) + ":" + strconv.Itoa(line)
+
+	c := l.core
+	buf := c.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer c.pool.Put(buf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadUint32(&c.json) == 1 {
+		l.writeJSON(buf, level, caller, msg, j)
+	} else {
+		if j != nil {
+			b, err := json.Marshal(j)
+			if err != nil {
+				panic(err)
+			}
+			msg = string(b)
+		}
+		buf.WriteString(time.Now().Format(time.RFC3339))
+		buf.WriteByte(' ')
+		buf.WriteString(levelNames[level])
+		buf.WriteByte(' ')
+		buf.WriteString(c.prefix)
+		buf.WriteByte(' ')
+		buf.WriteString(caller)
+		buf.WriteByte(' ')
+		buf.WriteString(l.text)
+		buf.WriteString(msg)
+	}
+	buf.WriteByte('\n')
+	c.out.Write(buf.Bytes())
+}
+
+func (l *logger) writeJSON(buf *bytes.Buffer, level log.Lvl, caller, msg string, j log.JSON) {
+	writeField := func(k string, v interface{}) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(v))
+		}
+		kb, _ := json.Marshal(k)
+		buf.WriteByte(',')
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(b)
+	}
+	buf.WriteString(`{"time":"`)
+	buf.WriteString(time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`","level":"`)
+	buf.WriteString(levelNames[level])
+	buf.WriteByte('"')
+	if len(l.core.prefix) > 0 {
+		writeField("prefix", l.core.prefix)
+	}
+	writeField("caller", caller)
+	for _, f := range l.fields {
+		writeField(f.key, f.value)
+	}
+	if j == nil {
+		writeField("message", msg)
+	} else {
+		keys := make([]string, 0, len(j))
+		for k := range j {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeField(k, j[k])
+		}
+	}
+	buf.WriteByte('}')
+}
@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/labstack/gommon/log"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var out bytes.Buffer
+	cfg := &LogConfig{Level: "info", Format: "json", File: &LogFile{}}
+	lg := NewLoggerWithConfig(cfg)
+	lg.SetOutput(&out)
+
+	wl := lg.With(Fields{"worker": 3})
+	ml := wl.With(Fields{"topic": "test1", "partition": int32(2), "offset": int64(100)})
+	ml.Errorf("write %s failed", "x")
+	wl.Debug("ignored")
+	wl.Infoj(log.JSON{"qps": 10})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines: %s", len(lines), out.String())
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatalf("%s: %s", lines[0], err)
+	}
+	for k, v := range map[string]interface{}{
+		"level": "ERROR", "worker": 3.0, "topic": "test1", "partition": 2.0, "offset": 100.0, "message": "write x failed",
+	} {
+		if m[k] != v {
+			t.Errorf("%s: %v, except %v", k, m[k], v)
+		}
+	}
+	if c, _ := m["caller"].(string); !strings.HasPrefix(c, "logger_test.go:") {
+		t.Errorf("caller %q", m["caller"])
+	}
+	if !strings.HasPrefix(lines[0], `{"time":`) {
+		t.Errorf("time should be first: %s", lines[0])
+	}
+
+	m = nil
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil || m["qps"] != 10.0 || m["worker"] != 3.0 || m["message"] != nil {
+		t.Errorf("%s: %v", lines[1], err)
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	var out bytes.Buffer
+	cfg := &LogConfig{File: &LogFile{}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("empty filename should fail")
+	}
+	lg := NewLoggerWithConfig(cfg)
+	lg.SetOutput(&out)
+
+	lg.With(Fields{"worker": 1}).With(Fields{"worker": 2, "topic": "t"}).Warnf("stop %d", 5)
+	re := regexp.MustCompile(`^\S+ WARN  logger_test.go:\d+ topic=t worker=2 stop 5\n$`)
+	if !re.MatchString(out.String()) {
+		t.Errorf("%q", out.String())
+	}
+
+	// 热加载切换格式
+	out.Reset()
+	next := &LogConfig{Level: "debug", Format: "json"}
+	next.level = log.DEBUG
+	if err := ReloadLoggerWithConfig(lg, cfg, next); err != nil {
+		t.Fatal(err)
+	}
+	lg.Debug("x")
+	if !strings.HasPrefix(out.String(), `{"time":`) {
+		t.Errorf("%q", out.String())
+	}
+
+	if err := (&LogConfig{Format: "xml"}).Validate(); err == nil {
+		t.Error("invalid format should fail")
+	}
+}
+
+// 热加载不能在日志文件与标准输出之间切换，此时不修改任何配置
+func TestReloadLoggerFile(t *testing.T) {
+	cur := &LogConfig{Level: "info", File: &LogFile{}}
+	lg := NewLoggerWithConfig(cur)
+	next := &LogConfig{Level: "debug", File: &LogFile{FileName: "x.log", LogPath: "/tmp"}}
+	if err := next.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadLoggerWithConfig(lg, cur, next); err == nil || !strings.Contains(err.Error(), "restart required") {
+		t.Fatalf("add file: %v", err)
+	}
+	if lg.Level() != log.INFO {
+		t.Errorf("level %v changed by a rejected reload", lg.Level())
+	}
+	if err := CheckReloadLoggerConfig(next, &LogConfig{}); err == nil {
+		t.Error("remove file should fail")
+	}
+}
@@ -0,0 +1,417 @@
+/*
+prometheus 以Prometheus文本格式在HTTP接口上输出指标，作为graphite.Backend接收graphite.Add等写入的指标
+
+## 指标名
+graphite的指标名为`.`分隔的${node_names}.${metric}，按Rule转换为Prometheus的指标名与标签：
+
+	Rule{Pattern: "{topic}.consume.qps", Name: "kafka_consumed_total"}
+	Rule{Pattern: "msg.succ", Name: "messages_total", Labels: Labels{"result": "succ"}}
+
+Pattern中的{label}匹配一段并作为标签的值。没有匹配的Rule时，指标名为把非法字符替换为`_`后的原名，
+Add写入的指标加`_total`后缀。Add写入的为counter，从启动开始累加；Set写入的为gauge。
+Timing写入的为histogram，单位秒，指标名加`_seconds`后缀，桶的上界为DefaultBuckets。
+MonitorChan的chan输出为 chan_length{chan="${node_name}"} 与 chan_capacity{chan="${node_name}"}。
+所有指标加Config.Namespace前缀和Config.Labels标签。
+*/
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"process_data/lib/graphite"
+	"process_data/lib/logging"
+)
+
+// Config [prometheus]
+type Config struct {
+	Listen    string            `toml:"listen" json:"listen"`       // 如 ":9108"，为空时不启用
+	Path      string            `toml:"path" json:"path"`           // default "/metrics"
+	Namespace string            `toml:"namespace" json:"namespace"` // 指标名前缀，如 process_data
+	Labels    map[string]string `toml:"labels" json:"labels"`       // 所有指标附加的标签
+}
+
+func (c *Config) Validate() error {
+	if len(c.Listen) == 0 {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("prometheus.listen %q is invalid: %s", c.Listen, err)
+	}
+	if len(c.Path) == 0 {
+		c.Path = "/metrics"
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("prometheus.path %q must start with /", c.Path)
+	}
+	if len(c.Namespace) > 0 && !validName(c.Namespace) {
+		return fmt.Errorf("prometheus.namespace %q is invalid", c.Namespace)
+	}
+	for k := range c.Labels {
+		if !validName(k) || strings.Contains(k, ":") {
+			return fmt.Errorf("prometheus.labels: %q is invalid", k)
+		}
+	}
+	return nil
+}
+
+// Labels 标签名 -> 值
+type Labels map[string]string
+
+// Rule 将graphite指标名转换为Prometheus的指标名和标签
+type Rule struct {
+	Pattern string // .分隔，{label}匹配一段
+	Name    string // 不含Namespace
+	Labels  Labels // 固定的标签
+}
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// DefaultBuckets histogram的桶上界，单位秒
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// series 一个指标名加一组标签
+type series struct {
+	name   string
+	labels string // 渲染后的 {k="v",...}，无标签时为空
+	kind   string
+	value  int64
+	hist   *histogram // kind为kindHistogram时有效
+}
+
+// histogram 各桶的样本数，不累积；从启动开始累加
+type histogram struct {
+	mu      sync.Mutex
+	buckets []uint64 // 与DefaultBuckets一一对应，最后一个为+Inf
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(DefaultBuckets, v)
+	h.mu.Lock()
+	h.buckets[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// render 输出 _bucket, _sum, _count
+func (h *histogram) render(buf *bytes.Buffer, name, labels string) {
+	h.mu.Lock()
+	buckets := append([]uint64(nil), h.buckets...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	var cum uint64
+	for i, n := range buckets {
+		cum += n
+		le := "+Inf"
+		if i < len(DefaultBuckets) {
+			le = strconv.FormatFloat(DefaultBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", name, withLabel(labels, "le", le), cum)
+	}
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, labels, count)
+}
+
+// withLabel 在渲染后的标签中追加一个标签
+func withLabel(labels, k, v string) string {
+	if len(labels) == 0 {
+		return "{" + k + `="` + v + `"}`
+	}
+	return labels[:len(labels)-1] + "," + k + `="` + v + `"}`
+}
+
+type chanSeries struct {
+	labels string
+	ch     graphite.Channeler
+}
+
+// Exporter 实现graphite.Backend与http.Handler
+type Exporter struct {
+	cfg      Config
+	logger   logging.Logger
+	rules    []Rule
+	patterns [][]string // 与rules一一对应，Pattern按.切分
+
+	mu     sync.RWMutex
+	series map[string]*series // graphite指标名 -> series
+	chans  map[string]*chanSeries
+
+	server *http.Server
+	addr   net.Addr
+}
+
+// New 创建Exporter，rules按顺序匹配
+func New(cfg *Config, rules []Rule, logger logging.Logger) *Exporter {
+	e := &Exporter{
+		cfg:    *cfg,
+		logger: logger,
+		rules:  rules,
+		series: map[string]*series{},
+		chans:  map[string]*chanSeries{},
+	}
+	for _, r := range rules {
+		e.patterns = append(e.patterns, strings.Split(r.Pattern, "."))
+	}
+	return e
+}
+
+// Add counter key增加value
+func (e *Exporter) Add(key string, value int64) {
+	atomic.AddInt64(&e.get(key, kindCounter).value, value)
+}
+
+// Set gauge key设置为value
+func (e *Exporter) Set(key string, value int64) {
+	atomic.StoreInt64(&e.get(key, kindGauge).value, value)
+}
+
+// Timing histogram key记录一次耗时d
+func (e *Exporter) Timing(key string, d time.Duration) {
+	e.get(key, kindHistogram).hist.observe(d.Seconds())
+}
+
+// MonitorChan 输出时读取chan的长度和容量
+func (e *Exporter) MonitorChan(key string, channeler graphite.Channeler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.chans[key] = &chanSeries{labels: e.renderLabels(Labels{"chan": key}), ch: channeler}
+}
+
+func (e *Exporter) get(key, kind string) *series {
+	e.mu.RLock()
+	s := e.series[key]
+	e.mu.RUnlock()
+	if s != nil {
+		return s
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s = e.series[key]; s != nil {
+		return s
+	}
+	name, labels := e.convert(key)
+	if kind == kindCounter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	if kind == kindHistogram && !strings.HasSuffix(name, "_seconds") {
+		name += "_seconds"
+	}
+	if len(e.cfg.Namespace) > 0 {
+		name = e.cfg.Namespace + "_" + name
+	}
+	s = &series{name: name, labels: e.renderLabels(labels), kind: kind}
+	if kind == kindHistogram {
+		s.hist = &histogram{buckets: make([]uint64, len(DefaultBuckets)+1)}
+	}
+	e.series[key] = s
+	return s
+}
+
+// convert 按rules转换指标名，没有匹配的rule时替换非法字符
+func (e *Exporter) convert(key string) (string, Labels) {
+	parts := strings.Split(key, ".")
+	for i, pattern := range e.patterns {
+		if labels, ok := match(pattern, parts); ok {
+			r := e.rules[i]
+			for k, v := range r.Labels {
+				labels[k] = v
+			}
+			return r.Name, labels
+		}
+	}
+	return sanitize(key), Labels{}
+}
+
+func match(pattern, parts []string) (Labels, bool) {
+	if len(pattern) != len(parts) {
+		return nil, false
+	}
+	labels := Labels{}
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			labels[p[1:len(p)-1]] = parts[i]
+		} else if p != parts[i] {
+			return nil, false
+		}
+	}
+	return labels, true
+}
+
+// renderLabels 合并Config.Labels，按标签名排序
+func (e *Exporter) renderLabels(labels Labels) string {
+	all := make(Labels, len(labels)+len(e.cfg.Labels))
+	for k, v := range e.cfg.Labels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	if len(all) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(all[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// validChar 指标名与标签名的第i个字符是否合法: [a-zA-Z_:][a-zA-Z0-9_:]*
+func validChar(c byte, i int) bool {
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9'
+}
+
+func validName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !validChar(s[i], i) {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// sanitize 非法字符替换为_
+func sanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !validChar(c, i) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Render 以Prometheus文本格式输出所有指标，按指标名排序
+func (e *Exporter) Render(buf *bytes.Buffer) {
+	e.mu.RLock()
+	byName := map[string][]*series{}
+	for _, s := range e.series {
+		byName[s.name] = append(byName[s.name], s)
+	}
+	chans := make([]*chanSeries, 0, len(e.chans))
+	for _, c := range e.chans {
+		chans = append(chans, c)
+	}
+	e.mu.RUnlock()
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ss := byName[name]
+		sort.Slice(ss, func(i, j int) bool { return ss[i].labels < ss[j].labels })
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, ss[0].kind)
+		for _, s := range ss {
+			if s.hist != nil {
+				s.hist.render(buf, name, s.labels)
+				continue
+			}
+			buf.WriteString(name)
+			buf.WriteString(s.labels)
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(atomic.LoadInt64(&s.value), 10))
+			buf.WriteByte('\n')
+		}
+	}
+
+	if len(chans) == 0 {
+		return
+	}
+	sort.Slice(chans, func(i, j int) bool { return chans[i].labels < chans[j].labels })
+	for _, m := range []struct {
+		name  string
+		value func(graphite.Channeler) int
+	}{
+		{"chan_capacity", graphite.Channeler.Capacity},
+		{"chan_length", graphite.Channeler.Length},
+	} {
+		name := m.name
+		if len(e.cfg.Namespace) > 0 {
+			name = e.cfg.Namespace + "_" + name
+		}
+		fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+		for _, c := range chans {
+			fmt.Fprintf(buf, "%s%s %d\n", name, c.labels, m.value(c.ch))
+		}
+	}
+}
+
+// ServeHTTP 输出所有指标
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	e.Render(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Start 在Config.Listen上启动HTTP服务，监听失败时返回错误
+func (e *Exporter) Start() error {
+	ln, err := net.Listen("tcp", e.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(e.cfg.Path, e)
+	e.server = &http.Server{Handler: mux}
+	e.addr = ln.Addr()
+	go func() {
+		if err := e.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			e.logger.Errorf("prometheus serve %s failed: %s", e.cfg.Listen, err)
+		}
+	}()
+	return nil
+}
+
+// Addr Start后实际监听的地址
+func (e *Exporter) Addr() net.Addr {
+	return e.addr
+}
+
+// Stop 停止HTTP服务，等待正在处理的请求最多5秒
+func (e *Exporter) Stop() error {
+	if e.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return e.server.Shutdown(ctx)
+}
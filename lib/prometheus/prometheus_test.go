@@ -0,0 +1,131 @@
+package prometheus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"process_data/config"
+	"process_data/lib/graphite"
+	"process_data/lib/logging"
+)
+
+var testRules = []Rule{
+	{Pattern: "msg.succ", Name: "messages_total", Labels: Labels{"result": "succ"}},
+	{Pattern: "msg.invalid", Name: "messages_total", Labels: Labels{"result": "invalid"}},
+	{Pattern: "{topic}.consume.qps", Name: "kafka_consumed_total"},
+	{Pattern: "time.redis", Name: "redis_write_duration_seconds", Labels: Labels{"mode": "single"}},
+}
+
+func TestRender(t *testing.T) {
+	e := New(&Config{Namespace: "pd", Labels: map[string]string{"scene": "freq"}}, testRules, logging.DefaultLogger())
+	e.Add("msg.succ", 2)
+	e.Add("msg.succ", 3)
+	e.Add("msg.invalid", 1)
+	e.Add("test_topic.consume.qps", 7)
+	e.Add("reload.succ", 1)
+	e.Set("lag", 12)
+	ch := make(config.KafkaConsumerMsgCh, 10)
+	ch <- &config.KafkaConsumerMsg{}
+	e.MonitorChan("inchan", ch)
+
+	except := `# TYPE pd_kafka_consumed_total counter
+pd_kafka_consumed_total{scene="freq",topic="test_topic"} 7
+# TYPE pd_lag gauge
+pd_lag{scene="freq"} 12
+# TYPE pd_messages_total counter
+pd_messages_total{result="invalid",scene="freq"} 1
+pd_messages_total{result="succ",scene="freq"} 5
+# TYPE pd_reload_succ_total counter
+pd_reload_succ_total{scene="freq"} 1
+# TYPE pd_chan_capacity gauge
+pd_chan_capacity{chan="inchan",scene="freq"} 10
+# TYPE pd_chan_length gauge
+pd_chan_length{chan="inchan",scene="freq"} 1
+`
+	var buf bytes.Buffer
+	e.Render(&buf)
+	if buf.String() != except {
+		t.Errorf("got:\n%s\nexcept:\n%s", buf.String(), except)
+	}
+}
+
+// graphite的包级函数同时写入Exporter，未启用graphite时也生效
+func TestExporterBackend(t *testing.T) {
+	cfg := &Config{Listen: "127.0.0.1:0"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e := New(cfg, testRules, logging.DefaultLogger())
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	graphite.AddBackend(e)
+	graphite.AddQPS("t1.consume", 7)
+	graphite.AddMetric("msg", "succ", 1)
+	graphite.RemoveBackend(e)
+	graphite.Add("msg.succ", 1)
+
+	resp, err := http.Get("http://" + e.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	for _, line := range []string{`kafka_consumed_total{topic="t1"} 7`, `messages_total{result="succ"} 1`} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, b)
+		}
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %s", ct)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []*Config{
+		{Listen: "9108"},
+		{Listen: ":9108", Path: "metrics"},
+		{Listen: ":9108", Namespace: "process-data"},
+		{Listen: ":9108", Labels: map[string]string{"1scene": "x"}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v: except error", c)
+		}
+	}
+	c := &Config{Listen: ":9108"}
+	if err := c.Validate(); err != nil || c.Path != "/metrics" {
+		t.Errorf("%+v %v", c, err)
+	}
+}
+
+func TestRenderHistogram(t *testing.T) {
+	e := New(&Config{}, testRules, logging.DefaultLogger())
+	e.Timing("time.redis", 2*time.Millisecond)
+	e.Timing("time.redis", 2*time.Millisecond)
+	e.Timing("time.redis", 20*time.Second)
+	e.Timing("time.queue", time.Millisecond)
+
+	var buf bytes.Buffer
+	e.Render(&buf)
+	for _, line := range []string{
+		"# TYPE redis_write_duration_seconds histogram",
+		`redis_write_duration_seconds_bucket{mode="single",le="0.001"} 0`,
+		`redis_write_duration_seconds_bucket{mode="single",le="0.0025"} 2`,
+		`redis_write_duration_seconds_bucket{mode="single",le="10"} 2`,
+		`redis_write_duration_seconds_bucket{mode="single",le="+Inf"} 3`,
+		`redis_write_duration_seconds_sum{mode="single"} 20.004`,
+		`redis_write_duration_seconds_count{mode="single"} 3`,
+		"# TYPE time_queue_seconds histogram",
+		`time_queue_seconds_bucket{le="0.001"} 1`,
+		`time_queue_seconds_count 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, buf.String())
+		}
+	}
+}
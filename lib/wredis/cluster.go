@@ -0,0 +1,303 @@
+package wredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	redis "github.com/gomodule/redigo/redis"
+)
+
+const (
+	ClusterSlots        = 16384 // Redis Cluster的slot总数
+	clusterMaxRedirects = 5     // 单条命令最多跟随的MOVED/ASK次数
+)
+
+// clusterClient Redis Cluster客户端
+// 通过CLUSTER SLOTS获取slot分布，按CRC16(key)%16384路由到master
+// 收到MOVED时更新slot并异步刷新拓扑，收到ASK时向目标节点发送ASKING后重试
+type clusterClient struct {
+	name     string
+	seeds    []string
+	maxRetry int
+
+	mu      sync.RWMutex
+	slots   []string               // slot -> master地址
+	pools   map[string]*redis.Pool // 地址 -> 连接池，按需创建
+	newPool func(addr string) *redis.Pool
+
+	refreshing int32 // 1表示正在异步刷新拓扑
+}
+
+func newClusterClient(name string, seeds []string, maxRetry int, newPool func(addr string) *redis.Pool) (*clusterClient, error) {
+	cc := &clusterClient{
+		name:     name,
+		seeds:    seeds,
+		maxRetry: maxRetry,
+		slots:    make([]string, ClusterSlots),
+		pools:    map[string]*redis.Pool{},
+		newPool:  newPool,
+	}
+	if err := cc.refresh(); err != nil {
+		cc.close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Slot 返回key所在的slot，key中包含非空的{hashtag}时只计算hashtag
+func Slot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % ClusterSlots)
+}
+
+// crc16 CRC16-XMODEM，与Redis Cluster一致
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// addrBySlot 返回slot所在的master地址，未知时为空
+func (cc *clusterClient) addrBySlot(slot int) string {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.slots[slot]
+}
+
+// getConn 从addr的连接池获取连接，连接池不存在时创建
+func (cc *clusterClient) getConn(addr string) redis.Conn {
+	cc.mu.RLock()
+	if pool, ok := cc.pools[addr]; ok {
+		conn := pool.Get()
+		cc.mu.RUnlock()
+		return conn
+	}
+	cc.mu.RUnlock()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	pool, ok := cc.pools[addr]
+	if !ok {
+		pool = cc.newPool(addr)
+		cc.pools[addr] = pool
+	}
+	return pool.Get()
+}
+
+// refresh 依次向已知节点和种子节点发送CLUSTER SLOTS，以第一个成功的结果为准
+func (cc *clusterClient) refresh() error {
+	var lastErr error
+	for _, addr := range cc.knownAddrs() {
+		slots, err := cc.fetchSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cc.mu.Lock()
+		cc.slots = slots
+		cc.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("fail to refresh cluster slots, wredis.name: %s, err: %s", cc.name, lastErr)
+}
+
+// refreshAsync 后台刷新拓扑，同一时刻只有一个刷新在进行
+func (cc *clusterClient) refreshAsync() {
+	if !atomic.CompareAndSwapInt32(&cc.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&cc.refreshing, 0)
+		cc.refresh()
+	}()
+}
+
+// knownAddrs 当前slot分布中的master在前，种子节点在后，去重
+func (cc *clusterClient) knownAddrs() []string {
+	seen := map[string]bool{}
+	addrs := []string{}
+	cc.mu.RLock()
+	for _, addr := range cc.slots {
+		if len(addr) > 0 && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	cc.mu.RUnlock()
+	for _, addr := range cc.seeds {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// fetchSlots 解析CLUSTER SLOTS的结果
+// 每项为 [start, end, [master_ip, master_port, ...], [replica_ip, replica_port, ...]...]
+func (cc *clusterClient) fetchSlots(addr string) ([]string, error) {
+	conn := cc.getConn(addr)
+	defer conn.Close()
+	items, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("empty cluster slots from %s", addr)
+	}
+	slots := make([]string, ClusterSlots)
+	for _, item := range items {
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("invalid cluster slots from %s: %v", addr, item)
+		}
+		start, err1 := redis.Int(fields[0], nil)
+		end, err2 := redis.Int(fields[1], nil)
+		master, err3 := redis.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 ||
+			start < 0 || end >= ClusterSlots || start > end {
+			return nil, fmt.Errorf("invalid cluster slots from %s: %v", addr, item)
+		}
+		host, _ := redis.String(master[0], nil)
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster slots from %s: %v", addr, item)
+		}
+		// 节点未配置cluster-announce-ip时可能返回空host，使用当前连接的host
+		if len(host) == 0 {
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		node := net.JoinHostPort(host, strconv.Itoa(port))
+		for s := start; s <= end; s++ {
+			slots[s] = node
+		}
+	}
+	return slots, nil
+}
+
+// parseRedirect 解析 "MOVED 3999 127.0.0.1:6381" 或 "ASK 3999 127.0.0.1:6381"
+func parseRedirect(err error) (kind string, slot int, addr string, ok bool) {
+	rerr, isRedisErr := err.(redis.Error)
+	if !isRedisErr {
+		return "", 0, "", false
+	}
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, convErr := strconv.Atoi(fields[1])
+	if convErr != nil || slot < 0 || slot >= ClusterSlots {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+// do 按key的slot执行命令，args为完整的命令参数
+func (cc *clusterClient) do(key string, cmdName string, args ...interface{}) (interface{}, error) {
+	slot := Slot(key)
+	return cc.doAt(cc.addrBySlot(slot), slot, cmdName, args...)
+}
+
+// doAt 在addr上执行命令并跟随重定向
+// slot小于0表示命令不对应key，网络错误重试时不重新路由
+func (cc *clusterClient) doAt(addr string, slot int, cmdName string, args ...interface{}) (reply interface{}, err error) {
+	asking := false
+	redirects, retry := 0, 0
+	for {
+		if len(addr) == 0 {
+			return nil, fmt.Errorf("slot %d is not served by any node, wredis.name: %s", slot, cc.name)
+		}
+		reply, err = cc.doOnce(addr, asking, cmdName, args...)
+		if err == nil || err == redis.ErrNil {
+			return reply, err
+		}
+		if kind, toSlot, toAddr, ok := parseRedirect(err); ok {
+			if redirects >= clusterMaxRedirects {
+				return reply, fmt.Errorf("too many cluster redirects, last: %s", err)
+			}
+			redirects++
+			asking = kind == "ASK"
+			if !asking {
+				// MOVED说明slot已迁移完成，拓扑可能有多处变化
+				cc.mu.Lock()
+				cc.slots[toSlot] = toAddr
+				cc.mu.Unlock()
+				cc.refreshAsync()
+			}
+			addr = toAddr
+			continue
+		}
+		if _, isRedisErr := err.(redis.Error); isRedisErr {
+			return reply, err
+		}
+		//网络错误, 节点可能已下线, 刷新拓扑后重试
+		if retry >= cc.maxRetry {
+			return reply, err
+		}
+		retry++
+		asking = false
+		if slot >= 0 && cc.refresh() == nil {
+			addr = cc.addrBySlot(slot)
+		}
+	}
+}
+
+func (cc *clusterClient) doOnce(addr string, asking bool, cmdName string, args ...interface{}) (interface{}, error) {
+	conn := cc.getConn(addr)
+	defer conn.Close()
+	if asking {
+		if err := conn.Send("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return conn.Do(cmdName, args...)
+}
+
+// resize 以新的参数创建连接池，旧连接池关闭
+func (cc *clusterClient) resize(newPool func(addr string) *redis.Pool) error {
+	cc.mu.Lock()
+	old := cc.pools
+	cc.pools = map[string]*redis.Pool{}
+	cc.newPool = newPool
+	cc.mu.Unlock()
+	return closePoolMap(cc.name, old)
+}
+
+func (cc *clusterClient) close() error {
+	cc.mu.Lock()
+	old := cc.pools
+	cc.pools = map[string]*redis.Pool{}
+	cc.mu.Unlock()
+	return closePoolMap(cc.name, old)
+}
+
+func closePoolMap(name string, pools map[string]*redis.Pool) error {
+	closeErr := []string{}
+	for addr, p := range pools {
+		if err := p.Close(); err != nil {
+			closeErr = append(closeErr,
+				fmt.Sprintf("fail to close connect pool for server: %s, cluster: %s, err: %s", addr, name, err))
+		}
+	}
+	if len(closeErr) > 0 {
+		return fmt.Errorf("fail to close Wredis, err: %s", strings.Join(closeErr, "|"))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package wredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/server"
+)
+
+// fakeClusterNode 模拟Redis Cluster的一个master，只支持CLUSTER SLOTS/ASKING/GET/SET
+type fakeClusterNode struct {
+	srv  *server.Server
+	addr string
+}
+
+type fakeCluster struct {
+	mu    sync.Mutex
+	nodes []*fakeClusterNode
+	owner []int               // slot -> 节点下标
+	ask   map[int]int         // 迁移中的slot -> 目标节点下标
+	data  []map[string]string // 各节点的数据
+	cmds  []int               // 各节点收到的GET/SET数
+}
+
+func newFakeCluster(t *testing.T, n int) *fakeCluster {
+	fc := &fakeCluster{
+		owner: make([]int, ClusterSlots),
+		ask:   map[int]int{},
+	}
+	for i := 0; i < n; i++ {
+		srv, err := server.NewServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &fakeClusterNode{srv: srv, addr: srv.Addr().String()}
+		fc.nodes = append(fc.nodes, node)
+		fc.data = append(fc.data, map[string]string{})
+		fc.cmds = append(fc.cmds, 0)
+		fc.register(i)
+	}
+	// 平均分配slot
+	for s := 0; s < ClusterSlots; s++ {
+		fc.owner[s] = s * n / ClusterSlots
+	}
+	return fc
+}
+
+func (fc *fakeCluster) close() {
+	for _, node := range fc.nodes {
+		node.srv.Close()
+	}
+}
+
+func (fc *fakeCluster) addrs() []string {
+	addrs := []string{}
+	for _, node := range fc.nodes {
+		addrs = append(addrs, node.addr)
+	}
+	return addrs
+}
+
+func (fc *fakeCluster) register(i int) {
+	srv := fc.nodes[i].srv
+	srv.Register("CLUSTER", func(c *server.Peer, cmd string, args []string) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		type rng struct{ start, end, node int }
+		ranges := []rng{}
+		for s := 0; s < ClusterSlots; s++ {
+			if len(ranges) > 0 && ranges[len(ranges)-1].node == fc.owner[s] {
+				ranges[len(ranges)-1].end = s
+				continue
+			}
+			ranges = append(ranges, rng{s, s, fc.owner[s]})
+		}
+		c.WriteLen(len(ranges))
+		for _, r := range ranges {
+			host, port, _ := net.SplitHostPort(fc.nodes[r.node].addr)
+			p, _ := strconv.Atoi(port)
+			c.WriteLen(3)
+			c.WriteInt(r.start)
+			c.WriteInt(r.end)
+			c.WriteLen(2)
+			c.WriteBulk(host)
+			c.WriteInt(p)
+		}
+	})
+	srv.Register("ASKING", func(c *server.Peer, cmd string, args []string) {
+		c.Ctx = "asking"
+		c.WriteOK()
+	})
+	handle := func(c *server.Peer, cmd string, args []string) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		asking := c.Ctx == "asking"
+		c.Ctx = nil
+		slot := Slot(args[0])
+		if to, ok := fc.ask[slot]; ok && fc.owner[slot] == i {
+			c.WriteError(fmt.Sprintf("ASK %d %s", slot, fc.nodes[to].addr))
+			return
+		}
+		if fc.owner[slot] != i {
+			if to, ok := fc.ask[slot]; !ok || to != i || !asking {
+				c.WriteError(fmt.Sprintf("MOVED %d %s", slot, fc.nodes[fc.owner[slot]].addr))
+				return
+			}
+		}
+		fc.cmds[i]++
+		if cmd == "SET" {
+			fc.data[i][args[0]] = args[1]
+			c.WriteOK()
+			return
+		}
+		v, ok := fc.data[i][args[0]]
+		if !ok {
+			c.WriteNull()
+			return
+		}
+		c.WriteBulk(v)
+	}
+	srv.Register("GET", handle)
+	srv.Register("SET", handle)
+}
+
+func newTestClusterWRedis(t *testing.T, fc *fakeCluster) *WRedis {
+	cfg, err := generateRedisClusterConfig(fc.addrs()[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Mode = "cluster"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewWithConfig(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Fatalf("crc16 = %x, except 31c3", crc)
+	}
+	cases := map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+	}
+	for key, tag := range cases {
+		if Slot(key) != Slot(tag) {
+			t.Errorf("slot of %s != slot of %s", key, tag)
+		}
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	fc := newFakeCluster(t, 3)
+	defer fc.close()
+	c := newTestClusterWRedis(t, fc)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%d_transmit_new", i)
+		if _, err := c.DoByHash("SET", key, i); err != nil {
+			t.Fatalf("SET %s: %s", key, err)
+		}
+	}
+	// 数据都落在slot所属的节点上
+	for i, data := range fc.data {
+		for key := range data {
+			if fc.owner[Slot(key)] != i {
+				t.Fatalf("key %s on node %d, except %d", key, i, fc.owner[Slot(key)])
+			}
+		}
+	}
+}
+
+func TestClusterMoved(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	defer fc.close()
+	c := newTestClusterWRedis(t, fc)
+	defer c.Close()
+
+	key := "moved_key"
+	slot := Slot(key)
+	from := fc.owner[slot]
+	to := 1 - from
+
+	// slot迁移到另一个节点
+	fc.mu.Lock()
+	fc.owner[slot] = to
+	fc.mu.Unlock()
+
+	if _, err := c.DoByHash("SET", key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if fc.data[to][key] != "v" {
+		t.Fatalf("key not written to node %d", to)
+	}
+	// MOVED后slot已更新，不再访问旧节点
+	fc.mu.Lock()
+	before := fc.cmds[from]
+	fc.mu.Unlock()
+	v, err := c.DoByHash("GET", key)
+	if err != nil || string(v.([]byte)) != "v" {
+		t.Fatalf("GET %s = %v, %v", key, v, err)
+	}
+	if c.cluster.addrBySlot(slot) != fc.nodes[to].addr || fc.cmds[from] != before {
+		t.Fatalf("slot %d not updated after MOVED", slot)
+	}
+}
+
+func TestClusterAsk(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	defer fc.close()
+	c := newTestClusterWRedis(t, fc)
+	defer c.Close()
+
+	key := "ask_key"
+	slot := Slot(key)
+	from := fc.owner[slot]
+	to := 1 - from
+
+	// slot迁移中，key已在目标节点
+	fc.mu.Lock()
+	fc.ask[slot] = to
+	fc.mu.Unlock()
+
+	if _, err := c.DoByHash("SET", key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if fc.data[to][key] != "v" {
+		t.Fatalf("key not written to node %d", to)
+	}
+	// ASK不更新slot分布
+	if c.cluster.addrBySlot(slot) != fc.nodes[from].addr {
+		t.Fatalf("slot %d should not be updated after ASK", slot)
+	}
+}
+
+func TestClusterRefreshOnNodeDown(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	defer fc.close()
+	c := newTestClusterWRedis(t, fc)
+	defer c.Close()
+
+	key := "failover_key"
+	slot := Slot(key)
+	from := fc.owner[slot]
+	to := 1 - from
+
+	// 节点下线，slot全部由另一个节点接管
+	fc.mu.Lock()
+	for s := range fc.owner {
+		fc.owner[s] = to
+	}
+	fc.mu.Unlock()
+	fc.nodes[from].srv.Close()
+
+	if _, err := c.DoByHash("SET", key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if fc.data[to][key] != "v" {
+		t.Fatalf("key not written to node %d", to)
+	}
+}
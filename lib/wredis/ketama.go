@@ -0,0 +1,71 @@
+package wredis
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// 每个权重单位对应的虚拟节点数，与ketama一致：40次md5，每次取4个点
+const ketamaPointsPerWeight = 160
+
+// NodeHashCallBack 根据节点列表生成哈希函数，哈希值即节点下标
+type NodeHashCallBack func(servers []string, weights []int) HashCallBack
+
+var NodeHashHandler = map[string]NodeHashCallBack{
+	"KETAMA": func(servers []string, weights []int) HashCallBack {
+		return NewKetamaRing(servers, weights).Hash
+	},
+}
+
+type ketamaPoint struct {
+	hash  uint32
+	index uint64
+}
+
+// KetamaRing 带虚拟节点和权重的一致性哈希环
+// 增删一个节点时，只有约1/N的key会被重新映射
+type KetamaRing struct {
+	points []ketamaPoint
+}
+
+// NewKetamaRing weights与servers一一对应，为空或小于等于0时权重为1
+func NewKetamaRing(servers []string, weights []int) *KetamaRing {
+	r := &KetamaRing{}
+	for i, server := range servers {
+		weight := 1
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		for j := 0; j < weight*ketamaPointsPerWeight/4; j++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", server, j)))
+			for k := 0; k < 4; k++ {
+				r.points = append(r.points, ketamaPoint{
+					hash:  binary.LittleEndian.Uint32(digest[k*4:]),
+					index: uint64(i),
+				})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// Hash 返回key所在节点的下标
+func (r *KetamaRing) Hash(key string) uint64 {
+	if len(r.points) == 0 {
+		return 0
+	}
+	digest := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(digest[:4])
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].index
+}
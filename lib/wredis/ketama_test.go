@@ -0,0 +1,66 @@
+package wredis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ketamaServers(n int) []string {
+	servers := []string{}
+	for i := 0; i < n; i++ {
+		servers = append(servers, fmt.Sprintf("10.0.0.%d:6379", i+1))
+	}
+	return servers
+}
+
+// 增加一个节点，只有约1/N的key迁移，且只迁移到新节点
+func TestKetamaAddNode(t *testing.T) {
+	keyNum := 100000
+	for _, n := range []int{4, 8, 16} {
+		before := NewKetamaRing(ketamaServers(n), nil)
+		after := NewKetamaRing(ketamaServers(n+1), nil)
+
+		moved := 0
+		for i := 0; i < keyNum; i++ {
+			key := fmt.Sprintf("%d_transmit_new", i)
+			from, to := before.Hash(key), after.Hash(key)
+			if from == to {
+				continue
+			}
+			moved++
+			if to != uint64(n) {
+				t.Fatalf("nodes %d: key %s moved from %d to old node %d", n, key, from, to)
+			}
+		}
+		ratio := float64(moved) / float64(keyNum)
+		except := 1 / float64(n+1)
+		t.Logf("nodes %d -> %d: moved %.4f, except %.4f", n, n+1, ratio, except)
+		if ratio > except*1.5 || ratio < except*0.5 {
+			t.Errorf("nodes %d -> %d: moved %.4f, except about %.4f", n, n+1, ratio, except)
+		}
+	}
+}
+
+func TestKetamaWeight(t *testing.T) {
+	keyNum := 100000
+	r := NewKetamaRing(ketamaServers(3), []int{1, 1, 2})
+	counts := make([]int, 3)
+	for i := 0; i < keyNum; i++ {
+		counts[r.Hash(fmt.Sprintf("key_%d", i))]++
+	}
+	t.Logf("counts %v", counts)
+	// 权重为2的节点约占1/2
+	ratio := float64(counts[2]) / float64(keyNum)
+	if ratio < 0.4 || ratio > 0.6 {
+		t.Errorf("weight 2 node ratio %.4f, except about 0.5", ratio)
+	}
+}
+
+func TestKetamaNodeHashHandler(t *testing.T) {
+	hasher := NodeHashHandler["KETAMA"](ketamaServers(5), nil)
+	for i := 0; i < 1000; i++ {
+		if idx := hasher(fmt.Sprintf("key_%d", i)); idx >= 5 {
+			t.Fatalf("index %d out of range", idx)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package wredis
+
+import (
+	"fmt"
+	"sync"
+
+	redis "github.com/gomodule/redigo/redis"
+)
+
+// PipelineResult 批量命令中一条命令的结果
+type PipelineResult struct {
+	Reply interface{}
+	Err   error
+}
+
+// pipelineShard 分片模式下为实例下标，集群模式下为节点地址
+type pipelineShard struct {
+	index uint64
+	addr  string
+}
+
+type pipelineCmd struct {
+	index   int // 在Send顺序中的下标
+	cmdName string
+	key     string
+	args    []interface{} // 完整的命令参数
+}
+
+// Pipeline 批量写入，按key所在的实例分组，每个实例一次往返
+// 不是goroutine-safe，每个worker各自持有
+type Pipeline struct {
+	c       *WRedis
+	n       int
+	cmds    map[pipelineShard][]pipelineCmd
+	scripts []pipelineScript
+}
+
+type pipelineScript struct {
+	index  int
+	script *Script
+	key    string
+	args   []interface{}
+}
+
+// NewPipeline 创建批量写入
+func (c *WRedis) NewPipeline() *Pipeline {
+	return &Pipeline{c: c, cmds: map[pipelineShard][]pipelineCmd{}}
+}
+
+// Len 已Send未Flush的命令数
+func (p *Pipeline) Len() int {
+	return p.n
+}
+
+// Send 缓存一条命令，Flush时发送
+func (p *Pipeline) Send(cmdName string, key string, args ...interface{}) {
+	p.send(key, cmdName, append([]interface{}{key}, args...))
+}
+
+// Eval 缓存一条脚本命令，实例上没有脚本时Flush会改用EVAL重试
+func (p *Pipeline) Eval(script *Script, key string, args ...interface{}) {
+	p.scripts = append(p.scripts, pipelineScript{index: p.n, script: script, key: key, args: args})
+	p.send(key, "EVALSHA", script.evalArgs("EVALSHA", key, args))
+}
+
+func (p *Pipeline) send(key string, cmdName string, args []interface{}) {
+	var shard pipelineShard
+	if p.c.cluster != nil {
+		shard.addr = p.c.cluster.addrBySlot(Slot(key))
+	} else if p.c.Hasher != nil {
+		shard.index = p.c.Hasher(key) % uint64(len(p.c.Servers))
+	}
+	p.cmds[shard] = append(p.cmds[shard], pipelineCmd{index: p.n, cmdName: cmdName, key: key, args: args})
+	p.n++
+}
+
+// Flush 各实例并行发送缓存的命令并接收结果，返回值与Send顺序一致，之后Pipeline可复用
+// 网络错误时整组重发，命令需可重复执行
+func (p *Pipeline) Flush() []PipelineResult {
+	results := make([]PipelineResult, p.n)
+	var wg sync.WaitGroup
+	for shard, cmds := range p.cmds {
+		wg.Add(1)
+		go func(shard pipelineShard, cmds []pipelineCmd) {
+			defer wg.Done()
+			p.flushShard(shard, cmds, results)
+		}(shard, cmds)
+	}
+	wg.Wait()
+	for _, ps := range p.scripts {
+		if isNoScript(results[ps.index].Err) {
+			r, err := p.c.EvalByHash(ps.script, ps.key, ps.args...)
+			results[ps.index] = PipelineResult{Reply: r, Err: err}
+		}
+	}
+	p.cmds = map[pipelineShard][]pipelineCmd{}
+	p.scripts = nil
+	p.n = 0
+	return results
+}
+
+func (p *Pipeline) flushShard(shard pipelineShard, cmds []pipelineCmd, results []PipelineResult) {
+	if p.c.cluster != nil {
+		p.flushClusterShard(shard.addr, cmds, results)
+		return
+	}
+	if p.c.Hasher == nil {
+		err := fmt.Errorf("cannot found hash callback function. wredis.name: %s", p.c.Name)
+		for _, cmd := range cmds {
+			results[cmd.index].Err = err
+		}
+		return
+	}
+	var err error
+	for retry := 0; retry <= p.c.MaxRetry; retry++ {
+		var conn redis.Conn
+		conn, err = p.c.getConn(shard.index)
+		if err != nil {
+			break
+		}
+		err = pipelineDo(conn, cmds, results)
+		conn.Close()
+		if err == nil {
+			return
+		}
+	}
+	for _, cmd := range cmds {
+		results[cmd.index] = PipelineResult{Err: err}
+	}
+}
+
+// flushClusterShard 集群模式，MOVED/ASK或网络错误的命令逐条重试，由clusterClient跟随重定向
+func (p *Pipeline) flushClusterShard(addr string, cmds []pipelineCmd, results []PipelineResult) {
+	cc := p.c.cluster
+	if len(addr) > 0 {
+		conn := cc.getConn(addr)
+		err := pipelineDo(conn, cmds, results)
+		conn.Close()
+		if err == nil {
+			retryCmds := []pipelineCmd{}
+			for _, cmd := range cmds {
+				if _, _, _, ok := parseRedirect(results[cmd.index].Err); ok {
+					retryCmds = append(retryCmds, cmd)
+				}
+			}
+			cmds = retryCmds
+		}
+	}
+	for _, cmd := range cmds {
+		r, err := cc.do(cmd.key, cmd.cmdName, cmd.args...)
+		results[cmd.index] = PipelineResult{Reply: r, Err: err}
+	}
+}
+
+// pipelineDo 在一个连接上Send全部命令后Flush，再依次Receive
+// 返回值为连接错误，单条命令的错误记录在results中
+func pipelineDo(conn redis.Conn, cmds []pipelineCmd, results []PipelineResult) error {
+	for _, cmd := range cmds {
+		if err := conn.Send(cmd.cmdName, cmd.args...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		r, err := conn.Receive()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return err
+			}
+		}
+		results[cmd.index] = PipelineResult{Reply: r, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package wredis
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	mockCluster, err := NewMockCluster(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockCluster.Close()
+	cfg, err := generateRedisClusterConfig(mockCluster.Addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Validate()
+	wr, err := NewWithConfig(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wr.Close()
+
+	p := wr.NewPipeline()
+	for i := 0; i < 100; i++ {
+		p.Send("SET", fmt.Sprintf("key_%d", i), i, "EX", 60)
+	}
+	// 单条命令失败不影响其他命令
+	p.Send("HSET", "key_0", "f", "v")
+	if p.Len() != 101 {
+		t.Fatalf("pipeline len %d, except 101", p.Len())
+	}
+	results := p.Flush()
+	if len(results) != 101 || p.Len() != 0 {
+		t.Fatalf("results %d, pipeline len %d", len(results), p.Len())
+	}
+	for i := 0; i < 100; i++ {
+		if results[i].Err != nil {
+			t.Fatalf("SET key_%d: %s", i, results[i].Err)
+		}
+	}
+	if results[100].Err == nil {
+		t.Fatal("HSET on string key should fail")
+	}
+
+	// key写入了DoByHash所在的实例，且带过期时间
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		node := mockCluster.Nodes[wr.Hasher(key)%uint64(len(wr.Servers))]
+		if v, err := node.Get(key); err != nil || v != fmt.Sprint(i) {
+			t.Fatalf("GET %s = %s, %v", key, v, err)
+		}
+		if ttl := node.TTL(key); ttl != 60*time.Second {
+			t.Fatalf("TTL %s = %s, except 60s", key, ttl)
+		}
+	}
+}
+
+func TestClusterPipeline(t *testing.T) {
+	fc := newFakeCluster(t, 3)
+	defer fc.close()
+	c := newTestClusterWRedis(t, fc)
+	defer c.Close()
+
+	// 部分slot迁移，pipeline中对应的命令收到MOVED后重试
+	fc.mu.Lock()
+	for i := 0; i < 100; i += 10 {
+		slot := Slot(fmt.Sprintf("key_%d", i))
+		fc.owner[slot] = (fc.owner[slot] + 1) % 3
+	}
+	fc.mu.Unlock()
+
+	p := c.NewPipeline()
+	for i := 0; i < 100; i++ {
+		p.Send("SET", fmt.Sprintf("key_%d", i), i)
+	}
+	for i, r := range p.Flush() {
+		if r.Err != nil {
+			t.Fatalf("SET key_%d: %s", i, r.Err)
+		}
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if _, ok := fc.data[fc.owner[Slot(key)]][key]; !ok {
+			t.Fatalf("key %s not on node %d", key, fc.owner[Slot(key)])
+		}
+	}
+}
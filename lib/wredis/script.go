@@ -0,0 +1,43 @@
+package wredis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+
+	redis "github.com/gomodule/redigo/redis"
+)
+
+// Script 只操作一个key的Lua脚本，集群模式下按key路由
+type Script struct {
+	src  string
+	hash string
+}
+
+func NewScript(src string) *Script {
+	h := sha1.Sum([]byte(src))
+	return &Script{src: src, hash: hex.EncodeToString(h[:])}
+}
+
+func (s *Script) evalArgs(cmd string, key string, args []interface{}) []interface{} {
+	body := s.hash
+	if cmd == "EVAL" {
+		body = s.src
+	}
+	return append([]interface{}{body, 1, key}, args...)
+}
+
+// isNoScript 脚本未加载到实例
+func isNoScript(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "NOSCRIPT ")
+}
+
+// EvalByHash 在key所在实例执行脚本, 先EVALSHA, 实例上没有脚本时EVAL
+func (c *WRedis) EvalByHash(script *Script, key string, args ...interface{}) (reply interface{}, err error) {
+	reply, err = c.doByKey(key, "EVALSHA", script.evalArgs("EVALSHA", key, args)...)
+	if isNoScript(err) {
+		return c.doByKey(key, "EVAL", script.evalArgs("EVAL", key, args)...)
+	}
+	return reply, err
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	redis "github.com/gomodule/redigo/redis"
@@ -28,32 +29,55 @@ type WRedis struct {
 	Hasher   HashCallBack
 	Pools    []*redis.Pool
 	MaxRetry int
+
+	mu      sync.RWMutex                                            // 保护Pools，Resize时替换
+	newPool func(server string, maxIdle, maxActive int) *redis.Pool // 以相同的连接参数创建连接池
+
+	cluster *clusterClient // 不为nil时为Redis Cluster模式，Servers为种子节点，Hasher/Pools不使用
+}
+
+// getConn 从第index个实例的连接池获取连接
+func (c *WRedis) getConn(index uint64) (redis.Conn, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	pool := c.Pools[index]
+	if pool == nil {
+		return nil, fmt.Errorf("cannot found connection pool for server: %s", c.Servers[index])
+	}
+	return pool.Get(), nil
 }
 
 //WRedis.DoByHash()
 //DoByHash wrap redis.DO and execute command in redis server that hashed by user defined hasher
 func (c *WRedis) DoByHash(cmdName string, key string, args ...interface{}) (reply interface{}, err error) {
+	return c.doByKey(key, cmdName, append([]interface{}{key}, args...)...)
+}
+
+//doByKey 按key选择实例执行命令, args为完整的命令参数, key不一定是第一个参数(如EVALSHA)
+func (c *WRedis) doByKey(key string, cmdName string, args ...interface{}) (reply interface{}, err error) {
+	if c.cluster != nil {
+		//集群模式按slot路由, 重定向与重试由clusterClient处理
+		return c.cluster.do(key, cmdName, args...)
+	}
 	if c.Hasher == nil {
 		//找不到哈希函数, 报错
 		return "", fmt.Errorf("cannot found hash callback function. wredis.name: %s", c.Name)
 	}
 	//哈希获得操作的实例下标
 	index := c.Hasher(key) % uint64(len(c.Servers))
-	//寻找连接池
-	pool := c.Pools[index]
-	if pool == nil {
-		return "", fmt.Errorf("cannot found connection pool for server: %s", c.Servers[index])
+	//寻找连接池, 获取连接
+	conn, err := c.getConn(index)
+	if err != nil {
+		return "", err
 	}
-	//获取连接
-	conn := pool.Get()
 	defer conn.Close()
 	//重试机制
-	r, err := conn.Do(cmdName, append([]interface{}{key}, args...)...)
+	r, err := conn.Do(cmdName, args...)
 	if err == nil || err == redis.ErrNil {
 		return r, err
 	}
 	for retry := 0; retry < c.MaxRetry; retry++ {
-		r, err = conn.Do(cmdName, append([]interface{}{key}, args...)...)
+		r, err = conn.Do(cmdName, args...)
 		if err == nil || err == redis.ErrNil {
 			return r, err
 		}
@@ -67,13 +91,14 @@ func (c *WRedis) Do(index uint64, cmdName string, args ...interface{}) (reply in
 	if index >= uint64(len(c.Servers)) {
 		return "", fmt.Errorf("invalid index of redis, must less than: %d", len(c.Servers))
 	}
-	//寻找连接池
-	pool := c.Pools[index]
-	if pool == nil {
-		return "", fmt.Errorf("cannot found connection pool for server: %s", c.Servers[index])
+	if c.cluster != nil {
+		return c.cluster.doAt(c.Servers[index], -1, cmdName, args...)
+	}
+	//寻找连接池, 获取连接
+	conn, err := c.getConn(index)
+	if err != nil {
+		return "", err
 	}
-	//获取连接
-	conn := pool.Get()
 	defer conn.Close()
 	//重试机制
 	r, err := conn.Do(cmdName, args...)
@@ -89,14 +114,51 @@ func (c *WRedis) Do(index uint64, cmdName string, args ...interface{}) (reply in
 	return r, err
 }
 
+//Resize 以新的连接池大小重建各实例的连接池, 旧连接池中使用中的连接归还时关闭
+func (c *WRedis) Resize(maxIdle int, maxActive int) error {
+	if c.newPool == nil {
+		return fmt.Errorf("wredis %s does not support resize", c.Name)
+	}
+	if c.cluster != nil {
+		return c.cluster.resize(func(addr string) *redis.Pool {
+			return c.newPool(addr, maxIdle, maxActive)
+		})
+	}
+	poolSlice := []*redis.Pool{}
+	for _, s := range c.Servers {
+		pool := c.newPool(s, maxIdle, maxActive)
+		if pool == nil {
+			return fmt.Errorf("cannot create connect pool for server: %s", s)
+		}
+		poolSlice = append(poolSlice, pool)
+	}
+
+	c.mu.Lock()
+	oldPools := c.Pools
+	c.Pools = poolSlice
+	c.mu.Unlock()
+
+	return c.closePools(oldPools)
+}
+
 //Close release underlaying resource of WRedis
 func (c *WRedis) Close() error {
+	if c.cluster != nil {
+		return c.cluster.close()
+	}
+	c.mu.RLock()
+	pools := c.Pools
+	c.mu.RUnlock()
+	return c.closePools(pools)
+}
+
+func (c *WRedis) closePools(pools []*redis.Pool) error {
 	//仅释放集群内各实例已创建的连接池
-	if c.Pools == nil || len(c.Pools) <= 0 {
+	if pools == nil || len(pools) <= 0 {
 		return nil
 	}
 	closeErr := []string{}
-	for i, p := range c.Pools {
+	for i, p := range pools {
 		err := p.Close()
 		if err != nil {
 			closeErr = append(closeErr,
@@ -109,17 +171,8 @@ func (c *WRedis) Close() error {
 	return nil
 }
 
-/*
-WRedis.Send
-func (c *WRedis) Send(cmdName string, key string, args ...interface{}) error {
-	fmt.Printf("call WConn.Send, cmd: %s, key: %s, args: %v \n", cmdName, key, args)
-	return nil
-}
-*/
-
-//WRedis.Flush
-
-//WRedis.Receive
+//WRedis.Send/Flush/Receive
+//批量命令见Pipeline: NewPipeline().Send(...)缓存, Flush()按实例分组发送并接收结果
 
 //WRedis.New
 //New create new instance of struct WRedis, return error when any error occurs
@@ -146,10 +199,16 @@ func New(name string, servers []string, db int, hasher HashCallBack, maxIdle int
 		Hasher:   hasher,
 		Pools:    poolSlice,
 		MaxRetry: maxRetry,
+		newPool: func(server string, maxIdle, maxActive int) *redis.Pool {
+			return NewPool(server, db, maxIdle, maxActive, idleTimeout, connectTimeout, readTimeout, writeTimeout)
+		},
 	}, nil
 }
 
 func NewWithConfig(cfg *config.RedisCluster) (*WRedis, error) {
+	if cfg.Mode == config.RedisModeCluster {
+		return newClusterWithConfig(cfg)
+	}
 	// 初始化所有实例连接池
 	poolSlice := []*redis.Pool{}
 	for _, s := range cfg.Servers {
@@ -166,7 +225,10 @@ func NewWithConfig(cfg *config.RedisCluster) (*WRedis, error) {
 		}
 		poolSlice = append(poolSlice, pool)
 	}
-	hasher := HashHandler[cfg.Hasher]
+	hasher, err := newHasher(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	return &WRedis{
 		Name:     cfg.Name,
@@ -174,9 +236,59 @@ func NewWithConfig(cfg *config.RedisCluster) (*WRedis, error) {
 		Hasher:   hasher,
 		Pools:    poolSlice,
 		MaxRetry: cfg.MaxRetry,
+		newPool: func(server string, maxIdle, maxActive int) *redis.Pool {
+			return NewPool(server,
+				cfg.Database,
+				maxIdle,
+				maxActive,
+				cfg.IdleTimeout.Duration,
+				cfg.DialConnectTimeout.Duration,
+				cfg.DialReadTimeout.Duration,
+				cfg.DialWriteTimeout.Duration)
+		},
 	}, nil
 }
 
+//newClusterWithConfig Redis Cluster模式, cfg.Servers为种子节点, 启动时需至少一个可用
+func newClusterWithConfig(cfg *config.RedisCluster) (*WRedis, error) {
+	newPool := func(server string, maxIdle, maxActive int) *redis.Pool {
+		return NewPool(server,
+			0,
+			maxIdle,
+			maxActive,
+			cfg.IdleTimeout.Duration,
+			cfg.DialConnectTimeout.Duration,
+			cfg.DialReadTimeout.Duration,
+			cfg.DialWriteTimeout.Duration)
+	}
+	maxIdle, maxActive := cfg.MaxIdle, cfg.MaxActive
+	cluster, err := newClusterClient(cfg.Name, cfg.Servers, cfg.MaxRetry, func(addr string) *redis.Pool {
+		return newPool(addr, maxIdle, maxActive)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &WRedis{
+		Name:     cfg.Name,
+		Servers:  cfg.Servers,
+		MaxRetry: cfg.MaxRetry,
+		newPool:  newPool,
+		cluster:  cluster,
+	}, nil
+}
+
+//newHasher 按cfg.Hasher选择哈希函数, KETAMA等需要节点信息的哈希函数由NodeHashHandler生成
+func newHasher(cfg *config.RedisCluster) (HashCallBack, error) {
+	if hasher, ok := HashHandler[cfg.Hasher]; ok {
+		return hasher, nil
+	}
+	if newNodeHasher, ok := NodeHashHandler[cfg.Hasher]; ok {
+		return newNodeHasher(cfg.Servers, cfg.Weights), nil
+	}
+	return nil, fmt.Errorf("unknown hasher %q, wredis.name: %s", cfg.Hasher, cfg.Name)
+}
+
 //NewDefault create intance of WRedis, using default config
 func NewDefault(name string, servers []string, hasher HashCallBack) (*WRedis, error) {
 	return New(name, servers, DEFAULT_DB, hasher, DEFAULT_MAX_IDLE, DEFAULT_MAX_ACTIVE, DEFAULT_IDLE_TIMEOUT, DEFAULT_CONNECT_TIMEOUT, DEFAULT_READ_TIMEOUT, DEFAULT_WRITE_TIMEOUT, DEFAULT_MAX_RETRY)
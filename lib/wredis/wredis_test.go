@@ -4,7 +4,7 @@ package wredis
 
 import (
 	"fmt"
-	lt "git.intra.weibo.com/ad/adx/alaya/lib/time"
+	lt "process_data/lib/time"
 	"github.com/alicebob/miniredis"
 	redis "github.com/gomodule/redigo/redis"
 	"process_data/config"